@@ -7,24 +7,48 @@ import (
 	usermodel "users/model"
 )
 
+//FormatEvents builds the v1 response straight from the events-go history.
 func FormatEvents(usrinfo usermodel.User, events eventmodel.Events) model.UserResponse {
-	if len(events.Events) == 0 {
-		return model.UserResponse{
-			UserInfo: usrinfo,
-			Events:   []map[string]string{},
-		}
-	}
-	formattedevent := []map[string]string{}
+	return ToV1(FormatUserEvents(usrinfo, events))
+}
+
+//FormatUserEvents builds the typed v2 response. events-go only stores granted
+//swipes, so every stored event is reported as granted.
+func FormatUserEvents(usrinfo usermodel.User, events eventmodel.Events) model.UserEvents {
+	formattedevent := []model.Event{}
 	for _, val := range events.Events {
 		for key, unixtime := range val {
-			timeStamp := time.Unix(unixtime, 0)
-			formattedevent = append(formattedevent, map[string]string{
-				key: timeStamp.String(),
+			formattedevent = append(formattedevent, model.Event{
+				Username:  events.Username,
+				Door:      key,
+				Timestamp: time.Unix(unixtime, 0).UTC(),
+				Outcome:   model.OutcomeGranted,
 			})
 		}
 	}
-	return model.UserResponse{
+	return model.UserEvents{
 		UserInfo: usrinfo,
 		Events:   formattedevent,
 	}
 }
+
+//ToV1 adapts the typed response to the v1 shape of door -> local time string.
+func ToV1(response model.UserEvents) model.UserResponse {
+	return ToV1Formatted(response, FormatOptions{})
+}
+
+//ToV1Formatted is ToV1 with timestamps rendered per opts. Relative labels have
+//no place in the v1 shape and are ignored.
+func ToV1Formatted(response model.UserEvents, opts FormatOptions) model.UserResponse {
+	formattedevent := []map[string]string{}
+	for _, event := range response.Events {
+		formattedevent = append(formattedevent, map[string]string{
+			event.Door: FormatTime(event.Timestamp, opts),
+		})
+	}
+	return model.UserResponse{
+		UserInfo:   response.UserInfo,
+		Events:     formattedevent,
+		NextCursor: response.NextCursor,
+	}
+}
@@ -70,3 +70,162 @@ func TestFormatEvents(t *testing.T) {
 		})
 	}
 }
+
+func TestQueryEvents(t *testing.T) {
+	events := eventmodel.Events{
+		Username: "abc",
+		Events: []map[string]int64{
+			{"Door1": 100},
+			{"Door2": 200},
+			{"Door1": 300},
+			{"Door1": 300},
+			{"Door2": 400},
+		},
+	}
+	tests := []struct {
+		name  string
+		query model.EventQuery
+		pages [][]map[string]int64
+	}{
+		{
+			name:  "No filters",
+			query: model.EventQuery{},
+			pages: [][]map[string]int64{events.Events},
+		},
+		{
+			name:  "Door and time range",
+			query: model.EventQuery{Door: "Door1", From: time.Unix(200, 0), To: time.Unix(400, 0)},
+			pages: [][]map[string]int64{{{"Door1": 300}, {"Door1": 300}}},
+		},
+		{
+			name:  "Denied outcome",
+			query: model.EventQuery{Outcome: model.OutcomeDenied},
+			pages: [][]map[string]int64{{}},
+		},
+		{
+			name:  "Descending pages split ties",
+			query: model.EventQuery{Order: model.OrderDesc, Limit: 2},
+			pages: [][]map[string]int64{
+				{{"Door2": 400}, {"Door1": 300}},
+				{{"Door1": 300}, {"Door2": 200}},
+				{{"Door1": 100}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := test.query
+			for i, want := range test.pages {
+				page, next, err := QueryEvents(events, query)
+				if err != nil {
+					t.Fatalf("page %d: unexpected error %v", i, err)
+				}
+				if diff := cmp.Diff(page.Events, want, cmpopts.EquateEmpty()); diff != "" {
+					t.Fatalf("page %d differs: (-got +want)\n%s", i, diff)
+				}
+				if (next == "") != (i == len(test.pages)-1) {
+					t.Fatalf("page %d: unexpected cursor %q", i, next)
+				}
+				query.Cursor = next
+			}
+		})
+	}
+
+	_, next, _ := QueryEvents(events, model.EventQuery{Door: "Door1", Outcome: model.OutcomeGranted, From: time.Unix(100, 0), Limit: 1})
+	invalid := []struct {
+		name  string
+		query model.EventQuery
+		err   error
+	}{
+		{name: "Bogus cursor", query: model.EventQuery{Cursor: "bogus"}, err: ErrInvalidCursor},
+		{name: "Unknown outcome", query: model.EventQuery{Outcome: "maybe"}, err: ErrInvalidOutcome},
+		{name: "Unknown order", query: model.EventQuery{Order: "up"}, err: ErrInvalidOrder},
+		{name: "Cursor of other door", query: model.EventQuery{Door: "Door2", Outcome: model.OutcomeGranted, From: time.Unix(100, 0), Cursor: next}, err: ErrInvalidCursor},
+		{name: "Cursor of other outcome", query: model.EventQuery{Door: "Door1", From: time.Unix(100, 0), Cursor: next}, err: ErrInvalidCursor},
+		{name: "Cursor of other range", query: model.EventQuery{Door: "Door1", Outcome: model.OutcomeGranted, From: time.Unix(200, 0), Cursor: next}, err: ErrInvalidCursor},
+		{name: "Cursor of other order", query: model.EventQuery{Door: "Door1", Outcome: model.OutcomeGranted, From: time.Unix(100, 0), Order: model.OrderDesc, Cursor: next}, err: ErrInvalidCursor},
+	}
+	for _, test := range invalid {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := QueryEvents(events, test.query); err != test.err {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+	if _, _, err := QueryEvents(events, model.EventQuery{Door: "Door1", Outcome: model.OutcomeGranted, From: time.Unix(100, 0), Cursor: next}); err != nil {
+		t.Fatalf("expected the cursor to continue its own query, got %v", err)
+	}
+}
+
+func TestFormatUserEvents(t *testing.T) {
+	userinfoval := usermodel.User{Username: "abc"}
+	events := eventmodel.Events{
+		Username: "abc",
+		Events:   []map[string]int64{{"Door1": 1600000000}},
+	}
+	want := model.UserEvents{
+		UserInfo: userinfoval,
+		Events: []model.Event{{
+			Username:  "abc",
+			Door:      "Door1",
+			Timestamp: time.Date(2020, time.September, 13, 12, 26, 40, 0, time.UTC),
+			Outcome:   model.OutcomeGranted,
+		}},
+	}
+	actual := FormatUserEvents(userinfoval, events)
+	if diff := cmp.Diff(actual, want); diff != "" {
+		t.Fatalf("differs: (-got +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(ToV1(actual), FormatEvents(userinfoval, events)); diff != "" {
+		t.Fatalf("v1 adapter differs: (-got +want)\n%s", diff)
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	ts := time.Date(2020, time.September, 13, 12, 26, 40, 0, time.UTC)
+	tests := []struct {
+		name     string
+		tz       string
+		format   string
+		locale   string
+		expected string
+	}{
+		{name: "Default keeps v1 output", expected: ts.Local().String()},
+		{name: "RFC 3339 in zone", tz: "Asia/Kolkata", format: FormatRFC3339, expected: "2020-09-13T17:56:40+05:30"},
+		{name: "Epoch", tz: "America/New_York", format: FormatEpoch, expected: "1600000000"},
+		{name: "Human en-US", tz: "America/New_York", format: FormatHuman, expected: "Sep 13, 2020 8:26:40 AM EDT"},
+		{name: "Human de", tz: "Europe/Berlin", format: FormatHuman, locale: "de-DE", expected: "13.09.2020 14:26:40 CEST"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := ParseFormatOptions(test.tz, test.format, test.locale, "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := FormatTime(ts, opts); actual != test.expected {
+				t.Fatalf("got %q, want %q", actual, test.expected)
+			}
+		})
+	}
+
+	if _, err := ParseFormatOptions("Mars/Base", "", "", "", false); err != ErrInvalidTimezone {
+		t.Fatalf("expected ErrInvalidTimezone, got %v", err)
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Date(2020, time.September, 13, 12, 0, 0, 0, time.UTC)
+	tests := map[time.Duration]string{
+		-30 * time.Second: "just now",
+		-time.Minute:      "1 minute ago",
+		-5 * time.Hour:    "5 hours ago",
+		2 * time.Hour:     "in 2 hours",
+		-72 * time.Hour:   "3 days ago",
+	}
+	for offset, expected := range tests {
+		if actual := RelativeTime(now.Add(offset), now); actual != expected {
+			t.Fatalf("%v: got %q, want %q", offset, actual, expected)
+		}
+	}
+}
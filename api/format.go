@@ -0,0 +1,192 @@
+package api
+
+import (
+	"accessdoor/model"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	//consumers may ask for any zone, the runtime image ships no zoneinfo
+	_ "time/tzdata"
+)
+
+const (
+	FormatRFC3339 = "rfc3339"
+	FormatEpoch   = "epoch"
+	FormatHuman   = "human"
+)
+
+var (
+	ErrInvalidTimezone   = errors.New("unknown time zone")
+	ErrInvalidTimeFormat = errors.New("time format must be rfc3339, epoch or human")
+
+	//humanLayouts are the human readable layouts per locale. Only the language
+	//and region are matched, en-US is the fallback.
+	humanLayouts = map[string]string{
+		"en-US": "Jan 2, 2006 3:04:05 PM MST",
+		"en-GB": "2 Jan 2006 15:04:05 MST",
+		"en":    "Jan 2, 2006 3:04:05 PM MST",
+		"de":    "02.01.2006 15:04:05 MST",
+		"fr":    "02/01/2006 15:04:05 MST",
+		"es":    "02/01/2006 15:04:05 MST",
+		"nl":    "02-01-2006 15:04:05 MST",
+		"ja":    "2006/01/02 15:04:05 MST",
+		"zh":    "2006-01-02 15:04:05 MST",
+	}
+)
+
+//FormatOptions is how a consumer wants timestamps rendered. The zero value keeps
+//the original output: time.Time.String() in the server zone for v1 and RFC 3339
+//UTC for v2.
+type FormatOptions struct {
+	Location *time.Location
+	Format   string
+	Locale   string
+	Relative bool
+	Now      time.Time
+}
+
+type contextKey int
+
+const contextKeyFormat contextKey = iota
+
+type formatRequest struct {
+	tz             string
+	format         string
+	locale         string
+	acceptLanguage string
+	relative       bool
+}
+
+//PopulateFormat stores how the consumer wants timestamps rendered. The zone is
+//taken from the tz query parameter or the X-Timezone header.
+func PopulateFormat(ctx context.Context, r *http.Request) context.Context {
+	params := r.URL.Query()
+	req := formatRequest{
+		tz:             params.Get("tz"),
+		format:         params.Get("timeformat"),
+		locale:         params.Get("locale"),
+		acceptLanguage: r.Header.Get("Accept-Language"),
+		relative:       params.Get("relative") == "true",
+	}
+	if req.tz == "" {
+		req.tz = r.Header.Get("X-Timezone")
+	}
+	return context.WithValue(ctx, contextKeyFormat, req)
+}
+
+//FormatOptionsFrom parses the options PopulateFormat stored in ctx.
+func FormatOptionsFrom(ctx context.Context) (FormatOptions, error) {
+	req, _ := ctx.Value(contextKeyFormat).(formatRequest)
+	return ParseFormatOptions(req.tz, req.format, req.locale, req.acceptLanguage, req.relative)
+}
+
+//ParseFormatOptions validates the consumer supplied zone and format. acceptLanguage
+//is only used when locale is empty.
+func ParseFormatOptions(tz, format, locale, acceptLanguage string, relative bool) (FormatOptions, error) {
+	opts := FormatOptions{Format: strings.ToLower(format), Relative: relative, Now: time.Now()}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return opts, ErrInvalidTimezone
+		}
+		opts.Location = loc
+	}
+	switch opts.Format {
+	case "", FormatRFC3339, FormatEpoch, FormatHuman:
+	default:
+		return opts, ErrInvalidTimeFormat
+	}
+	opts.Locale = locale
+	if opts.Locale == "" && acceptLanguage != "" {
+		opts.Locale = strings.TrimSpace(strings.Split(strings.Split(acceptLanguage, ",")[0], ";")[0])
+	}
+	return opts, nil
+}
+
+//FormatTime renders t in the requested zone and format. Without a format the
+//v1 time.Time.String() rendering is kept.
+func FormatTime(t time.Time, opts FormatOptions) string {
+	loc := opts.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	switch opts.Format {
+	case FormatRFC3339:
+		return t.Format(time.RFC3339)
+	case FormatEpoch:
+		return strconv.FormatInt(t.Unix(), 10)
+	case FormatHuman:
+		return t.Format(humanLayout(opts.Locale))
+	default:
+		return t.String()
+	}
+}
+
+func humanLayout(locale string) string {
+	locale = strings.Replace(locale, "_", "-", -1)
+	if layout, ok := humanLayouts[locale]; ok {
+		return layout
+	}
+	if layout, ok := humanLayouts[strings.ToLower(strings.Split(locale, "-")[0])]; ok {
+		return layout
+	}
+	return humanLayouts["en-US"]
+}
+
+//RelativeTime labels t relative to now, e.g. "5 minutes ago" or "in 2 hours".
+func RelativeTime(t, now time.Time) string {
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	if d < time.Minute {
+		return "just now"
+	}
+	var n int64
+	var unit string
+	switch {
+	case d < time.Hour:
+		n, unit = int64(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int64(d/time.Hour), "hour"
+	case d < 30*24*time.Hour:
+		n, unit = int64(d/(24*time.Hour)), "day"
+	case d < 365*24*time.Hour:
+		n, unit = int64(d/(30*24*time.Hour)), "month"
+	default:
+		n, unit = int64(d/(365*24*time.Hour)), "year"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	if future {
+		return fmt.Sprintf("in %d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %s ago", n, unit)
+}
+
+//ApplyFormat renders the v2 events for a consumer. Timestamp stays RFC 3339 but
+//moves to the requested zone, Time and Relative are only set when asked for.
+func ApplyFormat(response model.UserEvents, opts FormatOptions) model.UserEvents {
+	events := make([]model.Event, 0, len(response.Events))
+	for _, event := range response.Events {
+		if opts.Location != nil {
+			event.Timestamp = event.Timestamp.In(opts.Location)
+		}
+		if opts.Format != "" {
+			event.Time = FormatTime(event.Timestamp, opts)
+		}
+		if opts.Relative {
+			event.Relative = RelativeTime(event.Timestamp, opts.Now)
+		}
+		events = append(events, event)
+	}
+	response.Events = events
+	return response
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"accessdoor/model"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	eventmodel "events/model"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrInvalidCursor  = errors.New("invalid cursor")
+	ErrInvalidOrder   = errors.New("order must be asc or desc")
+	ErrInvalidOutcome = errors.New("outcome must be granted or denied")
+)
+
+type eventEntry struct {
+	door string
+	ts   int64
+}
+
+//cursor marks the last event handed out. N counts how many events sharing the
+//same (T, D) key have already been returned, so ties are never repeated or lost.
+//F are the filters of the query it was handed out for.
+type cursor struct {
+	T int64  `json:"t"`
+	D string `json:"d"`
+	N int    `json:"n"`
+	O string `json:"o"`
+	F string `json:"f"`
+}
+
+//ValidateQuery checks the order and outcome of q, empty means the default.
+func ValidateQuery(q model.EventQuery) error {
+	if q.Order != "" && q.Order != model.OrderAsc && q.Order != model.OrderDesc {
+		return ErrInvalidOrder
+	}
+	if q.Outcome != "" && q.Outcome != model.OutcomeGranted && q.Outcome != model.OutcomeDenied {
+		return ErrInvalidOutcome
+	}
+	return nil
+}
+
+//filterKey identifies the filters of q, a cursor only continues the same ones.
+func filterKey(q model.EventQuery) string {
+	var from, to int64
+	if !q.From.IsZero() {
+		from = q.From.Unix()
+	}
+	if !q.To.IsZero() {
+		to = q.To.Unix()
+	}
+	return fmt.Sprintf("%v|%v|%v|%v", q.Door, q.Outcome, from, to)
+}
+
+//QueryEvents applies the filters, ordering and paging of q to the event history.
+//It returns the matching page and an opaque cursor for the next one, which is
+//empty once the history is exhausted.
+func QueryEvents(events eventmodel.Events, q model.EventQuery) (eventmodel.Events, string, error) {
+	if err := ValidateQuery(q); err != nil {
+		return eventmodel.Events{}, "", err
+	}
+	order := q.Order
+	if order == "" {
+		order = model.OrderAsc
+	}
+	var after *cursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.O != order || c.F != filterKey(q) {
+			return eventmodel.Events{}, "", ErrInvalidCursor
+		}
+		after = &c
+	}
+
+	entries := filterEvents(events, q)
+	less := func(a, b eventEntry) bool {
+		if a.ts != b.ts {
+			return a.ts < b.ts
+		}
+		return a.door < b.door
+	}
+	if order == model.OrderDesc {
+		asc := less
+		less = func(a, b eventEntry) bool { return asc(b, a) }
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+
+	start := 0
+	if after != nil {
+		key := eventEntry{door: after.D, ts: after.T}
+		for start < len(entries) && less(entries[start], key) {
+			start++
+		}
+		for skipped := 0; skipped < after.N && start < len(entries) && entries[start] == key; skipped++ {
+			start++
+		}
+	}
+	end := len(entries)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+
+	page := eventmodel.Events{
+		Id:       events.Id,
+		Revision: events.Revision,
+		Username: events.Username,
+		Events:   make([]map[string]int64, 0, end-start),
+	}
+	for _, e := range entries[start:end] {
+		page.Events = append(page.Events, map[string]int64{e.door: e.ts})
+	}
+	if end == len(entries) {
+		return page, "", nil
+	}
+
+	last := entries[end-1]
+	next := cursor{T: last.ts, D: last.door, O: order, F: filterKey(q)}
+	for i := end - 1; i >= 0 && entries[i] == last; i-- {
+		next.N++
+	}
+	return page, encodeCursor(next), nil
+}
+
+//filterEvents flattens the history and keeps the entries matching q.
+//From is inclusive and To is exclusive.
+func filterEvents(events eventmodel.Events, q model.EventQuery) []eventEntry {
+	// events-go only stores granted swipes, so a denied filter never matches.
+	if q.Outcome != "" && q.Outcome != model.OutcomeGranted {
+		return []eventEntry{}
+	}
+	entries := []eventEntry{}
+	for _, val := range events.Events {
+		for door, unixtime := range val {
+			if q.Door != "" && door != q.Door {
+				continue
+			}
+			if !q.From.IsZero() && unixtime < q.From.Unix() {
+				continue
+			}
+			if !q.To.IsZero() && unixtime >= q.To.Unix() {
+				continue
+			}
+			entries = append(entries, eventEntry{door: door, ts: unixtime})
+		}
+	}
+	return entries
+}
+
+func encodeCursor(c cursor) string {
+	payload, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	payload, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(payload, &c)
+	return c, err
+}
@@ -0,0 +1,154 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+var errNotAdmin = errors.New("only admin users can do this")
+
+//identity is who made a request, resolved once by NewActorHandler. role is
+//filled by checkAdmin so later steps of the same request need no lookup.
+type identity struct {
+	actor    string
+	sourceIP string
+	role     string
+}
+
+//ActorTrust is the trusted proxy boundary. Only the proxies it lists may name
+//the actor of a request in X-Actor and the source address in X-Forwarded-For,
+//everyone else is identified by their verified client certificate.
+type ActorTrust struct {
+	networks []*net.IPNet
+	names    map[string]bool
+}
+
+//NewActorTrust reads proxies. An IP or CIDR is matched against the peer
+//address of the connection, anything else against the common name of a
+//verified client certificate.
+func NewActorTrust(proxies []string) (*ActorTrust, error) {
+	networks, names, err := parseAddresses(proxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy %v", err)
+	}
+	return &ActorTrust{networks: networks, names: names}, nil
+}
+
+//parseAddresses splits a list of IPs, CIDRs and names. An IP is a network of
+//its own.
+func parseAddresses(list []string) ([]*net.IPNet, map[string]bool, error) {
+	networks := []*net.IPNet{}
+	names := map[string]bool{}
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+		case strings.Contains(item, "/"):
+			_, network, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%q", item)
+			}
+			networks = append(networks, network)
+		case net.ParseIP(item) != nil:
+			ip := net.ParseIP(item)
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * len(ip)
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			names[item] = true
+		}
+	}
+	return networks, names, nil
+}
+
+//resolve returns the identity of r.
+func (t *ActorTrust) resolve(r *http.Request) identity {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	var name string
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	trusted := name != "" && t.names[name]
+	if ip := net.ParseIP(peer); ip != nil {
+		for _, network := range t.networks {
+			trusted = trusted || network.Contains(ip)
+		}
+	}
+	if !trusted {
+		return identity{actor: name, sourceIP: peer}
+	}
+	id := identity{actor: r.Header.Get("X-Actor"), sourceIP: peer}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		id.sourceIP = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return id
+}
+
+//NewActorHandler resolves who made every request before next sees it.
+func NewActorHandler(trust *ActorTrust, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := trust.resolve(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyActor, &id)))
+	})
+}
+
+//actor is the authenticated identity making the request, empty when there is
+//none.
+func actor(ctx context.Context) string {
+	if id, ok := ctx.Value(contextKeyActor).(*identity); ok {
+		return id.actor
+	}
+	return ""
+}
+
+//checkAdmin requires the actor of the request to be an admin user.
+func checkAdmin(ctx context.Context, usersService UsersService) error {
+	id, ok := ctx.Value(contextKeyActor).(*identity)
+	if !ok || id.actor == "" {
+		return errNotAdmin
+	}
+	if id.role == model.RoleAdmin {
+		return nil
+	}
+	userinfo, err := usersService.GetUser(ctx, id.actor)
+	if err != nil {
+		return err
+	}
+	if !userinfo.IsAdmin {
+		id.role = model.RoleUser
+		return errNotAdmin
+	}
+	id.role = model.RoleAdmin
+	return nil
+}
+
+//verifiedAdmin reports whether checkAdmin already found the actor of the
+//request to be an admin.
+func verifiedAdmin(ctx context.Context) bool {
+	id, ok := ctx.Value(contextKeyActor).(*identity)
+	return ok && id.role == model.RoleAdmin
+}
+
+//requireAdmin lets only admin actors through to the endpoint.
+func requireAdmin(usersService UsersService) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if err := checkAdmin(ctx, usersService); err != nil {
+				return nil, err
+			}
+			return next(ctx, request)
+		}
+	}
+}
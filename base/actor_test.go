@@ -0,0 +1,137 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestActorResolve(t *testing.T) {
+	trust, err := NewActorTrust([]string{"10.0.0.0/8", "192.168.1.5", "edge-proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		remote   string
+		cert     string
+		header   string
+		forward  string
+		actor    string
+		sourceIP string
+	}{
+		{name: "untrusted peer headers ignored", remote: "203.0.113.9:4000", header: "admin", forward: "1.2.3.4", actor: "", sourceIP: "203.0.113.9"},
+		{name: "client certificate", remote: "203.0.113.9:4000", cert: "door-7", header: "admin", actor: "door-7", sourceIP: "203.0.113.9"},
+		{name: "trusted network", remote: "10.1.2.3:4000", header: "alice", forward: "1.2.3.4, 10.1.2.3", actor: "alice", sourceIP: "1.2.3.4"},
+		{name: "trusted address", remote: "192.168.1.5:4000", header: "alice", actor: "alice", sourceIP: "192.168.1.5"},
+		{name: "address next to trusted one", remote: "192.168.1.6:4000", header: "alice", actor: "", sourceIP: "192.168.1.6"},
+		{name: "trusted certificate name", remote: "203.0.113.9:4000", cert: "edge-proxy", header: "alice", forward: "1.2.3.4", actor: "alice", sourceIP: "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.cert != "" {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tt.cert}}}}}
+			}
+			if tt.header != "" {
+				r.Header.Set("X-Actor", tt.header)
+			}
+			if tt.forward != "" {
+				r.Header.Set("X-Forwarded-For", tt.forward)
+			}
+			var ctx context.Context
+			NewActorHandler(trust, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				ctx = r.Context()
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if got := actor(ctx); got != tt.actor {
+				t.Errorf("actor: expected %q, got %q", tt.actor, got)
+			}
+			if got := sourceIP(ctx); got != tt.sourceIP {
+				t.Errorf("source ip: expected %q, got %q", tt.sourceIP, got)
+			}
+		})
+	}
+}
+
+func TestNewActorTrustInvalid(t *testing.T) {
+	if _, err := NewActorTrust([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("expected an invalid CIDR to fail")
+	}
+}
+
+func TestCheckAdmin(t *testing.T) {
+	users := newFakeUsersService(
+		usermodel.User{Username: "root", IsAdmin: true},
+		usermodel.User{Username: "bob"},
+	)
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+	}{
+		{name: "no actor", ctx: context.Background(), err: errNotAdmin},
+		{name: "not admin", ctx: withActor(context.Background(), "bob"), err: errNotAdmin},
+		{name: "admin", ctx: withActor(context.Background(), "root"), err: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkAdmin(tt.ctx, users); err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	//the role is looked up once per request
+	ctx := withActor(context.Background(), "root")
+	gets := users.gets
+	checkAdmin(ctx, users)
+	checkAdmin(ctx, users)
+	if users.gets != gets+1 {
+		t.Fatalf("expected one lookup, got %v", users.gets-gets)
+	}
+}
+
+func TestSensitiveReadsNeedAdmin(t *testing.T) {
+	users := newFakeUsersService(usermodel.User{Username: "root", IsAdmin: true}, usermodel.User{Username: "bob"})
+	events := newFakeEventsService()
+	roster, _ := LoadUserRoster("")
+	doors := MakeDoorIndexHandler(NewDoorIndex(time.Hour), users, log.NewNopLogger(), "/v2")
+	handlers := map[string]http.Handler{
+		"/v2/events/export":   MakeExportHandler(events, users, roster, log.NewNopLogger()),
+		"/v2/attendance":      MakeAttendanceHandler(NewAttendance(testDoors(), events, roster, time.Hour), users, log.NewNopLogger(), "/v2"),
+		"/v2/usage":           MakeRollupHandler(NewRollup(time.Hour), users, log.NewNopLogger(), "/v2"),
+		"/v2/doors":           doors,
+		"/v2/doors/HQ/grants": doors,
+		"/v2/doors/HQ/events": doors,
+	}
+	tests := []struct {
+		name  string
+		actor string
+		code  int
+	}{
+		{name: "No actor", code: http.StatusForbidden},
+		{name: "User", actor: "bob", code: http.StatusForbidden},
+		{name: "Admin", actor: "root", code: http.StatusOK},
+	}
+	for path, h := range handlers {
+		for _, test := range tests {
+			t.Run(path+" "+test.name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r.WithContext(withActor(r.Context(), test.actor)))
+				if w.Code != test.code {
+					t.Errorf("expected %v, got %v: %v", test.code, w.Code, w.Body.String())
+				}
+			})
+		}
+	}
+}
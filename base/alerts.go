@@ -0,0 +1,483 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	AlertSinkLog     = "log"
+	AlertSinkSyslog  = "syslog"
+	AlertSinkWebhook = "webhook"
+
+	AlertPerUser = "user"
+	AlertPerDoor = "door"
+
+	AlertInfo     = "info"
+	AlertWarning  = "warning"
+	AlertCritical = "critical"
+
+	//recentAlerts is how many fired alerts GET /alerts keeps.
+	recentAlerts = 100
+)
+
+//AlertRule is a declarative condition over access decisions. Every set field
+//must match. Rate fires only once Count matching decisions fall within Window
+//milliseconds, counted separately per user or per door when Per is set.
+type AlertRule struct {
+	Name     string       `json:"name"`
+	Users    []string     `json:"users,omitempty"`
+	Doors    []string     `json:"doors,omitempty"`
+	Areas    []string     `json:"areas,omitempty"`
+	Outcome  string       `json:"outcome,omitempty"`
+	Between  *AlertWindow `json:"between,omitempty"`
+	Rate     *AlertRate   `json:"rate,omitempty"`
+	Per      string       `json:"per,omitempty"`
+	Cooldown int64        `json:"cooldown,omitempty"`
+	Severity string       `json:"severity,omitempty"`
+	Sinks    []string     `json:"sinks,omitempty"`
+}
+
+//AlertWindow is a daily time of day range as 15:04. From after To wraps midnight.
+type AlertWindow struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Timezone string `json:"tz,omitempty"`
+
+	from, to int
+	loc      *time.Location
+}
+
+//AlertRate ...
+type AlertRate struct {
+	Count  int   `json:"count"`
+	Window int64 `json:"window"`
+}
+
+//Alert is what a rule sends to its sinks. Suppressed counts the firings held
+//back by the cooldown since the previous alert of the same rule and key.
+type Alert struct {
+	ID         string      `json:"id"`
+	Rule       string      `json:"rule"`
+	Severity   string      `json:"severity"`
+	Key        string      `json:"key,omitempty"`
+	Count      int         `json:"count"`
+	Suppressed int         `json:"suppressed,omitempty"`
+	Event      model.Event `json:"event"`
+	FiredAt    time.Time   `json:"firedat"`
+}
+
+//AlertSink delivers fired alerts. It is called synchronously from the decision
+//path and must not block.
+type AlertSink interface {
+	Alert(alert Alert)
+}
+
+type logAlertSink struct {
+	logger log.Logger
+}
+
+func (s logAlertSink) Alert(alert Alert) {
+	s.logger.Log("method", "Alert", "rule", alert.Rule, "severity", alert.Severity, "key", alert.Key,
+		"count", alert.Count, "suppressed", alert.Suppressed, "username", alert.Event.Username,
+		"door", alert.Event.Door, "outcome", alert.Event.Outcome)
+}
+
+type syslogAlertSink struct {
+	w SyslogWriter
+}
+
+func (s syslogAlertSink) Alert(alert Alert) {
+	msg := fmt.Sprintf("alert rule=%q severity=%v key=%q count=%v suppressed=%v username=%q door=%q outcome=%v",
+		alert.Rule, alert.Severity, alert.Key, alert.Count, alert.Suppressed,
+		alert.Event.Username, alert.Event.Door, alert.Event.Outcome)
+	switch alert.Severity {
+	case AlertCritical:
+		s.w.WriteSyslog(syslog.LOG_CRIT, "-", msg)
+	case AlertInfo:
+		s.w.WriteSyslog(syslog.LOG_INFO, "-", msg)
+	default:
+		s.w.WriteSyslog(syslog.LOG_WARNING, "-", msg)
+	}
+}
+
+type webhookAlertSink struct {
+	d *WebhookDispatcher
+}
+
+func (s webhookAlertSink) Alert(alert Alert) {
+	s.d.Dispatch(WebhookAlertFired, alert)
+}
+
+//NewLogAlertSink ...
+func NewLogAlertSink(logger log.Logger) AlertSink {
+	return logAlertSink{logger: logger}
+}
+
+//NewSyslogAlertSink ...
+func NewSyslogAlertSink(w SyslogWriter) AlertSink {
+	return syslogAlertSink{w: w}
+}
+
+//NewWebhookAlertSink sends alerts to the webhook subscriptions of alert.fired,
+//with the dispatcher's retries and signing.
+func NewWebhookAlertSink(d *WebhookDispatcher) AlertSink {
+	return webhookAlertSink{d: d}
+}
+
+//LoadAlertRules reads {"rules": [...]} and validates every rule against the
+//known sinks. An empty path is no rules.
+func LoadAlertRules(path string, sinks map[string]AlertSink) ([]AlertRule, error) {
+	var file struct {
+		Rules []AlertRule `json:"rules"`
+	}
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if err := rule.validate(sinks); err != nil {
+			return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %q: duplicate name", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return file.Rules, nil
+}
+
+func (r *AlertRule) validate(sinks map[string]AlertSink) error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if r.Outcome != "" && r.Outcome != model.OutcomeGranted && r.Outcome != model.OutcomeDenied {
+		return errors.New("outcome must be granted or denied")
+	}
+	if r.Per != "" && r.Per != AlertPerUser && r.Per != AlertPerDoor {
+		return errors.New("per must be user or door")
+	}
+	if r.Rate != nil && (r.Rate.Count < 1 || r.Rate.Window <= 0) {
+		return errors.New("rate needs a positive count and window")
+	}
+	if r.Cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+	switch r.Severity {
+	case "":
+		r.Severity = AlertWarning
+	case AlertInfo, AlertWarning, AlertCritical:
+	default:
+		return errors.New("severity must be info, warning or critical")
+	}
+	if len(r.Sinks) == 0 {
+		r.Sinks = []string{AlertSinkLog}
+	}
+	for _, sink := range r.Sinks {
+		if sinks[sink] == nil {
+			return fmt.Errorf("unknown sink %q", sink)
+		}
+	}
+	if r.Between != nil {
+		return r.Between.parse()
+	}
+	return nil
+}
+
+func (w *AlertWindow) parse() error {
+	from, err := time.Parse("15:04", w.From)
+	if err != nil {
+		return errors.New("between.from must be 15:04")
+	}
+	to, err := time.Parse("15:04", w.To)
+	if err != nil {
+		return errors.New("between.to must be 15:04")
+	}
+	w.from, w.to = from.Hour()*60+from.Minute(), to.Hour()*60+to.Minute()
+	w.loc = time.Local
+	if w.Timezone != "" {
+		if w.loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return errors.New("between.tz is not a known zone")
+		}
+	}
+	return nil
+}
+
+func (w *AlertWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+func (r *AlertRule) matches(event model.Event, doors DoorCatalog) bool {
+	return (len(r.Users) == 0 || inList(r.Users, event.Username)) &&
+		(len(r.Doors) == 0 || inList(r.Doors, event.Door)) &&
+		(len(r.Areas) == 0 || inList(r.Areas, doors[event.Door].Area)) &&
+		(r.Outcome == "" || r.Outcome == event.Outcome) &&
+		(r.Between == nil || r.Between.contains(event.Timestamp))
+}
+
+func (r *AlertRule) key(event model.Event) string {
+	switch r.Per {
+	case AlertPerUser:
+		return event.Username
+	case AlertPerDoor:
+		return event.Door
+	}
+	return ""
+}
+
+func inList(list []string, val string) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+//alertState is the rate and cooldown state of one rule and key. idle is when
+//neither still needs it, the state is dropped after that.
+type alertState struct {
+	hits       []time.Time
+	lastFired  time.Time
+	suppressed int
+	idle       time.Time
+}
+
+//AlertEngine evaluates every rule on every access decision. A decision seen
+//twice, e.g. retried by a client with the same request id, is only evaluated
+//once, and a rule stays quiet for Cooldown milliseconds per key after firing.
+//Keys idle for longer than their rule's rate window and cooldown are forgotten,
+//together with any count of suppressed firings.
+type AlertEngine struct {
+	mtx    sync.Mutex
+	rules  []AlertRule
+	doors  *Doors
+	sinks  map[string]AlertSink
+	states map[string]*alertState
+	seen   map[string]time.Time
+	pruned time.Time
+	recent []Alert
+	now    func() time.Time
+}
+
+//NewAlertEngine ...
+func NewAlertEngine(rules []AlertRule, doors *Doors, sinks map[string]AlertSink) *AlertEngine {
+	return &AlertEngine{
+		rules:  rules,
+		doors:  doors,
+		sinks:  sinks,
+		states: map[string]*alertState{},
+		seen:   map[string]time.Time{},
+		now:    time.Now,
+	}
+}
+
+//OnDecision implements DecisionListener.
+func (e *AlertEngine) OnDecision(_ context.Context, event model.Event) {
+	fired := []Alert{}
+	e.mtx.Lock()
+	e.prune(e.now())
+	if e.duplicate(event) {
+		e.mtx.Unlock()
+		return
+	}
+	//SetRules swaps the slice rather than changing it, the sinks are read from this one
+	rules := e.rules
+	doors := e.doors.Catalog()
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(event, doors) {
+			continue
+		}
+		if alert, ok := e.evaluate(rule, event); ok {
+			fired = append(fired, alert)
+		}
+	}
+	e.mtx.Unlock()
+
+	for _, alert := range fired {
+		for _, name := range ruleSinks(rules, alert.Rule) {
+			e.sinks[name].Alert(alert)
+		}
+	}
+}
+
+//prune forgets event identities after an hour and idle rule states, at most
+//once a minute.
+func (e *AlertEngine) prune(now time.Time) {
+	if now.Sub(e.pruned) <= time.Minute {
+		return
+	}
+	for id, at := range e.seen {
+		if now.Sub(at) > time.Hour {
+			delete(e.seen, id)
+		}
+	}
+	for key, state := range e.states {
+		if !now.Before(state.idle) {
+			delete(e.states, key)
+		}
+	}
+	e.pruned = now
+}
+
+//duplicate remembers event identities until prune forgets them. The request id
+//comes from the client's X-Request-Id, so it only tells apart decisions that are
+//otherwise the same and never identifies one on its own.
+func (e *AlertEngine) duplicate(event model.Event) bool {
+	now := e.now()
+	id := event.Username + "\x00" + event.Door + "\x00" + event.Outcome + "\x00" + event.Timestamp.String() + "\x00" + event.RequestID
+	if _, ok := e.seen[id]; ok {
+		return true
+	}
+	e.seen[id] = now
+	return false
+}
+
+func (e *AlertEngine) evaluate(rule *AlertRule, event model.Event) (Alert, bool) {
+	key := rule.key(event)
+	state := e.states[rule.Name+"\x00"+key]
+	if state == nil {
+		state = &alertState{}
+		e.states[rule.Name+"\x00"+key] = state
+	}
+	now := e.now()
+	keep := time.Duration(rule.Cooldown) * time.Millisecond
+	if rule.Rate != nil && time.Duration(rule.Rate.Window)*time.Millisecond > keep {
+		keep = time.Duration(rule.Rate.Window) * time.Millisecond
+	}
+	state.idle = now.Add(keep)
+	count := 1
+	if rule.Rate != nil {
+		cutoff := event.Timestamp.Add(-time.Duration(rule.Rate.Window) * time.Millisecond)
+		hits := state.hits[:0]
+		for _, hit := range state.hits {
+			if hit.After(cutoff) {
+				hits = append(hits, hit)
+			}
+		}
+		state.hits = append(hits, event.Timestamp)
+		count = len(state.hits)
+		if count < rule.Rate.Count {
+			return Alert{}, false
+		}
+	}
+	if !state.lastFired.IsZero() && now.Sub(state.lastFired) < time.Duration(rule.Cooldown)*time.Millisecond {
+		state.suppressed++
+		return Alert{}, false
+	}
+	alert := Alert{
+		ID:         newID(),
+		Rule:       rule.Name,
+		Severity:   rule.Severity,
+		Key:        key,
+		Count:      count,
+		Suppressed: state.suppressed,
+		Event:      event,
+		FiredAt:    now.UTC(),
+	}
+	state.lastFired = now
+	state.suppressed = 0
+	e.recent = append(e.recent, alert)
+	if len(e.recent) > recentAlerts {
+		e.recent = e.recent[len(e.recent)-recentAlerts:]
+	}
+	return alert, true
+}
+
+func ruleSinks(rules []AlertRule, name string) []string {
+	for _, rule := range rules {
+		if rule.Name == name {
+			return rule.Sinks
+		}
+	}
+	return nil
+}
+
+//SetRules replaces the rules. Rate and cooldown state is kept for the rules
+//whose name stays.
+func (e *AlertEngine) SetRules(rules []AlertRule) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	names := map[string]bool{}
+	for _, rule := range rules {
+		names[rule.Name] = true
+	}
+	for key := range e.states {
+		if !names[strings.SplitN(key, "\x00", 2)[0]] {
+			delete(e.states, key)
+		}
+	}
+	e.rules = rules
+}
+
+//Rules ...
+func (e *AlertEngine) Rules() []AlertRule {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return append([]AlertRule{}, e.rules...)
+}
+
+//Recent returns the last fired alerts, newest first.
+func (e *AlertEngine) Recent() []Alert {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	alerts := make([]Alert, 0, len(e.recent))
+	for i := len(e.recent) - 1; i >= 0; i-- {
+		alerts = append(alerts, e.recent[i])
+	}
+	return alerts
+}
+
+//MakeAlertHandler mounts the alert routes under baseRoute.
+func MakeAlertHandler(e *AlertEngine, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	}
+	r.Methods(http.MethodGet).Path(baseRoute + "/alerts").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return e.Recent(), nil
+		},
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/alerts/rules").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return e.Rules(), nil
+		},
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		options...,
+	))
+	return r
+}
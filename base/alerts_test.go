@@ -0,0 +1,189 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+//recordingSink keeps every alert it receives.
+type recordingSink struct {
+	alerts []Alert
+}
+
+func (s *recordingSink) Alert(alert Alert) {
+	s.alerts = append(s.alerts, alert)
+}
+
+func TestAlertEngine(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	type decision struct {
+		seconds   int
+		username  string
+		door      string
+		outcome   string
+		requestID string
+	}
+	denied := func(seconds int, username string) decision {
+		return decision{seconds: seconds, username: username, door: "HQ-In", outcome: model.OutcomeDenied}
+	}
+	type fired struct {
+		Key        string
+		Count      int
+		Suppressed int
+		Seconds    int
+	}
+	tests := []struct {
+		name      string
+		rule      AlertRule
+		decisions []decision
+		fired     []fired
+	}{
+		{
+			name:      "Every match fires",
+			rule:      AlertRule{Name: "denied", Outcome: model.OutcomeDenied},
+			decisions: []decision{denied(0, "abc"), {seconds: 1, username: "abc", door: "HQ-In", outcome: model.OutcomeGranted}, denied(2, "def")},
+			fired:     []fired{{Count: 1, Seconds: 0}, {Count: 1, Seconds: 2}},
+		},
+		{
+			name:      "Rate fires once the window is full",
+			rule:      AlertRule{Name: "burst", Outcome: model.OutcomeDenied, Rate: &AlertRate{Count: 3, Window: 60000}, Per: AlertPerUser},
+			decisions: []decision{denied(0, "abc"), denied(10, "abc"), denied(20, "def"), denied(30, "abc"), denied(40, "abc")},
+			fired:     []fired{{Key: "abc", Count: 3, Seconds: 30}, {Key: "abc", Count: 4, Seconds: 40}},
+		},
+		{
+			name:      "Hits leave the rate window",
+			rule:      AlertRule{Name: "burst", Rate: &AlertRate{Count: 2, Window: 60000}},
+			decisions: []decision{denied(0, "abc"), denied(60, "abc"), denied(90, "abc")},
+			fired:     []fired{{Count: 2, Seconds: 90}},
+		},
+		{
+			name:      "Cooldown suppresses and reports the count",
+			rule:      AlertRule{Name: "denied", Outcome: model.OutcomeDenied, Cooldown: 60000, Per: AlertPerDoor},
+			decisions: []decision{denied(0, "abc"), denied(10, "def"), denied(20, "ghi"), denied(60, "abc"), denied(70, "abc")},
+			fired:     []fired{{Key: "HQ-In", Count: 1, Seconds: 0}, {Key: "HQ-In", Count: 1, Suppressed: 2, Seconds: 60}},
+		},
+		{
+			name:      "Cooldown is kept per key",
+			rule:      AlertRule{Name: "denied", Cooldown: 60000, Per: AlertPerUser},
+			decisions: []decision{denied(0, "abc"), denied(1, "def"), denied(2, "abc")},
+			fired:     []fired{{Key: "abc", Count: 1, Seconds: 0}, {Key: "def", Count: 1, Seconds: 1}},
+		},
+		{
+			name: "Retried decision is evaluated once",
+			rule: AlertRule{Name: "denied", Outcome: model.OutcomeDenied},
+			decisions: []decision{
+				{seconds: 0, username: "abc", door: "HQ-In", outcome: model.OutcomeDenied, requestID: "r1"},
+				{seconds: 0, username: "abc", door: "HQ-In", outcome: model.OutcomeDenied, requestID: "r1"},
+				{seconds: 0, username: "abc", door: "HQ-In", outcome: model.OutcomeDenied, requestID: "r2"},
+			},
+			fired: []fired{{Count: 1, Seconds: 0}, {Count: 1, Seconds: 0}},
+		},
+		{
+			name: "Different denials sharing a request id both fire",
+			rule: AlertRule{Name: "denied", Outcome: model.OutcomeDenied},
+			decisions: []decision{
+				{seconds: 0, username: "abc", door: "HQ-In", outcome: model.OutcomeDenied, requestID: "r1"},
+				{seconds: 1, username: "def", door: "HQ-Lab", outcome: model.OutcomeDenied, requestID: "r1"},
+			},
+			fired: []fired{{Count: 1, Seconds: 0}, {Count: 1, Seconds: 1}},
+		},
+		{
+			name:      "Same swipe without a request id is evaluated once",
+			rule:      AlertRule{Name: "denied", Outcome: model.OutcomeDenied},
+			decisions: []decision{denied(0, "abc"), denied(0, "abc")},
+			fired:     []fired{{Count: 1, Seconds: 0}},
+		},
+		{
+			name:      "Area and time of day",
+			rule:      AlertRule{Name: "lab", Areas: []string{"HQ"}, Between: &AlertWindow{From: "22:00", To: "09:00", Timezone: "UTC"}},
+			decisions: []decision{{seconds: -60, username: "abc", door: "HQ-Lab"}, {seconds: 0, username: "abc", door: "HQ-Lab"}, {seconds: -30, username: "abc", door: "Lab-In"}},
+			fired:     []fired{{Count: 1, Seconds: -60}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			sinks := map[string]AlertSink{"test": sink}
+			test.rule.Sinks = []string{"test"}
+			if err := test.rule.validate(sinks); err != nil {
+				t.Fatal(err)
+			}
+			e := NewAlertEngine([]AlertRule{test.rule}, testDoors(), sinks)
+			for _, d := range test.decisions {
+				at := start.Add(time.Duration(d.seconds) * time.Second)
+				e.now = func() time.Time { return at }
+				e.OnDecision(context.Background(), model.Event{Username: d.username, Door: d.door, Outcome: d.outcome, RequestID: d.requestID, Timestamp: at})
+			}
+			got := []fired{}
+			for _, alert := range sink.alerts {
+				got = append(got, fired{Key: alert.Key, Count: alert.Count, Suppressed: alert.Suppressed, Seconds: int(alert.FiredAt.Sub(start) / time.Second)})
+			}
+			if diff := cmp.Diff(test.fired, got); diff != "" {
+				t.Errorf("alerts mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAlertEngineEvictsIdleKeys(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	now := start
+	sinks := map[string]AlertSink{AlertSinkLog: &recordingSink{}}
+	rules := []AlertRule{
+		{Name: "burst", Rate: &AlertRate{Count: 5, Window: 10 * 60000}, Per: AlertPerUser},
+		{Name: "quiet", Cooldown: 2 * 60000, Per: AlertPerUser},
+	}
+	for i := range rules {
+		if err := rules[i].validate(sinks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := NewAlertEngine(rules, testDoors(), sinks)
+	e.now = func() time.Time { return now }
+	decide := func(username string) {
+		e.OnDecision(context.Background(), model.Event{Username: username, Door: "HQ-In", Timestamp: now})
+	}
+	keys := func() []string {
+		e.mtx.Lock()
+		defer e.mtx.Unlock()
+		keys := []string{}
+		for _, rule := range rules {
+			for _, username := range []string{"abc", "def", "ghi"} {
+				if e.states[rule.Name+"\x00"+username] != nil {
+					keys = append(keys, rule.Name+"/"+username)
+				}
+			}
+		}
+		return keys
+	}
+
+	decide("abc")
+	decide("def")
+	if diff := cmp.Diff([]string{"burst/abc", "burst/def", "quiet/abc", "quiet/def"}, keys()); diff != "" {
+		t.Fatalf("keys mismatch (-want +got):\n%s", diff)
+	}
+
+	//the cooldown of abc is over, its hit is still in the rate window
+	now = start.Add(5 * time.Minute)
+	decide("def")
+	if diff := cmp.Diff([]string{"burst/abc", "burst/def", "quiet/def"}, keys()); diff != "" {
+		t.Fatalf("keys mismatch (-want +got):\n%s", diff)
+	}
+
+	//abc is past its rate window, def still has a hit in it
+	now = start.Add(11 * time.Minute)
+	decide("ghi")
+	if diff := cmp.Diff([]string{"burst/def", "burst/ghi", "quiet/ghi"}, keys()); diff != "" {
+		t.Fatalf("keys mismatch (-want +got):\n%s", diff)
+	}
+
+	now = start.Add(30 * time.Minute)
+	decide("ghi")
+	if diff := cmp.Diff([]string{"burst/ghi", "quiet/ghi"}, keys()); diff != "" {
+		t.Fatalf("keys mismatch (-want +got):\n%s", diff)
+	}
+}
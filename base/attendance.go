@@ -0,0 +1,274 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const attendanceDate = "2006-01-02"
+
+//AttendanceRequest selects the people and days of an attendance report. From
+//and To are day boundaries in Location, To is exclusive.
+type AttendanceRequest struct {
+	Users    []string
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+}
+
+//AttendanceRecord is one person's day on site. A shift belongs to the day it
+//started on, so overnight shifts are reported once, on their first day.
+type AttendanceRecord struct {
+	Username      string     `json:"username"`
+	Date          string     `json:"date,omitempty"`
+	FirstIn       *time.Time `json:"firstin,omitempty"`
+	LastOut       *time.Time `json:"lastout,omitempty"`
+	OnSiteSeconds int64      `json:"onsiteseconds"`
+	Shifts        int        `json:"shifts"`
+	Overnight     bool       `json:"overnight,omitempty"`
+	MissingEntry  bool       `json:"missingentry,omitempty"`
+	MissingExit   bool       `json:"missingexit,omitempty"`
+	OnSite        bool       `json:"onsite,omitempty"`
+}
+
+//shift is a stay between a perimeter entry and exit. Either side is zero when
+//its swipe is missing.
+type shift struct {
+	in, out time.Time
+	onSite  bool
+}
+
+//Attendance derives daily attendance from granted swipes at perimeter doors.
+//An entry not followed by an exit within maxShift is reported as a missing exit
+//and adds no on-site time.
+type Attendance struct {
+	doors         *Doors
+	eventsService EventsService
+	roster        *UserRoster
+	maxShift      time.Duration
+	now           func() time.Time
+}
+
+//NewAttendance ...
+func NewAttendance(doors *Doors, eventsService EventsService, roster *UserRoster, maxShift time.Duration) *Attendance {
+	return &Attendance{
+		doors:         doors,
+		eventsService: eventsService,
+		roster:        roster,
+		maxShift:      maxShift,
+		now:           time.Now,
+	}
+}
+
+//Report builds the records of every user in req, every user in the roster when
+//req.Users is empty. Days without a shift are left out.
+//
+//A user whose history cannot be read fails the whole report, a partial one would
+//read as people who were not on site.
+func (a *Attendance) Report(ctx context.Context, req AttendanceRequest) ([]AttendanceRecord, error) {
+	users := req.Users
+	if len(users) == 0 {
+		users = a.roster.List()
+	}
+	records := []AttendanceRecord{}
+	for _, username := range users {
+		//widen the window so shifts crossing its edges are paired correctly
+		history, err := fetchEvents(ctx, a.eventsService, model.EventQuery{
+			Username: username,
+			From:     req.From.Add(-a.maxShift),
+			To:       req.To.Add(a.maxShift),
+		})
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, a.daily(username, a.shifts(history), req)...)
+	}
+	return records, nil
+}
+
+func (a *Attendance) shifts(history []model.Event) []shift {
+	shifts := []shift{}
+	var open *shift
+	for _, event := range history {
+		door, ok := a.doors.Catalog()[event.Door]
+		if !ok || !door.Perimeter || event.Outcome != model.OutcomeGranted {
+			continue
+		}
+		if open != nil && event.Timestamp.Sub(open.in) > a.maxShift {
+			shifts = append(shifts, *open)
+			open = nil
+		}
+		switch door.Type {
+		case DoorEntry:
+			//a second entry inside the same shift keeps the first in
+			if open == nil {
+				open = &shift{in: event.Timestamp}
+			}
+		case DoorExit:
+			if open != nil {
+				open.out = event.Timestamp
+				shifts = append(shifts, *open)
+				open = nil
+			} else if n := len(shifts); n > 0 && !shifts[n-1].out.IsZero() && !shifts[n-1].in.IsZero() &&
+				event.Timestamp.Sub(shifts[n-1].in) <= a.maxShift {
+				//a later exit of the same shift moves last out
+				shifts[n-1].out = event.Timestamp
+			} else {
+				shifts = append(shifts, shift{out: event.Timestamp})
+			}
+		}
+	}
+	if open != nil {
+		open.onSite = a.now().Sub(open.in) <= a.maxShift
+		shifts = append(shifts, *open)
+	}
+	return shifts
+}
+
+func (a *Attendance) daily(username string, shifts []shift, req AttendanceRequest) []AttendanceRecord {
+	loc := req.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	byDate := map[string]*AttendanceRecord{}
+	dates := []string{}
+	for _, s := range shifts {
+		start := s.in
+		if start.IsZero() {
+			start = s.out
+		}
+		if start.Before(req.From) || !start.Before(req.To) {
+			continue
+		}
+		date := start.In(loc).Format(attendanceDate)
+		record, ok := byDate[date]
+		if !ok {
+			record = &AttendanceRecord{Username: username, Date: date}
+			byDate[date] = record
+			dates = append(dates, date)
+		}
+		record.Shifts++
+		switch {
+		case s.in.IsZero():
+			record.MissingEntry = true
+		case s.out.IsZero() && s.onSite:
+			record.OnSite = true
+			record.OnSiteSeconds += int64(a.now().Sub(s.in) / time.Second)
+		case s.out.IsZero():
+			record.MissingExit = true
+		default:
+			record.OnSiteSeconds += int64(s.out.Sub(s.in) / time.Second)
+			if s.out.In(loc).Format(attendanceDate) != date {
+				record.Overnight = true
+			}
+		}
+		if !s.in.IsZero() && (record.FirstIn == nil || s.in.Before(*record.FirstIn)) {
+			in := s.in.In(loc)
+			record.FirstIn = &in
+		}
+		if !s.out.IsZero() && (record.LastOut == nil || s.out.After(*record.LastOut)) {
+			out := s.out.In(loc)
+			record.LastOut = &out
+		}
+	}
+	sort.Strings(dates)
+	records := make([]AttendanceRecord, 0, len(dates))
+	for _, date := range dates {
+		records = append(records, *byDate[date])
+	}
+	return records
+}
+
+//MakeAttendanceHandler mounts the attendance routes under baseRoute. They need
+//an admin actor.
+func MakeAttendanceHandler(a *Attendance, usersService UsersService, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	}
+	report := requireAdmin(usersService)(func(ctx context.Context, request interface{}) (interface{}, error) {
+		return a.Report(ctx, request.(AttendanceRequest))
+	})
+	r.Methods(http.MethodGet).Path(baseRoute + "/attendance").Handler(httptransport.NewServer(
+		report,
+		decodeAttendanceRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/attendance/export").Handler(httptransport.NewServer(
+		report,
+		decodeAttendanceRequest,
+		encodeAttendanceCSV,
+		options...,
+	))
+	return r
+}
+
+func decodeAttendanceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	params := r.URL.Query()
+	req := AttendanceRequest{Users: splitList(params.Get("users")), Location: time.UTC}
+	if tz := params.Get("tz"); tz != "" {
+		if req.Location, err = time.LoadLocation(tz); err != nil {
+			return nil, errBadRequest
+		}
+	}
+	if req.From, err = parseDateParam(params.Get("from"), req.Location); err != nil {
+		return nil, errBadRequest
+	}
+	if req.To, err = parseDateParam(params.Get("to"), req.Location); err != nil {
+		return nil, errBadRequest
+	}
+	//the last 7 days, today included
+	if req.To.IsZero() {
+		now := time.Now().In(req.Location)
+		req.To = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, req.Location)
+	}
+	if req.From.IsZero() {
+		req.From = req.To.AddDate(0, 0, -7)
+	}
+	if !req.From.Before(req.To) {
+		return nil, errBadRequest
+	}
+	return req, nil
+}
+
+//parseDateParam accepts a calendar day in loc besides the formats of parseTimeParam.
+func parseDateParam(val string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation(attendanceDate, val, loc); err == nil {
+		return t, nil
+	}
+	return parseTimeParam(val)
+}
+
+func encodeAttendanceCSV(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	records := response.([]AttendanceRecord)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=attendance.csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"username", "date", "firstin", "lastout", "onsiteseconds", "shifts", "overnight", "missingentry", "missingexit", "onsite"})
+	for _, record := range records {
+		var in, out string
+		if record.FirstIn != nil {
+			in = record.FirstIn.Format(time.RFC3339)
+		}
+		if record.LastOut != nil {
+			out = record.LastOut.Format(time.RFC3339)
+		}
+		cw.Write([]string{record.Username, record.Date, in, out,
+			strconv.FormatInt(record.OnSiteSeconds, 10), strconv.Itoa(record.Shifts),
+			strconv.FormatBool(record.Overnight), strconv.FormatBool(record.MissingEntry),
+			strconv.FormatBool(record.MissingExit), strconv.FormatBool(record.OnSite)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,173 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAttendanceShifts(t *testing.T) {
+	day := time.Date(2020, time.September, 13, 0, 0, 0, 0, time.UTC)
+	at := func(hours float64) time.Time { return day.Add(time.Duration(hours * float64(time.Hour))) }
+	ptr := func(t time.Time) *time.Time { return &t }
+	type swipe struct {
+		door  string
+		hours float64
+	}
+	tests := []struct {
+		name    string
+		swipes  []swipe
+		now     float64
+		loc     *time.Location
+		records []AttendanceRecord
+	}{
+		{
+			name:   "Day shift",
+			swipes: []swipe{{"HQ-In", 9}, {"HQ-Lab", 10}, {"HQ-Out", 17}},
+			now:    48,
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-13", FirstIn: ptr(at(9)), LastOut: ptr(at(17)), OnSiteSeconds: 8 * 3600, Shifts: 1},
+			},
+		},
+		{
+			name:   "Overnight shift is reported on its first day",
+			swipes: []swipe{{"HQ-In", 22}, {"HQ-Out", 30}},
+			now:    48,
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-13", FirstIn: ptr(at(22)), LastOut: ptr(at(30)), OnSiteSeconds: 8 * 3600, Shifts: 1, Overnight: true},
+			},
+		},
+		{
+			name:   "Second entry and later exit stay in one shift",
+			swipes: []swipe{{"HQ-In", 8}, {"HQ-In", 9}, {"HQ-Out", 12}, {"HQ-Out", 13}},
+			now:    48,
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-13", FirstIn: ptr(at(8)), LastOut: ptr(at(13)), OnSiteSeconds: 5 * 3600, Shifts: 1},
+			},
+		},
+		{
+			name:   "Two shifts a day",
+			swipes: []swipe{{"HQ-In", 1}, {"HQ-Out", 2}, {"HQ-In", 20}, {"HQ-Out", 21}},
+			now:    48,
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-13", FirstIn: ptr(at(1)), LastOut: ptr(at(21)), OnSiteSeconds: 2 * 3600, Shifts: 2},
+			},
+		},
+		{
+			name:   "Missing exit adds no time",
+			swipes: []swipe{{"HQ-In", 9}, {"HQ-In", 33}, {"HQ-Out", 40}},
+			now:    48,
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-13", FirstIn: ptr(at(9)), Shifts: 1, MissingExit: true},
+				{Username: "abc", Date: "2020-09-14", FirstIn: ptr(at(33)), LastOut: ptr(at(40)), OnSiteSeconds: 7 * 3600, Shifts: 1},
+			},
+		},
+		{
+			name:   "Missing exit once the shift is too long",
+			swipes: []swipe{{"HQ-In", 9}},
+			now:    26,
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-13", FirstIn: ptr(at(9)), Shifts: 1, MissingExit: true},
+			},
+		},
+		{
+			name:   "Still on site",
+			swipes: []swipe{{"HQ-In", 9}},
+			now:    12,
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-13", FirstIn: ptr(at(9)), OnSiteSeconds: 3 * 3600, Shifts: 1, OnSite: true},
+			},
+		},
+		{
+			name:   "Missing entry",
+			swipes: []swipe{{"HQ-Out", 17}},
+			now:    48,
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-13", LastOut: ptr(at(17)), Shifts: 1, MissingEntry: true},
+			},
+		},
+		{
+			name:    "Only perimeter doors count",
+			swipes:  []swipe{{"Lab-In", 9}, {"Lab-Out", 17}},
+			now:     48,
+			records: []AttendanceRecord{},
+		},
+		{
+			name:   "Days follow the zone",
+			swipes: []swipe{{"HQ-In", 23}, {"HQ-Out", 23.5}},
+			now:    48,
+			loc:    time.FixedZone("UTC+2", 2*3600),
+			records: []AttendanceRecord{
+				{Username: "abc", Date: "2020-09-14", FirstIn: ptr(at(23)), LastOut: ptr(at(23.5)), OnSiteSeconds: 1800, Shifts: 1},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := newFakeEventsService()
+			for _, s := range test.swipes {
+				events.add("abc", s.door, at(s.hours).Unix())
+			}
+			roster, _ := LoadUserRoster("")
+			a := NewAttendance(testDoors(), events, roster, 16*time.Hour)
+			a.now = func() time.Time { return at(test.now) }
+			req := AttendanceRequest{Users: []string{"abc"}, From: day, To: day.AddDate(0, 0, 2), Location: test.loc}
+			if test.loc != nil {
+				req.From = time.Date(2020, time.September, 13, 0, 0, 0, 0, test.loc)
+				req.To = req.From.AddDate(0, 0, 2)
+			}
+			records, err := a.Report(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//compare instants, FirstIn and LastOut are rendered in the report zone
+			if diff := cmp.Diff(test.records, records, cmp.Comparer(func(a, b time.Time) bool { return a.Equal(b) })); diff != "" {
+				t.Errorf("records mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAttendanceFailure(t *testing.T) {
+	day := time.Date(2020, time.September, 13, 0, 0, 0, 0, time.UTC)
+	events := newFakeEventsService()
+	for _, username := range []string{"abc", "def"} {
+		events.add(username, "HQ-In", day.Add(9*time.Hour).Unix())
+		events.add(username, "HQ-Out", day.Add(17*time.Hour).Unix())
+	}
+	events.errs["bad"] = errors.New("events-go unavailable")
+	roster, _ := LoadUserRoster("")
+	a := NewAttendance(testDoors(), events, roster, 16*time.Hour)
+	users := newFakeUsersService(usermodel.User{Username: "root", IsAdmin: true})
+	h := MakeAttendanceHandler(a, users, log.NewNopLogger(), "/v2")
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "First user fails", path: "/v2/attendance?users=bad,abc&from=2020-09-13&to=2020-09-14"},
+		{name: "Second user fails", path: "/v2/attendance?users=abc,bad,def&from=2020-09-13&to=2020-09-14"},
+		{name: "Second user fails the CSV", path: "/v2/attendance/export?users=abc,bad,def&from=2020-09-13&to=2020-09-14"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			h.ServeHTTP(w, r.WithContext(withActor(r.Context(), "root")))
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("expected status %v, got %v", http.StatusInternalServerError, w.Code)
+			}
+			if diff := cmp.Diff(`{"error":"events-go unavailable"}`, strings.TrimSpace(w.Body.String())); diff != "" {
+				t.Errorf("body mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package base
+
+import (
+	"accessdoor/model"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+//AuditEntry is one line of the audit log. Hash covers every other field,
+//including PrevHash, so editing, dropping or reordering lines breaks the chain.
+type AuditEntry struct {
+	Seq      uint64             `json:"seq"`
+	Change   model.AccessChange `json:"change"`
+	Diff     []DoorDiff         `json:"diff"`
+	PrevHash string             `json:"prevhash"`
+	Hash     string             `json:"hash"`
+}
+
+//DoorDiff is the access to one door before and after a change. A nil side means
+//the door was not in DoorAccess.
+type DoorDiff struct {
+	Door   string `json:"door"`
+	Before *bool  `json:"before"`
+	After  *bool  `json:"after"`
+}
+
+//AuditQuery ...
+type AuditQuery struct {
+	Username string
+	Actor    string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+//auditHead is the last entry of the log, kept in a file next to it. The chain
+//alone cannot show that entries were cut from its end.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+//AuditLog appends access change attempts to a local hash-chained JSON lines file.
+type AuditLog struct {
+	mtx      sync.Mutex
+	path     string
+	file     *os.File
+	seq      uint64
+	lastHash string
+	logger   log.Logger
+}
+
+//OpenAuditLog opens or creates the log at path and verifies the existing chain
+//and its head before appending to it. A last line torn by a crash is dropped.
+func OpenAuditLog(path string, logger log.Logger) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := recoverTornLine(f, logger); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %v: %v", path, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	last, err := VerifyAuditLog(f)
+	if err == nil {
+		err = CheckAuditHead(path, last)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %v: %v", path, err)
+	}
+	logger.Log("method", "OpenAuditLog", "seq", last.Seq, "hash", last.Hash)
+	return &AuditLog{
+		path:     path,
+		file:     f,
+		seq:      last.Seq,
+		lastHash: last.Hash,
+		logger:   logger,
+	}, nil
+}
+
+//OnAccessAttempt implements AccessAttemptListener, so denied and failed
+//changes are logged next to the applied ones.
+func (a *AuditLog) OnAccessAttempt(_ context.Context, change model.AccessChange) {
+	if _, err := a.Append(change); err != nil {
+		a.logger.Log("method", "AuditAppend", "username", change.Username, "requestid", change.RequestID, "err", err)
+	}
+}
+
+//Append chains change onto the log and syncs it to disk.
+func (a *AuditLog) Append(change model.AccessChange) (AuditEntry, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	entry := AuditEntry{
+		Seq:      a.seq + 1,
+		Change:   change,
+		Diff:     diffDoors(change.Before, change.After),
+		PrevHash: a.lastHash,
+	}
+	entry.Hash = hashAuditEntry(entry)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return AuditEntry{}, err
+	}
+	if err := a.file.Sync(); err != nil {
+		return AuditEntry{}, err
+	}
+	a.seq = entry.Seq
+	a.lastHash = entry.Hash
+	return entry, writeAuditHead(a.path, auditHead{Seq: entry.Seq, Hash: entry.Hash})
+}
+
+//Query scans the log for entries matching q, oldest first.
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []AuditEntry{}
+	err = scanAuditLog(f, func(entry AuditEntry) error {
+		change := entry.Change
+		if (q.Username != "" && change.Username != q.Username) ||
+			(q.Actor != "" && change.Actor != q.Actor) ||
+			(!q.From.IsZero() && change.Timestamp.Before(q.From)) ||
+			(!q.To.IsZero() && !change.Timestamp.Before(q.To)) {
+			return nil
+		}
+		entries = append(entries, entry)
+		if q.Limit > 0 && len(entries) > q.Limit {
+			entries = entries[1:]
+		}
+		return nil
+	})
+	return entries, err
+}
+
+//Close ...
+func (a *AuditLog) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.file.Close()
+}
+
+//VerifyAuditLog walks the chain in r and returns the last entry. It fails on the
+//first sequence gap, broken link or entry whose hash does not match its contents.
+func VerifyAuditLog(r io.Reader) (AuditEntry, error) {
+	var last AuditEntry
+	err := scanAuditLog(r, func(entry AuditEntry) error {
+		if entry.Seq != last.Seq+1 {
+			return fmt.Errorf("gap after seq %v: next entry is seq %v", last.Seq, entry.Seq)
+		}
+		if entry.PrevHash != last.Hash {
+			return fmt.Errorf("seq %v does not link to seq %v", entry.Seq, last.Seq)
+		}
+		if hashAuditEntry(entry) != entry.Hash {
+			return fmt.Errorf("seq %v has been modified", entry.Seq)
+		}
+		last = entry
+		return nil
+	})
+	return last, err
+}
+
+//CheckAuditHead compares last, the end of the chain of the log at path, with
+//the head recorded next to it. The log may be one entry ahead, when the
+//process stopped between the two writes. A log without a head file passes.
+func CheckAuditHead(path string, last AuditEntry) error {
+	data, err := ioutil.ReadFile(path + ".head")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var head auditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return fmt.Errorf("head: %v", err)
+	}
+	switch {
+	case head.Seq == last.Seq && head.Hash == last.Hash:
+		return nil
+	case head.Seq+1 == last.Seq && head.Hash == last.PrevHash:
+		return nil
+	case head.Seq > last.Seq:
+		return fmt.Errorf("truncated: head is seq %v but the log ends at seq %v", head.Seq, last.Seq)
+	default:
+		return fmt.Errorf("head seq %v does not match the log ending at seq %v", head.Seq, last.Seq)
+	}
+}
+
+//writeAuditHead replaces the head file, so it is never half written.
+func writeAuditHead(path string, head auditHead) error {
+	data, _ := json.Marshal(head)
+	return replaceFile(path+".head", data)
+}
+
+//replaceFile writes data to a temporary file next to path, syncs it and renames
+//it over path, so readers see the old or the new contents and never a mix.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//recoverTornLine handles a last line without its newline, left by a crash in
+//the middle of Append. A complete entry gets its newline, anything else is cut
+//off. Either way it is logged.
+func recoverTornLine(f *os.File, logger log.Logger) error {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	cut := bytes.LastIndexByte(data, '\n') + 1
+	torn := data[cut:]
+	if json.Valid(torn) {
+		logger.Log("method", "OpenAuditLog", "msg", "completing unterminated last line", "offset", cut)
+		_, err = f.Write([]byte{'\n'})
+		return err
+	}
+	logger.Log("method", "OpenAuditLog", "msg", "dropping torn last line", "offset", cut, "bytes", len(torn))
+	if err := f.Truncate(int64(cut)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func scanAuditLog(r io.Reader, fn func(AuditEntry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func hashAuditEntry(entry AuditEntry) string {
+	entry.Hash = ""
+	payload, _ := json.Marshal(entry)
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+func diffDoors(before, after map[string]bool) []DoorDiff {
+	doors := map[string]bool{}
+	for door := range before {
+		doors[door] = true
+	}
+	for door := range after {
+		doors[door] = true
+	}
+	diff := []DoorDiff{}
+	for door := range doors {
+		b, inBefore := before[door]
+		a, inAfter := after[door]
+		if inBefore == inAfter && b == a {
+			continue
+		}
+		d := DoorDiff{Door: door}
+		if inBefore {
+			d.Before = &b
+		}
+		if inAfter {
+			d.After = &a
+		}
+		diff = append(diff, d)
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Door < diff[j].Door })
+	return diff
+}
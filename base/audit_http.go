@@ -0,0 +1,47 @@
+package base
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+//MakeAuditHandler mounts the audit query route under baseRoute. It needs an
+//admin actor.
+func MakeAuditHandler(a *AuditLog, usersService UsersService, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	r.Methods(http.MethodGet).Path(baseRoute + "/audit").Handler(httptransport.NewServer(
+		requireAdmin(usersService)(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return a.Query(request.(AuditQuery))
+		}),
+		decodeAuditQueryRequest,
+		encodeResponse,
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	))
+	return r
+}
+
+func decodeAuditQueryRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	params := r.URL.Query()
+	query := AuditQuery{
+		Username: params.Get("username"),
+		Actor:    params.Get("actor"),
+	}
+	if query.From, err = parseTimeParam(params.Get("from")); err != nil {
+		return nil, errBadRequest
+	}
+	if query.To, err = parseTimeParam(params.Get("to")); err != nil {
+		return nil, errBadRequest
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return nil, errBadRequest
+		}
+	}
+	return query, nil
+}
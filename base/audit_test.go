@@ -0,0 +1,251 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	a, err := OpenAuditLog(path, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"abc", "def", "ghi"} {
+		_, err := a.Append(model.AccessChange{
+			Actor:     "admin",
+			Username:  username,
+			Before:    usermodel.Doors{"Door1": true},
+			After:     usermodel.Doors{"Door1": false, "Door2": true},
+			Timestamp: time.Unix(1600000000, 0).UTC(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	//reopening continues the chain
+	a, err = OpenAuditLog(path, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := a.Append(model.AccessChange{Username: "jkl"})
+	if err != nil || entry.Seq != 4 {
+		t.Fatalf("expected seq 4, got %v (%v)", entry.Seq, err)
+	}
+	a.Close()
+	if len(entry.Diff) != 0 {
+		t.Fatalf("expected no diff, got %v", entry.Diff)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+	lines := strings.SplitAfter(strings.TrimSpace(string(content)), "\n")
+	tests := []struct {
+		name   string
+		log    string
+		errors bool
+	}{
+		{name: "Intact", log: string(content)},
+		{name: "Modified", log: strings.Replace(string(content), `"username":"def"`, `"username":"xyz"`, 1), errors: true},
+		{name: "Gap", log: lines[0] + lines[2] + lines[3], errors: true},
+		{name: "Truncated head", log: lines[1] + lines[2] + lines[3], errors: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := VerifyAuditLog(strings.NewReader(test.log))
+			if (err != nil) != test.errors {
+				t.Fatalf("unexpected verify result %v", err)
+			}
+		})
+	}
+}
+
+//writeAuditLog appends an entry per username to a new log and returns its path.
+func writeAuditLog(t *testing.T, usernames ...string) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for _, username := range usernames {
+		if _, err := a.Append(model.AccessChange{Username: username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestAuditLogRecovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(content string, lines []string) string
+		errors  bool
+		entries int
+	}{
+		{name: "Intact", edit: func(content string, _ []string) string { return content }, entries: 3},
+		{name: "Truncated tail", edit: func(_ string, lines []string) string { return lines[0] + lines[1] }, errors: true},
+		{name: "Torn last line", edit: func(content string, lines []string) string { return content + lines[0][:20] }, entries: 3},
+		{name: "Unterminated last line", edit: func(_ string, lines []string) string {
+			return lines[0] + lines[1] + strings.TrimSuffix(lines[2], "\n")
+		}, entries: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeAuditLog(t, "abc", "def", "ghi")
+			content, _ := ioutil.ReadFile(path)
+			lines := strings.SplitAfter(strings.TrimSpace(string(content)), "\n")
+			lines[len(lines)-1] += "\n"
+			if err := ioutil.WriteFile(path, []byte(test.edit(string(content), lines)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			a, err := OpenAuditLog(path, log.NewNopLogger())
+			if (err != nil) != test.errors {
+				t.Fatalf("unexpected open result %v", err)
+			}
+			if err != nil {
+				return
+			}
+			defer a.Close()
+			//the log can be appended to after the recovery
+			entry, err := a.Append(model.AccessChange{Username: "jkl"})
+			if err != nil || entry.Seq != uint64(test.entries+1) {
+				t.Fatalf("expected seq %v, got %v (%v)", test.entries+1, entry.Seq, err)
+			}
+			f, _ := os.Open(path)
+			defer f.Close()
+			if _, err := VerifyAuditLog(f); err != nil {
+				t.Fatalf("chain broken after recovery: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckAuditHead(t *testing.T) {
+	path := writeAuditLog(t, "abc", "def")
+	f, _ := os.Open(path)
+	last, err := VerifyAuditLog(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		head   auditHead
+		errors bool
+	}{
+		{name: "Same", head: auditHead{Seq: 2, Hash: last.Hash}},
+		{name: "One behind", head: auditHead{Seq: 1, Hash: last.PrevHash}},
+		{name: "Ahead", head: auditHead{Seq: 3, Hash: "x"}, errors: true},
+		{name: "Other hash", head: auditHead{Seq: 2, Hash: "x"}, errors: true},
+		{name: "Two behind", head: auditHead{Seq: 0, Hash: ""}, errors: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := writeAuditHead(path, test.head); err != nil {
+				t.Fatal(err)
+			}
+			if err := CheckAuditHead(path, last); (err != nil) != test.errors {
+				t.Fatalf("unexpected check result %v", err)
+			}
+		})
+	}
+}
+
+func TestDiffDoors(t *testing.T) {
+	diff := diffDoors(usermodel.Doors{"Door1": true, "Door2": true}, usermodel.Doors{"Door1": true, "Door2": false, "Door3": true})
+	if len(diff) != 2 || diff[0].Door != "Door2" || *diff[0].After || diff[1].Door != "Door3" || diff[1].Before != nil {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+}
+
+func TestAuditAccessAttempts(t *testing.T) {
+	users := newFakeUsersService(
+		usermodel.User{Username: "root", IsAdmin: true, DoorAccess: usermodel.Doors{"Door1": true}},
+		usermodel.User{Username: "bob", DoorAccess: usermodel.Doors{"Door1": true}},
+	)
+	a, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	s := NewService(log.NewNopLogger(), users, newFakeEventsService(), WithAccessAttemptListener(a))
+	tests := []struct {
+		name     string
+		username string
+		outcome  string
+		diff     int
+		err      bool
+	}{
+		{name: "Applied", username: "root", outcome: model.OutcomeApplied, diff: 1},
+		{name: "Denied", username: "bob", outcome: model.OutcomeDenied, err: true},
+		{name: "Failed", username: "ghost", outcome: model.OutcomeFailed, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := withActor(context.Background(), "bob")
+			err := s.UpdateUserAccess(ctx, usermodel.UpdateAccessRequest{Username: test.username, Doors: usermodel.Doors{"Door1": false}})
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			entries, err := a.Query(AuditQuery{Username: test.username})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("expected one entry, got %v", entries)
+			}
+			change := entries[0].Change
+			if change.Outcome != test.outcome || (change.Error != "") != test.err || change.Actor != "bob" {
+				t.Errorf("expected outcome %v by bob, got %+v", test.outcome, change)
+			}
+			//nothing changed for an attempt that was not applied
+			if len(entries[0].Diff) != test.diff {
+				t.Errorf("expected %v doors in the diff, got %v", test.diff, entries[0].Diff)
+			}
+		})
+	}
+}
+
+func TestAuditHandlerNeedsAdmin(t *testing.T) {
+	users := newFakeUsersService(usermodel.User{Username: "root", IsAdmin: true}, usermodel.User{Username: "bob"})
+	a, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	h := MakeAuditHandler(a, users, log.NewNopLogger(), "/v2")
+	tests := []struct {
+		name  string
+		actor string
+		code  int
+	}{
+		{name: "No actor", code: http.StatusForbidden},
+		{name: "User", actor: "bob", code: http.StatusForbidden},
+		{name: "Admin", actor: "root", code: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v2/audit?username=bob", nil)
+			r = r.WithContext(withActor(r.Context(), test.actor))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("expected %v, got %v: %v", test.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
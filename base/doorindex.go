@@ -0,0 +1,307 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+//DoorGrants is the access list of a door.
+type DoorGrants struct {
+	Door  string   `json:"door"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+//DoorEvents is the recent activity of a door.
+type DoorEvents struct {
+	Door   string        `json:"door"`
+	Events []model.Event `json:"events"`
+}
+
+//DoorEventsQuery ...
+type DoorEventsQuery struct {
+	Door    string
+	From    time.Time
+	To      time.Time
+	Outcome string
+	Limit   int
+}
+
+//DoorIndex is a reverse index keyed by door: who holds a grant and who used it
+//recently. Grants come from users-go and are updated incrementally on every
+//access change made through this service. Events older than retention are dropped.
+type DoorIndex struct {
+	mtx       sync.RWMutex
+	userDoors map[string]usermodel.Doors
+	grants    map[string]map[string]bool
+	events    map[string][]model.Event
+	//versions counts the access changes seen per user, so Rebuild does not
+	//overwrite a change made while it read the user
+	versions  map[string]uint64
+	retention time.Duration
+	now       func() time.Time
+}
+
+//NewDoorIndex ...
+func NewDoorIndex(retention time.Duration) *DoorIndex {
+	return &DoorIndex{
+		userDoors: map[string]usermodel.Doors{},
+		grants:    map[string]map[string]bool{},
+		events:    map[string][]model.Event{},
+		versions:  map[string]uint64{},
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+//Rebuild loads the grants and the retained history of every user in roster.
+//A user changed through this service meanwhile keeps the newer grants.
+func (x *DoorIndex) Rebuild(ctx context.Context, usersService UsersService, eventsService EventsService, roster *UserRoster, logger log.Logger) {
+	var from time.Time
+	if x.retention > 0 {
+		from = x.now().Add(-x.retention)
+	}
+	for _, username := range roster.List() {
+		x.mtx.RLock()
+		version := x.versions[username]
+		x.mtx.RUnlock()
+		userinfo, err := usersService.GetUser(ctx, username)
+		if err != nil {
+			logger.Log("method", "DoorIndexRebuild", "username", username, "err", err)
+			continue
+		}
+		x.mtx.Lock()
+		if x.versions[username] == version {
+			x.setGrants(username, userinfo.DoorAccess)
+		}
+		x.mtx.Unlock()
+
+		history, err := fetchEvents(ctx, eventsService, model.EventQuery{Username: username, From: from})
+		if err != nil {
+			logger.Log("method", "DoorIndexRebuild", "username", username, "err", err)
+			continue
+		}
+		x.mtx.Lock()
+		for _, event := range history {
+			x.addEvent(event)
+		}
+		x.mtx.Unlock()
+	}
+	logger.Log("method", "DoorIndexRebuild", "users", len(roster.List()), "doors", len(x.Doors()))
+}
+
+//OnAccessChange implements AccessChangeListener.
+func (x *DoorIndex) OnAccessChange(_ context.Context, change model.AccessChange) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.versions[change.Username]++
+	x.setGrants(change.Username, change.After)
+}
+
+//OnDecision implements DecisionListener.
+func (x *DoorIndex) OnDecision(_ context.Context, event model.Event) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.addEvent(event)
+}
+
+//setGrants replaces the grants of username. x.mtx must be held.
+func (x *DoorIndex) setGrants(username string, doors usermodel.Doors) {
+	for door := range x.userDoors[username] {
+		delete(x.grants[door], username)
+		if len(x.grants[door]) == 0 {
+			delete(x.grants, door)
+		}
+	}
+	granted := usermodel.Doors{}
+	for door, access := range doors {
+		if !access {
+			continue
+		}
+		granted[door] = true
+		if x.grants[door] == nil {
+			x.grants[door] = map[string]bool{}
+		}
+		x.grants[door][username] = true
+	}
+	x.userDoors[username] = granted
+}
+
+//addEvent inserts event in time order and prunes what fell out of retention.
+//A swipe seen live and again in the rebuilt history is only kept once.
+func (x *DoorIndex) addEvent(event model.Event) {
+	events := x.events[event.Door]
+	i := sort.Search(len(events), func(i int) bool { return events[i].Timestamp.After(event.Timestamp) })
+	for j := i - 1; j >= 0 && events[j].Timestamp.Equal(event.Timestamp); j-- {
+		if events[j].Username == event.Username && events[j].Outcome == event.Outcome {
+			return
+		}
+	}
+	events = append(events, model.Event{})
+	copy(events[i+1:], events[i:])
+	events[i] = event
+	x.events[event.Door] = x.retained(events)
+}
+
+//retained drops the events that fell out of retention from the time ordered
+//events.
+func (x *DoorIndex) retained(events []model.Event) []model.Event {
+	if x.retention <= 0 {
+		return events
+	}
+	cutoff := x.now().Add(-x.retention)
+	expired := sort.Search(len(events), func(i int) bool { return !events[i].Timestamp.Before(cutoff) })
+	return events[expired:]
+}
+
+//Prune drops the events that fell out of retention at doors without new
+//activity, which addEvent does not get to.
+func (x *DoorIndex) Prune() {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	for door, events := range x.events {
+		if events = x.retained(events); len(events) == 0 {
+			delete(x.events, door)
+		} else {
+			x.events[door] = events
+		}
+	}
+}
+
+//Run prunes every interval until ctx is done.
+func (x *DoorIndex) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			x.Prune()
+		}
+	}
+}
+
+//Grants ...
+func (x *DoorIndex) Grants(door string) DoorGrants {
+	x.mtx.RLock()
+	defer x.mtx.RUnlock()
+	grants := DoorGrants{Door: door, Users: []string{}}
+	for username := range x.grants[door] {
+		grants.Users = append(grants.Users, username)
+	}
+	sort.Strings(grants.Users)
+	grants.Count = len(grants.Users)
+	return grants
+}
+
+//Events returns the retained activity of a door, newest first.
+func (x *DoorIndex) Events(q DoorEventsQuery) DoorEvents {
+	x.mtx.RLock()
+	defer x.mtx.RUnlock()
+	result := DoorEvents{Door: q.Door, Events: []model.Event{}}
+	events := x.retained(x.events[q.Door])
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if (!q.From.IsZero() && event.Timestamp.Before(q.From)) ||
+			(!q.To.IsZero() && !event.Timestamp.Before(q.To)) ||
+			(q.Outcome != "" && event.Outcome != q.Outcome) {
+			continue
+		}
+		result.Events = append(result.Events, event)
+		if q.Limit > 0 && len(result.Events) == q.Limit {
+			break
+		}
+	}
+	return result
+}
+
+//Doors lists every door with a grant or retained activity.
+func (x *DoorIndex) Doors() []string {
+	x.mtx.RLock()
+	defer x.mtx.RUnlock()
+	seen := map[string]bool{}
+	for door := range x.grants {
+		seen[door] = true
+	}
+	for door, events := range x.events {
+		if len(x.retained(events)) > 0 {
+			seen[door] = true
+		}
+	}
+	doors := make([]string, 0, len(seen))
+	for door := range seen {
+		doors = append(doors, door)
+	}
+	sort.Strings(doors)
+	return doors
+}
+
+//MakeDoorIndexHandler mounts the door-centric routes under baseRoute. They
+//need an admin actor.
+func MakeDoorIndexHandler(x *DoorIndex, usersService UsersService, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	admin := requireAdmin(usersService)
+	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	}
+	r.Methods(http.MethodGet).Path(baseRoute + "/doors").Handler(httptransport.NewServer(
+		admin(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return x.Doors(), nil
+		}),
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/doors/{door}/grants").Handler(httptransport.NewServer(
+		admin(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return x.Grants(request.(string)), nil
+		}),
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			return mux.Vars(r)["door"], nil
+		},
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/doors/{door}/events").Handler(httptransport.NewServer(
+		admin(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return x.Events(request.(DoorEventsQuery)), nil
+		}),
+		decodeDoorEventsRequest,
+		encodeResponse,
+		options...,
+	))
+	return r
+}
+
+func decodeDoorEventsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	params := r.URL.Query()
+	query := DoorEventsQuery{
+		Door:    mux.Vars(r)["door"],
+		Outcome: params.Get("outcome"),
+	}
+	if query.From, err = parseTimeParam(params.Get("from")); err != nil {
+		return nil, errBadRequest
+	}
+	if query.To, err = parseTimeParam(params.Get("to")); err != nil {
+		return nil, errBadRequest
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return nil, errBadRequest
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,95 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDoorIndexRetention(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	x := NewDoorIndex(time.Hour)
+	x.now = func() time.Time { return start }
+	for i, door := range []string{"Door1", "Door2", "Door1"} {
+		x.OnDecision(context.Background(), model.Event{Username: "abc", Door: door, Timestamp: start.Add(time.Duration(i-2) * 20 * time.Minute), Outcome: model.OutcomeGranted})
+	}
+	//the same swipe seen again, e.g. by Rebuild, is kept once
+	x.OnDecision(context.Background(), model.Event{Username: "abc", Door: "Door1", Timestamp: start, Outcome: model.OutcomeGranted})
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		door1 int
+		doors []string
+	}{
+		{name: "Within retention", now: start, door1: 2, doors: []string{"Door1", "Door2"}},
+		{name: "Oldest expired", now: start.Add(30 * time.Minute), door1: 1, doors: []string{"Door1", "Door2"}},
+		{name: "Only newest left", now: start.Add(50 * time.Minute), door1: 1, doors: []string{"Door1"}},
+		{name: "All expired", now: start.Add(2 * time.Hour), door1: 0, doors: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			x.now = func() time.Time { return test.now }
+			if got := len(x.Events(DoorEventsQuery{Door: "Door1"}).Events); got != test.door1 {
+				t.Fatalf("expected %v Door1 events, got %v", test.door1, got)
+			}
+			if diff := cmp.Diff(x.Doors(), test.doors); diff != "" {
+				t.Fatalf("doors differ: (-got +want)\n%s", diff)
+			}
+		})
+	}
+
+	x.Prune()
+	if len(x.events) != 0 {
+		t.Fatalf("expected Prune to drop every door, got %v", x.events)
+	}
+}
+
+//changingUsersService makes an access change through the index while the
+//first user is read, like an updateuseraccess racing a rebuild.
+type changingUsersService struct {
+	*fakeUsersService
+	change func()
+}
+
+func (c *changingUsersService) GetUser(ctx context.Context, username string) (usermodel.User, error) {
+	u, err := c.fakeUsersService.GetUser(ctx, username)
+	if c.change != nil {
+		c.change()
+		c.change = nil
+	}
+	return u, err
+}
+
+func TestDoorIndexRebuildKeepsNewerGrants(t *testing.T) {
+	x := NewDoorIndex(0)
+	users := &changingUsersService{fakeUsersService: newFakeUsersService(
+		usermodel.User{Username: "abc", DoorAccess: usermodel.Doors{"Door1": true}},
+		usermodel.User{Username: "def", DoorAccess: usermodel.Doors{"Door1": true, "Door2": true}},
+	)}
+	users.change = func() {
+		x.OnAccessChange(context.Background(), model.AccessChange{Username: "abc", After: usermodel.Doors{"Door1": false, "Door2": true}})
+	}
+	roster, _ := LoadUserRoster("")
+	roster.Add("abc")
+	roster.Add("def")
+	x.Rebuild(context.Background(), users, newFakeEventsService(), roster, log.NewNopLogger())
+
+	tests := []struct {
+		door  string
+		users []string
+	}{
+		{door: "Door1", users: []string{"def"}},
+		{door: "Door2", users: []string{"abc", "def"}},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(x.Grants(test.door).Users, test.users); diff != "" {
+			t.Fatalf("%v grants differ: (-got +want)\n%s", test.door, diff)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package base
+
+import (
+	"accessdoor/model"
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	//DoorEntry moves the badge holder into the door's area.
+	DoorEntry = "entry"
+	//DoorExit moves the badge holder out of the door's area.
+	DoorExit = "exit"
+	//DoorInternal is inside an area, a swipe confirms the holder is still there.
+	DoorInternal = "internal"
+	//DoorMuster is a muster point reader. Swipes there check people in during a
+	//muster and never move presence.
+	DoorMuster = "muster"
+)
+
+//DoorInfo classifies a door for the reports built on top of access decisions.
+type DoorInfo struct {
+	Area string `json:"area"`
+	Type string `json:"type"`
+	//Perimeter marks the entry and exit doors of the site, used for attendance.
+	Perimeter bool `json:"perimeter,omitempty"`
+	//Sensitivity ranks doors for least-privilege reviews, higher is more sensitive.
+	Sensitivity int `json:"sensitivity,omitempty"`
+}
+
+//DoorCatalog maps a door name to its classification.
+type DoorCatalog map[string]DoorInfo
+
+//Doors holds the current door catalog. Replace swaps it as a whole, so readers
+//see either the old or the new catalog and never a mix.
+type Doors struct {
+	v atomic.Value
+}
+
+//NewDoors ...
+func NewDoors(catalog DoorCatalog) *Doors {
+	d := &Doors{}
+	d.Replace(catalog)
+	return d
+}
+
+//Catalog returns the current catalog. It must not be modified.
+func (d *Doors) Catalog() DoorCatalog {
+	return d.v.Load().(DoorCatalog)
+}
+
+//Replace ...
+func (d *Doors) Replace(catalog DoorCatalog) {
+	d.v.Store(catalog)
+}
+
+//DiffCatalogs lists the doors added to, removed from and reclassified in after.
+func DiffCatalogs(before, after DoorCatalog) (added, removed, changed []string) {
+	for door, info := range after {
+		if old, ok := before[door]; !ok {
+			added = append(added, door)
+		} else if old != info {
+			changed = append(changed, door)
+		}
+	}
+	for door := range before {
+		if _, ok := after[door]; !ok {
+			removed = append(removed, door)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+//LoadDoorCatalog reads a JSON object of door -> {"area", "type", "perimeter", "sensitivity"}.
+//An empty path is an empty catalog.
+func LoadDoorCatalog(path string) (DoorCatalog, error) {
+	catalog := DoorCatalog{}
+	if path == "" {
+		return catalog, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&catalog)
+	return catalog, err
+}
+
+//UserRoster is the set of usernames this service knows about. users-go has no
+//listing call, so it is seeded from a file and grows with every user seen.
+type UserRoster struct {
+	mtx   sync.RWMutex
+	users map[string]bool
+}
+
+//LoadUserRoster reads one username per line. An empty path is an empty roster.
+func LoadUserRoster(path string) (*UserRoster, error) {
+	roster := &UserRoster{users: map[string]bool{}}
+	if path == "" {
+		return roster, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if username := strings.TrimSpace(scanner.Text()); username != "" && !strings.HasPrefix(username, "#") {
+			roster.users[username] = true
+		}
+	}
+	return roster, scanner.Err()
+}
+
+//Add ...
+func (r *UserRoster) Add(username string) {
+	if username == "" {
+		return
+	}
+	r.mtx.RLock()
+	known := r.users[username]
+	r.mtx.RUnlock()
+	if known {
+		return
+	}
+	r.mtx.Lock()
+	r.users[username] = true
+	r.mtx.Unlock()
+}
+
+//List returns the usernames sorted.
+func (r *UserRoster) List() []string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	users := make([]string, 0, len(r.users))
+	for username := range r.users {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	return users
+}
+
+//OnDecision implements DecisionListener.
+func (r *UserRoster) OnDecision(_ context.Context, event model.Event) {
+	r.Add(event.Username)
+}
+
+//OnAccessChange implements AccessChangeListener.
+func (r *UserRoster) OnAccessChange(_ context.Context, change model.AccessChange) {
+	r.Add(change.Username)
+}
@@ -0,0 +1,113 @@
+package base
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadDoorCatalog(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name    string
+		path    string
+		catalog DoorCatalog
+		errors  bool
+	}{
+		{name: "No file", path: "", catalog: DoorCatalog{}},
+		{
+			name: "Classified doors",
+			path: write("doors.json", `{
+				"Lobby": {"area": "HQ", "type": "entry", "perimeter": true},
+				"Lab": {"area": "HQ", "type": "internal", "sensitivity": 3},
+				"Yard": {"type": "muster"}
+			}`),
+			catalog: DoorCatalog{
+				"Lobby": {Area: "HQ", Type: DoorEntry, Perimeter: true},
+				"Lab":   {Area: "HQ", Type: DoorInternal, Sensitivity: 3},
+				"Yard":  {Type: DoorMuster},
+			},
+		},
+		{name: "Invalid JSON", path: write("bad.json", `{"Lobby": `), errors: true},
+		{name: "Missing file", path: filepath.Join(dir, "missing.json"), errors: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			catalog, err := LoadDoorCatalog(test.path)
+			if (err != nil) != test.errors {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(catalog, test.catalog); diff != "" {
+				t.Fatalf("differs: (-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadUserRoster(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roster")
+	if err := ioutil.WriteFile(path, []byte("# staff\nabc\n\n  def  \nabc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	roster, err := LoadUserRoster(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roster.Add("ghi")
+	roster.Add("")
+	if diff := cmp.Diff(roster.List(), []string{"abc", "def", "ghi"}); diff != "" {
+		t.Fatalf("differs: (-got +want)\n%s", diff)
+	}
+}
+
+func TestDiffCatalogs(t *testing.T) {
+	before := DoorCatalog{
+		"Lobby":  {Area: "HQ", Type: DoorEntry, Perimeter: true},
+		"Lab":    {Area: "HQ", Type: DoorInternal, Sensitivity: 2},
+		"Dock":   {Area: "HQ", Type: DoorEntry},
+		"Garage": {Area: "Yard", Type: DoorExit},
+	}
+	tests := []struct {
+		name    string
+		after   DoorCatalog
+		added   []string
+		removed []string
+		changed []string
+	}{
+		{name: "Unchanged", after: before},
+		{name: "Emptied", after: DoorCatalog{}, removed: []string{"Dock", "Garage", "Lab", "Lobby"}},
+		{
+			name: "Added, removed and reclassified",
+			after: DoorCatalog{
+				"Lobby":  {Area: "HQ", Type: DoorEntry, Perimeter: true},
+				"Lab":    {Area: "HQ", Type: DoorInternal, Sensitivity: 3},
+				"Garage": {Area: "HQ", Type: DoorExit},
+				"Roof":   {Area: "HQ", Type: DoorInternal},
+				"Annex":  {Area: "Annex", Type: DoorEntry},
+			},
+			added:   []string{"Annex", "Roof"},
+			removed: []string{"Dock"},
+			changed: []string{"Garage", "Lab"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			added, removed, changed := DiffCatalogs(before, test.after)
+			if diff := cmp.Diff([][]string{test.added, test.removed, test.changed}, [][]string{added, removed, changed}); diff != "" {
+				t.Errorf("diff mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package base
 
 import (
+	"accessdoor/api"
+	"accessdoor/model"
 	"context"
 	"errors"
 	usermodel "users/model"
@@ -10,19 +12,27 @@ import (
 
 //Endpoints ...
 type Endpoints struct {
-	Check            endpoint.Endpoint
-	GetUser          endpoint.Endpoint
-	UpdateUserAccess endpoint.Endpoint
-	DoorAuthenticate endpoint.Endpoint
+	Check              endpoint.Endpoint
+	GetUser            endpoint.Endpoint
+	UpdateUserAccess   endpoint.Endpoint
+	DoorAuthenticate   endpoint.Endpoint
+	GetUserV1          endpoint.Endpoint
+	GetUserFormatted   endpoint.Endpoint
+	DoorAuthenticateV1 endpoint.Endpoint
 }
 
 //MakeServerEndpoints ...
 func MakeServerEndpoints(s Service) Endpoints {
+	getUser := MakeGetUser(s)
+	doorAuthenticate := MakeDoorAuthenticate(s)
 	return Endpoints{
-		Check:            MakeCheck(s),
-		GetUser:          MakeGetUser(s),
-		UpdateUserAccess: MakeUpdateUserAccess(s),
-		DoorAuthenticate: MakeDoorAuthenticate(s),
+		Check:              MakeCheck(s),
+		GetUser:            getUser,
+		UpdateUserAccess:   MakeUpdateUserAccess(s),
+		DoorAuthenticate:   doorAuthenticate,
+		GetUserV1:          v1GetUser(getUser),
+		GetUserFormatted:   formatGetUser(getUser),
+		DoorAuthenticateV1: v1DoorAuthenticate(doorAuthenticate),
 	}
 }
 
@@ -34,11 +44,11 @@ func MakeCheck(s Service) endpoint.Endpoint {
 }
 func MakeGetUser(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		username, ok := request.(string)
+		query, ok := request.(model.EventQuery)
 		if !ok {
 			return nil, errors.New("Bad Request")
 		}
-		return s.GetUser(ctx, username)
+		return s.GetUser(ctx, query)
 	}
 }
 
@@ -52,12 +62,62 @@ func MakeUpdateUserAccess(s Service) endpoint.Endpoint {
 	}
 }
 
+//MakeDoorAuthenticate returns the decision as the response, a denial is not an endpoint error.
 func MakeDoorAuthenticate(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		req, ok := request.(usermodel.DoorAuthenticate)
+		req, ok := request.(model.AuthenticateRequest)
 		if !ok {
 			return nil, errors.New("Bad Request")
 		}
-		return s.DoorAuthenticate(ctx, req)
+		event, err := s.DoorAuthenticate(ctx, req)
+		if err != nil && !IsAccessDenied(err) {
+			return nil, err
+		}
+		return event, nil
+	}
+}
+
+//v1GetUser adapts the typed getuser response to the v1 door -> time string shape.
+func v1GetUser(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		opts, err := api.FormatOptionsFrom(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err = next(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		return api.ToV1Formatted(response.(model.UserEvents), opts), nil
+	}
+}
+
+//formatGetUser renders the typed getuser response in the consumer's zone and format.
+func formatGetUser(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		opts, err := api.FormatOptionsFrom(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err = next(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		return api.ApplyFormat(response.(model.UserEvents), opts), nil
+	}
+}
+
+//v1DoorAuthenticate adapts the decision to the v1 bool response, where a denial is an error.
+func v1DoorAuthenticate(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		response, err = next(ctx, request)
+		if err != nil {
+			return false, err
+		}
+		event := response.(model.Event)
+		if event.Outcome != model.OutcomeGranted {
+			return false, accessDeniedError{door: event.Door}
+		}
+		return true, nil
 	}
 }
@@ -0,0 +1,28 @@
+package base
+
+import (
+	"accessdoor/api"
+	"accessdoor/model"
+	"context"
+	usermodel "users/model"
+)
+
+//fetchEvents returns the typed history of query.Username. Filters are pushed
+//down to events-go and applied again locally, without paging.
+func fetchEvents(ctx context.Context, eventsService EventsService, query model.EventQuery) ([]model.Event, error) {
+	history, err := eventsService.GetEvents(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	query.Limit = 0
+	query.Cursor = ""
+	page, _, err := api.QueryEvents(history, query)
+	if err != nil {
+		return nil, err
+	}
+	events := api.FormatUserEvents(usermodel.User{}, page).Events
+	for i := range events {
+		events[i].Username = query.Username
+	}
+	return events, nil
+}
@@ -0,0 +1,171 @@
+package base
+
+import (
+	"accessdoor/model"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+//ExportRequest selects the events of a bulk export. An empty Users exports
+//every user in the roster, an empty Doors exports every door.
+type ExportRequest struct {
+	Users  []string
+	Doors  map[string]bool
+	From   time.Time
+	To     time.Time
+	Format string
+}
+
+//MakeExportHandler streams events for a user set or door set as CSV or NDJSON.
+//Users are fetched from events-go one at a time and written out immediately,
+//so memory stays bounded by a single user's history whatever the export size.
+//Like the event stream it must not be wrapped in http.TimeoutHandler.
+//
+//A user that cannot be fetched ends the export. Before anything was sent that
+//is an error response, afterwards a terminal error record and the
+//X-Export-Error trailer. It needs an admin actor.
+func MakeExportHandler(eventsService EventsService, usersService UsersService, roster *UserRoster, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkAdmin(r.Context(), usersService); err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+		req, err := decodeExportRequest(r)
+		if err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+		if len(req.Users) == 0 {
+			req.Users = roster.List()
+		}
+		ctx := httptransport.PopulateRequestContext(r.Context(), r)
+		flusher, _ := w.(http.Flusher)
+
+		var write func(model.Event) error
+		var writeError func(username string, err error) error
+		var flush func() error
+		switch req.Format {
+		case ExportNDJSON:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			enc := json.NewEncoder(w)
+			write = func(event model.Event) error { return enc.Encode(event) }
+			writeError = func(username string, err error) error {
+				return enc.Encode(map[string]string{"error": err.Error(), "username": username})
+			}
+			flush = func() error { return nil }
+		default:
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			cw := csv.NewWriter(w)
+			cw.Write([]string{"username", "door", "timestamp", "outcome"})
+			write = func(event model.Event) error {
+				return cw.Write([]string{event.Username, event.Door, event.Timestamp.Format(time.RFC3339), event.Outcome})
+			}
+			writeError = func(username string, err error) error {
+				return cw.Write([]string{"#error", username, "", err.Error()})
+			}
+			flush = func() error {
+				cw.Flush()
+				return cw.Error()
+			}
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=events."+req.Format)
+		w.Header().Set("Trailer", "X-Export-Error")
+
+		//a single door can be pushed down to events-go, a set is filtered here
+		query := model.EventQuery{From: req.From, To: req.To}
+		if len(req.Doors) == 1 {
+			for door := range req.Doors {
+				query.Door = door
+			}
+		}
+		rows := 0
+		for i, username := range req.Users {
+			if ctx.Err() != nil {
+				return
+			}
+			query.Username = username
+			history, err := fetchEvents(ctx, eventsService, query)
+			if err != nil {
+				logger.Log("method", "ExportEvents", "username", username, "rows", rows, "err", err)
+				if i == 0 {
+					//nothing was sent yet
+					for _, header := range []string{"Content-Disposition", "Trailer"} {
+						w.Header().Del(header)
+					}
+					encodeError(ctx, err, w)
+					return
+				}
+				writeError(username, err)
+				flush()
+				w.Header().Set("X-Export-Error", username+": "+err.Error())
+				return
+			}
+			for _, event := range history {
+				if len(req.Doors) > 0 && !req.Doors[event.Door] {
+					continue
+				}
+				if err := write(event); err != nil {
+					return
+				}
+				rows++
+			}
+			if err := flush(); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		logger.Log("method", "ExportEvents", "users", len(req.Users), "rows", rows, "format", req.Format)
+	})
+}
+
+func decodeExportRequest(r *http.Request) (ExportRequest, error) {
+	params := r.URL.Query()
+	req := ExportRequest{
+		Users:  splitList(params.Get("users")),
+		Doors:  map[string]bool{},
+		Format: params.Get("format"),
+	}
+	for _, door := range splitList(params.Get("doors")) {
+		req.Doors[door] = true
+	}
+	if req.Format == "" {
+		req.Format = ExportCSV
+		if strings.Contains(r.Header.Get("Accept"), "ndjson") {
+			req.Format = ExportNDJSON
+		}
+	}
+	if req.Format != ExportCSV && req.Format != ExportNDJSON {
+		return req, errBadRequest
+	}
+	var err error
+	if req.From, err = parseTimeParam(params.Get("from")); err != nil {
+		return req, errBadRequest
+	}
+	if req.To, err = parseTimeParam(params.Get("to")); err != nil {
+		return req, errBadRequest
+	}
+	return req, nil
+}
+
+func splitList(val string) []string {
+	list := []string{}
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,75 @@
+package base
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestExportFailure(t *testing.T) {
+	events := newFakeEventsService()
+	events.add("abc", "Door1", 1600000000)
+	events.add("def", "Door1", 1600000100)
+	events.errs["bad"] = errors.New("events-go unavailable")
+	roster, _ := LoadUserRoster("")
+	users := newFakeUsersService(usermodel.User{Username: "root", IsAdmin: true})
+	h := MakeExportHandler(events, users, roster, log.NewNopLogger())
+
+	tests := []struct {
+		name    string
+		query   string
+		code    int
+		body    []string
+		trailer string
+	}{
+		{
+			name:  "Complete",
+			query: "users=abc,def",
+			code:  http.StatusOK,
+			body:  []string{"username,door,timestamp,outcome", "abc,Door1,2020-09-13T12:26:40Z,granted", "def,Door1,2020-09-13T12:28:20Z,granted"},
+		},
+		{
+			name:  "First user fails",
+			query: "users=bad,abc",
+			code:  http.StatusInternalServerError,
+			body:  []string{`{"error":"events-go unavailable"}`},
+		},
+		{
+			name:    "Later user fails as CSV",
+			query:   "users=abc,bad,def",
+			code:    http.StatusOK,
+			body:    []string{"username,door,timestamp,outcome", "abc,Door1,2020-09-13T12:26:40Z,granted", "#error,bad,,events-go unavailable"},
+			trailer: "bad: events-go unavailable",
+		},
+		{
+			name:    "Later user fails as NDJSON",
+			query:   "users=abc,bad,def&format=ndjson",
+			code:    http.StatusOK,
+			body:    []string{`{"username":"abc","door":"Door1","timestamp":"2020-09-13T12:26:40Z","outcome":"granted"}`, `{"error":"events-go unavailable","username":"bad"}`},
+			trailer: "bad: events-go unavailable",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/v2/events/export?"+test.query, nil)
+			h.ServeHTTP(w, r.WithContext(withActor(r.Context(), "root")))
+			resp := w.Result()
+			if resp.StatusCode != test.code {
+				t.Fatalf("expected %v, got %v", test.code, resp.StatusCode)
+			}
+			body := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+			if strings.Join(body, "\n") != strings.Join(test.body, "\n") {
+				t.Fatalf("unexpected body\n%v", w.Body.String())
+			}
+			if got := resp.Trailer.Get("X-Export-Error"); got != test.trailer {
+				t.Fatalf("expected trailer %q, got %q", test.trailer, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"errors"
+	eventmodel "events/model"
+	"sync"
+	usermodel "users/model"
+)
+
+//fakeUsersService keeps users in memory. UpdateUserAccess replaces the
+//DoorAccess of the user with the request like users-go does.
+type fakeUsersService struct {
+	mtx     sync.Mutex
+	users   map[string]usermodel.User
+	gets    int
+	updates []usermodel.UpdateAccessRequest
+}
+
+func newFakeUsersService(users ...usermodel.User) *fakeUsersService {
+	f := &fakeUsersService{users: map[string]usermodel.User{}}
+	for _, u := range users {
+		f.users[u.Username] = u
+	}
+	return f
+}
+
+func (f *fakeUsersService) GetUser(_ context.Context, username string) (usermodel.User, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.gets++
+	u, ok := f.users[username]
+	if !ok {
+		return usermodel.User{}, errors.New("user not found")
+	}
+	doors := usermodel.Doors{}
+	for door, access := range u.DoorAccess {
+		doors[door] = access
+	}
+	u.DoorAccess = doors
+	return u, nil
+}
+
+func (f *fakeUsersService) UpdateUserAccess(_ context.Context, req usermodel.UpdateAccessRequest) (string, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	u, ok := f.users[req.Username]
+	if !ok {
+		return "", errors.New("user not found")
+	}
+	u.DoorAccess = req.Doors
+	f.users[req.Username] = u
+	f.updates = append(f.updates, req)
+	return "updated", nil
+}
+
+func (f *fakeUsersService) DoorAuthenticate(_ context.Context, req usermodel.DoorAuthenticate) (string, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.users[req.Username].DoorAccess[req.AccessDoor] {
+		return "access granted", nil
+	}
+	return "access not granted", nil
+}
+
+//fakeEventsService keeps event histories in memory and fails the users in
+//errs. It ignores the filters, the callers apply them again.
+type fakeEventsService struct {
+	mtx    sync.Mutex
+	events map[string][]map[string]int64
+	errs   map[string]error
+}
+
+func newFakeEventsService() *fakeEventsService {
+	return &fakeEventsService{events: map[string][]map[string]int64{}, errs: map[string]error{}}
+}
+
+//add records a swipe of username at door.
+func (f *fakeEventsService) add(username, door string, unixtime int64) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.events[username] = append(f.events[username], map[string]int64{door: unixtime})
+}
+
+func (f *fakeEventsService) GetEvents(_ context.Context, query model.EventQuery) (eventmodel.Events, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.errs[query.Username]; err != nil {
+		return eventmodel.Events{}, err
+	}
+	return eventmodel.Events{Username: query.Username, Events: append([]map[string]int64{}, f.events[query.Username]...)}, nil
+}
+
+func (f *fakeEventsService) UpdateEvents(_ context.Context, req eventmodel.UpdateEventRequest) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.events[req.Username] = append(f.events[req.Username], req.Event)
+	return nil
+}
+
+//withActor is the context NewActorHandler gives a request of username.
+func withActor(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, contextKeyActor, &identity{actor: username})
+}
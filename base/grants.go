@@ -0,0 +1,307 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+var (
+	errNoAnalysis  = errors.New("no grant analysis has run yet")
+	errNotUnused   = errors.New("grant is not unused in the latest analysis")
+	errNoSelection = errors.New("no grants selected")
+)
+
+//UnusedGrant is a door a user holds access to without a granted swipe within
+//the lookback.
+type UnusedGrant struct {
+	Username    string `json:"username"`
+	Door        string `json:"door"`
+	Area        string `json:"area,omitempty"`
+	Sensitivity int    `json:"sensitivity"`
+}
+
+//GrantAnalysis is the result of one analysis run, most sensitive doors first.
+type GrantAnalysis struct {
+	GeneratedAt time.Time     `json:"generatedat"`
+	Since       time.Time     `json:"since"`
+	Users       int           `json:"users"`
+	Grants      int           `json:"grants"`
+	Unused      []UnusedGrant `json:"unused"`
+	Errors      []string      `json:"errors,omitempty"`
+}
+
+//RevokeRequest selects grants of the latest analysis to revoke.
+type RevokeRequest struct {
+	Grants []UnusedGrant `json:"grants"`
+}
+
+//RevokeResult is the outcome of revoking one user's selected grants.
+type RevokeResult struct {
+	Username string   `json:"username"`
+	Doors    []string `json:"doors"`
+	Error    string   `json:"error,omitempty"`
+}
+
+//GrantAnalyzer compares each roster user's grants with their events over the
+//lookback and keeps the latest report. Revocations are made through service,
+//so they reach the access change listeners like any other change.
+type GrantAnalyzer struct {
+	mtx           sync.RWMutex
+	doors         *Doors
+	service       Service
+	usersService  UsersService
+	eventsService EventsService
+	roster        *UserRoster
+	lookback      time.Duration
+	logger        log.Logger
+	latest        *GrantAnalysis
+	now           func() time.Time
+}
+
+//NewGrantAnalyzer ...
+func NewGrantAnalyzer(doors *Doors, service Service, usersService UsersService, eventsService EventsService, roster *UserRoster,
+	lookback time.Duration, logger log.Logger) *GrantAnalyzer {
+	return &GrantAnalyzer{
+		doors:         doors,
+		service:       service,
+		usersService:  usersService,
+		eventsService: eventsService,
+		roster:        roster,
+		lookback:      lookback,
+		logger:        logger,
+		now:           time.Now,
+	}
+}
+
+//Run analyses every interval until ctx is done, starting right away. A zero
+//interval only runs once.
+func (g *GrantAnalyzer) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		g.Analyze(ctx, g.lookback)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		g.Analyze(ctx, g.lookback)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//Analyze runs the analysis over lookback and keeps it as the latest report.
+//Users that cannot be read are skipped and listed in Errors.
+func (g *GrantAnalyzer) Analyze(ctx context.Context, lookback time.Duration) GrantAnalysis {
+	now := g.now()
+	analysis := GrantAnalysis{
+		GeneratedAt: now.UTC(),
+		Since:       now.Add(-lookback).UTC(),
+		Unused:      []UnusedGrant{},
+	}
+	for _, username := range g.roster.List() {
+		userinfo, err := g.usersService.GetUser(ctx, username)
+		if err != nil {
+			analysis.Errors = append(analysis.Errors, username+": "+err.Error())
+			continue
+		}
+		history, err := fetchEvents(ctx, g.eventsService, model.EventQuery{Username: username, From: analysis.Since})
+		if err != nil {
+			analysis.Errors = append(analysis.Errors, username+": "+err.Error())
+			continue
+		}
+		used := map[string]bool{}
+		for _, event := range history {
+			if event.Outcome == model.OutcomeGranted {
+				used[event.Door] = true
+			}
+		}
+		analysis.Users++
+		for door, access := range userinfo.DoorAccess {
+			if !access {
+				continue
+			}
+			analysis.Grants++
+			if !used[door] {
+				info := g.doors.Catalog()[door]
+				analysis.Unused = append(analysis.Unused, UnusedGrant{
+					Username:    username,
+					Door:        door,
+					Area:        info.Area,
+					Sensitivity: info.Sensitivity,
+				})
+			}
+		}
+	}
+	sort.Slice(analysis.Unused, func(i, j int) bool {
+		a, b := analysis.Unused[i], analysis.Unused[j]
+		if a.Sensitivity != b.Sensitivity {
+			return a.Sensitivity > b.Sensitivity
+		}
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+		return a.Door < b.Door
+	})
+	g.mtx.Lock()
+	g.latest = &analysis
+	g.mtx.Unlock()
+	g.logger.Log("method", "GrantAnalysis", "users", analysis.Users, "grants", analysis.Grants, "unused", len(analysis.Unused), "errors", len(analysis.Errors))
+	return analysis
+}
+
+//Latest ...
+func (g *GrantAnalyzer) Latest() (GrantAnalysis, error) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	if g.latest == nil {
+		return GrantAnalysis{}, errNoAnalysis
+	}
+	return *g.latest, nil
+}
+
+//Revoke removes the selected grants, one users-go update per user. Every grant
+//must be unused in the latest analysis and the actor must be an admin.
+func (g *GrantAnalyzer) Revoke(ctx context.Context, req RevokeRequest) ([]RevokeResult, error) {
+	if err := checkAdmin(ctx, g.usersService); err != nil {
+		return nil, err
+	}
+	if len(req.Grants) == 0 {
+		return nil, errNoSelection
+	}
+	latest, err := g.Latest()
+	if err != nil {
+		return nil, err
+	}
+	unused := map[UnusedGrant]bool{}
+	for _, grant := range latest.Unused {
+		unused[UnusedGrant{Username: grant.Username, Door: grant.Door}] = true
+	}
+	byUser := map[string]usermodel.Doors{}
+	users := []string{}
+	for _, grant := range req.Grants {
+		if !unused[UnusedGrant{Username: grant.Username, Door: grant.Door}] {
+			return nil, errNotUnused
+		}
+		if byUser[grant.Username] == nil {
+			byUser[grant.Username] = usermodel.Doors{}
+			users = append(users, grant.Username)
+		}
+		byUser[grant.Username][grant.Door] = false
+	}
+
+	results := make([]RevokeResult, 0, len(users))
+	for _, username := range users {
+		result := RevokeResult{Username: username, Doors: []string{}}
+		for door := range byUser[username] {
+			result.Doors = append(result.Doors, door)
+		}
+		sort.Strings(result.Doors)
+		if err := g.revoke(ctx, username, byUser[username]); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+//revoke sends the user's whole access list with the selected doors turned off,
+//users-go replaces the list on every update.
+func (g *GrantAnalyzer) revoke(ctx context.Context, username string, doors usermodel.Doors) error {
+	userinfo, err := g.usersService.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	req := usermodel.UpdateAccessRequest{Username: username, Doors: usermodel.Doors{}}
+	for door, access := range userinfo.DoorAccess {
+		req.Doors[door] = access
+	}
+	for door := range doors {
+		req.Doors[door] = false
+	}
+	if err := g.service.UpdateUserAccess(ctx, req); err != nil {
+		return err
+	}
+
+	//revoked grants leave the latest report so they cannot be selected twice
+	g.mtx.Lock()
+	if g.latest != nil {
+		unused := []UnusedGrant{}
+		for _, grant := range g.latest.Unused {
+			if _, revoked := doors[grant.Door]; !revoked || grant.Username != username {
+				unused = append(unused, grant)
+			}
+		}
+		g.latest.Unused = unused
+	}
+	g.mtx.Unlock()
+	securityLogger(g.logger).Log("method", "RevokeUnusedGrants", "actor", actor(ctx), "username", username, "doors", len(doors))
+	return nil
+}
+
+//MakeGrantHandler mounts the grant analysis routes under baseRoute.
+func MakeGrantHandler(g *GrantAnalyzer, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	}
+	r.Methods(http.MethodGet).Path(baseRoute + "/grants/unused").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return g.Latest()
+		},
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodPost).Path(baseRoute + "/grants/unused").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			if err := checkAdmin(ctx, g.usersService); err != nil {
+				return nil, err
+			}
+			return g.Analyze(ctx, request.(time.Duration)), nil
+		},
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			lookback := g.lookback
+			if days := r.URL.Query().Get("lookbackdays"); days != "" {
+				n, err := strconv.Atoi(days)
+				if err != nil || n < 1 {
+					return nil, errBadRequest
+				}
+				lookback = time.Duration(n) * 24 * time.Hour
+			}
+			return lookback, nil
+		},
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodPost).Path(baseRoute + "/grants/revoke").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return g.Revoke(ctx, request.(RevokeRequest))
+		},
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			var req RevokeRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				return nil, errBadRequest
+			}
+			return req, nil
+		},
+		encodeResponse,
+		options...,
+	))
+	return r
+}
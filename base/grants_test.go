@@ -0,0 +1,122 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+//recordingChanges keeps every access change it is told about.
+type recordingChanges struct {
+	changes []model.AccessChange
+}
+
+func (r *recordingChanges) OnAccessChange(_ context.Context, change model.AccessChange) {
+	r.changes = append(r.changes, change)
+}
+
+func TestGrantRevoke(t *testing.T) {
+	now := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	newAnalyzer := func() (*GrantAnalyzer, *fakeUsersService, *recordingChanges) {
+		users := newFakeUsersService(
+			usermodel.User{Username: "admin", IsAdmin: true},
+			usermodel.User{Username: "abc", DoorAccess: usermodel.Doors{"HQ-In": true, "HQ-Lab": true, "Lab-In": true, "Yard": false}},
+			usermodel.User{Username: "def", DoorAccess: usermodel.Doors{"HQ-Lab": true}},
+		)
+		events := newFakeEventsService()
+		events.add("abc", "HQ-In", now.Add(-time.Hour).Unix())
+		roster, _ := LoadUserRoster("")
+		roster.Add("abc")
+		roster.Add("def")
+		changes := &recordingChanges{}
+		s := NewService(log.NewNopLogger(), users, events, WithAccessChangeListener(changes))
+		g := NewGrantAnalyzer(testDoors(), s, users, events, roster, 24*time.Hour, log.NewNopLogger())
+		g.now = func() time.Time { return now }
+		g.Analyze(context.Background(), g.lookback)
+		return g, users, changes
+	}
+
+	tests := []struct {
+		name    string
+		actor   string
+		grants  []UnusedGrant
+		err     error
+		results []RevokeResult
+		access  map[string]usermodel.Doors
+		unused  []UnusedGrant
+	}{
+		{
+			name:    "Untouched grants survive",
+			actor:   "admin",
+			grants:  []UnusedGrant{{Username: "abc", Door: "HQ-Lab"}, {Username: "def", Door: "HQ-Lab"}},
+			results: []RevokeResult{{Username: "abc", Doors: []string{"HQ-Lab"}}, {Username: "def", Doors: []string{"HQ-Lab"}}},
+			access: map[string]usermodel.Doors{
+				"abc": {"HQ-In": true, "HQ-Lab": false, "Lab-In": true, "Yard": false},
+				"def": {"HQ-Lab": false},
+			},
+			unused: []UnusedGrant{{Username: "abc", Door: "Lab-In"}},
+		},
+		{
+			name:   "Actor must be an admin",
+			actor:  "abc",
+			grants: []UnusedGrant{{Username: "abc", Door: "HQ-Lab"}},
+			err:    errNotAdmin,
+		},
+		{
+			name:   "Grant in use",
+			actor:  "admin",
+			grants: []UnusedGrant{{Username: "abc", Door: "HQ-In"}},
+			err:    errNotUnused,
+		},
+		{
+			name:  "Nothing selected",
+			actor: "admin",
+			err:   errNoSelection,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, users, changes := newAnalyzer()
+			results, err := g.Revoke(withActor(context.Background(), test.actor), RevokeRequest{Grants: test.grants})
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if err != nil {
+				if len(users.updates) != 0 || len(changes.changes) != 0 {
+					t.Fatalf("expected no updates, got %v", users.updates)
+				}
+				return
+			}
+			if diff := cmp.Diff(test.results, results); diff != "" {
+				t.Errorf("results mismatch (-want +got):\n%s", diff)
+			}
+			for username, doors := range test.access {
+				if diff := cmp.Diff(doors, users.users[username].DoorAccess); diff != "" {
+					t.Errorf("%v access mismatch (-want +got):\n%s", username, diff)
+				}
+			}
+			//every revocation reaches the listeners once, through the service
+			if len(changes.changes) != len(test.results) {
+				t.Fatalf("expected %v access changes, got %v", len(test.results), len(changes.changes))
+			}
+			for _, change := range changes.changes {
+				if change.Actor != test.actor || change.ActorRole != model.RoleAdmin {
+					t.Errorf("unexpected actor %v with role %v", change.Actor, change.ActorRole)
+				}
+				if diff := cmp.Diff(test.access[change.Username], change.After); diff != "" {
+					t.Errorf("%v after mismatch (-want +got):\n%s", change.Username, diff)
+				}
+			}
+			latest, _ := g.Latest()
+			if diff := cmp.Diff(test.unused, latest.Unused, cmpopts.IgnoreFields(UnusedGrant{}, "Area", "Sensitivity")); diff != "" {
+				t.Errorf("unused mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -1,16 +1,19 @@
 package base
 
 import (
+	"accessdoor/api"
+	"accessdoor/model"
 	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	usermodel "users/model"
 
 	"github.com/go-kit/kit/log"
 	httptransport "github.com/go-kit/kit/transport/http"
-	"github.com/gorilla/mux"
 )
 
 var (
@@ -18,19 +21,22 @@ var (
 )
 
 // MakeHTTPHandler mounts all of the service endpoints into an http.Handler.
+// version is the path segment of the original API, the typed API is served beside it under v2.
 func MakeHTTPHandler(s Service, logger log.Logger, version string, basePath string) http.Handler {
-	r := mux.NewRouter()
+	r := newRouter()
 	e := MakeServerEndpoints(s)
 
 	baseRoute := "/" + basePath + "/" + version
+	v2Route := "/" + basePath + "/v2"
 
 	r.Methods(http.MethodGet).Path("/healthcheck").Handler(httptransport.NewServer(
 		e.Check,
 		httptransport.NopRequestDecoder,
 		encodeHealthResponse,
+		httptransport.ServerErrorEncoder(encodeError),
 	))
 	r.Methods(http.MethodPost).Path(baseRoute + "/authenticate").Handler(httptransport.NewServer(
-		e.DoorAuthenticate,
+		e.DoorAuthenticateV1,
 		decodedoorauthenticateRequest,
 		encodeResponse,
 		httptransport.ServerBefore(httptransport.PopulateRequestContext),
@@ -41,11 +47,34 @@ func MakeHTTPHandler(s Service, logger log.Logger, version string, basePath stri
 		encodeResponse,
 		httptransport.ServerBefore(httptransport.PopulateRequestContext),
 	))
+	//v1 errors keep the go-kit default, a plain text 500
 	r.Methods(http.MethodGet).Path(baseRoute + "/getuser").Handler(httptransport.NewServer(
-		e.GetUser,
+		e.GetUserV1,
 		decodeGetUserRequest,
 		encodeResponse,
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, api.PopulateFormat),
+	))
+
+	r.Methods(http.MethodPost).Path(v2Route + "/authenticate").Handler(httptransport.NewServer(
+		e.DoorAuthenticate,
+		decodedoorauthenticateRequest,
+		encodeResponse,
 		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+	))
+	r.Methods(http.MethodPost).Path(v2Route + "/updateuseraccess").Handler(httptransport.NewServer(
+		e.UpdateUserAccess,
+		decodeUpdateUserRequest,
+		encodeResponse,
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+	))
+	r.Methods(http.MethodGet).Path(v2Route + "/getuser").Handler(httptransport.NewServer(
+		e.GetUserFormatted,
+		decodeGetUserRequest,
+		encodeResponse,
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, api.PopulateFormat),
+		httptransport.ServerErrorEncoder(encodeError),
 	))
 	return r
 }
@@ -78,12 +107,33 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 		panic("encodeError with nil error")
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(codeFrom(err))
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"error": err.Error(),
 	})
 }
 
+func codeFrom(err error) int {
+	switch err {
+	case errBadRequest, errInvalidWebhook, errWebhookTarget, api.ErrInvalidCursor, api.ErrInvalidOrder, api.ErrInvalidOutcome,
+		api.ErrInvalidTimezone, api.ErrInvalidTimeFormat, errInvalidGroupBy,
+		errNotUnused, errNoSelection:
+		return http.StatusBadRequest
+	case errNotFound, errNoAnalysis:
+		return http.StatusNotFound
+	case errClientCertRequired:
+		return http.StatusUnauthorized
+	case errNotAdmin:
+		return http.StatusForbidden
+	case errMusterActive, errMusterRunning, errUnsubscribed:
+		return http.StatusConflict
+	case errShuttingDown:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		encodeError(ctx, e.error(), w)
@@ -97,11 +147,43 @@ func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response i
 	return json.NewEncoder(w).Encode(response)
 }
 func decodeGetUserRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		return "", errBadRequest
+	params := r.URL.Query()
+	query := model.EventQuery{
+		Username: params.Get("username"),
+		Door:     params.Get("door"),
+		Outcome:  params.Get("outcome"),
+		Order:    params.Get("order"),
+		Cursor:   params.Get("cursor"),
+	}
+	if query.Username == "" {
+		return query, errBadRequest
+	}
+	if query.From, err = parseTimeParam(params.Get("from")); err != nil {
+		return query, errBadRequest
+	}
+	if query.To, err = parseTimeParam(params.Get("to")); err != nil {
+		return query, errBadRequest
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return query, errBadRequest
+		}
+	}
+	if err := api.ValidateQuery(query); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+//parseTimeParam accepts either RFC 3339 or unix seconds. An empty value is the zero time.
+func parseTimeParam(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if unixtime, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(unixtime, 0), nil
 	}
-	return username, nil
+	return time.Parse(time.RFC3339, val)
 }
 
 func decodeUpdateUserRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
@@ -111,7 +193,7 @@ func decodeUpdateUserRequest(_ context.Context, r *http.Request) (request interf
 }
 
 func decodedoorauthenticateRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
-	var req usermodel.DoorAuthenticate
+	var req model.AuthenticateRequest
 	err = json.NewDecoder(r.Body).Decode(&req)
 	return req, nil
 }
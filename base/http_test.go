@@ -0,0 +1,52 @@
+package base
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestGetUserFormatErrors(t *testing.T) {
+	users := newFakeUsersService(usermodel.User{Username: "abc", DoorAccess: usermodel.Doors{"Door1": true}})
+	events := newFakeEventsService()
+	events.add("abc", "Door1", 1600000000)
+	s := NewService(log.NewNopLogger(), users, events)
+	h := MakeHTTPHandler(s, log.NewNopLogger(), "v1", "accessdoor")
+
+	tests := []struct {
+		name        string
+		target      string
+		header      string
+		code        int
+		contentType string
+	}{
+		{name: "v1 plain", target: "/accessdoor/v1/getuser?username=abc", code: http.StatusOK, contentType: "application/json; charset=utf-8"},
+		{name: "v1 zone", target: "/accessdoor/v1/getuser?username=abc&tz=Europe/Berlin", code: http.StatusOK, contentType: "application/json; charset=utf-8"},
+		//v1 errors are the go-kit default its clients know
+		{name: "v1 bad zone", target: "/accessdoor/v1/getuser?username=abc&tz=Nowhere/Else", code: http.StatusInternalServerError, contentType: "text/plain; charset=utf-8"},
+		{name: "v1 bad header zone", target: "/accessdoor/v1/getuser?username=abc", header: "Nowhere/Else", code: http.StatusInternalServerError, contentType: "text/plain; charset=utf-8"},
+		{name: "v1 bad format", target: "/accessdoor/v1/getuser?username=abc&timeformat=roman", code: http.StatusInternalServerError, contentType: "text/plain; charset=utf-8"},
+		{name: "v1 unknown user", target: "/accessdoor/v1/getuser?username=xyz", code: http.StatusInternalServerError, contentType: "text/plain; charset=utf-8"},
+		{name: "v2 bad zone", target: "/accessdoor/v2/getuser?username=abc&tz=Nowhere/Else", code: http.StatusBadRequest, contentType: "application/json; charset=utf-8"},
+		{name: "v2 unknown user", target: "/accessdoor/v2/getuser?username=xyz", code: http.StatusInternalServerError, contentType: "application/json; charset=utf-8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+			if test.header != "" {
+				r.Header.Set("X-Timezone", test.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("status = %d, want %d: %s", w.Code, test.code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("content type = %q, want %q", got, test.contentType)
+			}
+		})
+	}
+}
@@ -47,11 +47,11 @@ func (s instrumentingService) instrument(begin time.Time, methodName string, err
 	}
 }
 
-func (s instrumentingService) GetUser(ctx context.Context, username string) (res model.UserResponse, err error) {
+func (s instrumentingService) GetUser(ctx context.Context, query model.EventQuery) (res model.UserEvents, err error) {
 	defer func(begin time.Time) {
 		s.instrument(begin, "GetUser", err)
 	}(time.Now())
-	return s.next.GetUser(ctx, username)
+	return s.next.GetUser(ctx, query)
 }
 
 func (s instrumentingService) UpdateUserAccess(ctx context.Context, req usermodel.UpdateAccessRequest) (err error) {
@@ -60,7 +60,7 @@ func (s instrumentingService) UpdateUserAccess(ctx context.Context, req usermode
 	}(time.Now())
 	return s.next.UpdateUserAccess(ctx, req)
 }
-func (s instrumentingService) DoorAuthenticate(ctx context.Context, req usermodel.DoorAuthenticate) (hasaccess bool, err error) {
+func (s instrumentingService) DoorAuthenticate(ctx context.Context, req model.AuthenticateRequest) (event model.Event, err error) {
 	defer func(begin time.Time) {
 		s.instrument(begin, "DoorAuthenticate", err)
 	}(time.Now())
@@ -130,11 +130,11 @@ func NewEventsProxyInstrumentingService(labelNames []string, counter metrics.Cou
 	}
 }
 
-func (s eventsServiceInstrumentingService) GetEvents(ctx context.Context, username string) (resp eventmodel.Events, err error) {
+func (s eventsServiceInstrumentingService) GetEvents(ctx context.Context, query model.EventQuery) (resp eventmodel.Events, err error) {
 	defer func(begin time.Time) {
 		s.is.instrument(begin, "GetEvents", err)
 	}(time.Now())
-	return s.next.GetEvents(ctx, username)
+	return s.next.GetEvents(ctx, query)
 }
 
 func (s eventsServiceInstrumentingService) UpdateEvents(ctx context.Context, request eventmodel.UpdateEventRequest) (err error) {
@@ -0,0 +1,140 @@
+package base
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/gorilla/mux"
+)
+
+//routeUnmatched labels requests no route matched, they end in 404 or 405.
+const routeUnmatched = "unmatched"
+
+//HTTPMetrics are the transport level RED metrics. They see every request,
+//including those that fail routing, decoding or the server timeout.
+//Requests, Duration and ResponseSize are labelled with route and code,
+//InFlight, Timeouts and Panics with route.
+type HTTPMetrics struct {
+	Requests     metrics.Counter
+	Duration     metrics.Histogram
+	ResponseSize metrics.Histogram
+	InFlight     metrics.Gauge
+	Timeouts     metrics.Counter
+	Panics       metrics.Counter
+}
+
+//matchedRoute carries the route template from inside the routers back out to
+//NewHTTPMetricsHandler. Routers are nested, the innermost match names the
+//request. The handler behind a http.TimeoutHandler may still run after the
+//request is done, hence the lock.
+type matchedRoute struct {
+	mtx      sync.Mutex
+	m        *HTTPMetrics
+	template string
+	ctx      context.Context
+	inFlight bool
+	done     bool
+}
+
+//match names the request after template and moves it to that route in flight.
+//ctx is the request context the route runs with, it has the deadline of a
+//http.TimeoutHandler in front of the route.
+func (route *matchedRoute) match(template string, ctx context.Context) {
+	route.mtx.Lock()
+	defer route.mtx.Unlock()
+	if route.done {
+		return
+	}
+	if route.inFlight {
+		route.m.InFlight.With("route", route.template).Add(-1)
+	}
+	route.template = template
+	route.ctx = ctx
+	route.m.InFlight.With("route", route.template).Add(1)
+	route.inFlight = true
+}
+
+//finish ends the request on its route and tells whether it ran past its deadline.
+func (route *matchedRoute) finish() (string, bool) {
+	route.mtx.Lock()
+	defer route.mtx.Unlock()
+	route.done = true
+	if route.inFlight {
+		route.m.InFlight.With("route", route.template).Add(-1)
+	}
+	return route.template, route.ctx != nil && route.ctx.Err() == context.DeadlineExceeded
+}
+
+//NewHTTPMetricsHandler records m around next. Routers set up with MeasureRoutes
+//name the request after their route template. A timeout is a request whose
+//deadline passed, http.TimeoutHandler answers it with 503. Panics are counted
+//and passed on to the recovery handler.
+func NewHTTPMetricsHandler(m *HTTPMetrics, next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		begin := time.Now()
+		route := &matchedRoute{m: m, template: routeUnmatched}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			p := recover()
+			template, timedOut := route.finish()
+			status := sw.status
+			if p != nil {
+				m.Panics.With("route", template).Add(1)
+				status = http.StatusInternalServerError
+			}
+			if timedOut {
+				m.Timeouts.With("route", template).Add(1)
+				status = http.StatusServiceUnavailable
+			}
+			code := strconv.Itoa(status)
+			m.Requests.With("route", template, "code", code).Add(1)
+			m.Duration.With("route", template, "code", code).Observe(time.Since(begin).Seconds())
+			m.ResponseSize.With("route", template, "code", code).Observe(float64(sw.written))
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(sw, req.WithContext(context.WithValue(req.Context(), contextKeyRoute, route)))
+	})
+}
+
+//MeasureRoutes names requests measured by NewHTTPMetricsHandler after the
+//routes of r, and as unmatched when r answers 404 or 405.
+func MeasureRoutes(r *mux.Router) {
+	r.Use(measureRoute)
+	r.NotFoundHandler = unmatchedRoute(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = unmatchedRoute(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+}
+
+//measureRoute runs on matched routes only.
+func measureRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route, ok := r.Context().Value(contextKeyRoute).(*matchedRoute); ok {
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route.match(template, r.Context())
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//unmatchedRoute takes back the name an outer router gave the request.
+func unmatchedRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route, ok := r.Context().Value(contextKeyRoute).(*matchedRoute); ok {
+			route.match(routeUnmatched, r.Context())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
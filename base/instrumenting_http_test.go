@@ -0,0 +1,101 @@
+package base
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+)
+
+//labelHistogram counts the observations per label set.
+type labelHistogram struct{ *labelMetric }
+
+func (h labelHistogram) With(labelValues ...string) metrics.Histogram {
+	return labelHistogram{h.with(labelValues)}
+}
+
+func (h labelHistogram) Observe(float64) { h.values[h.key()]++ }
+
+func TestHTTPMetrics(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	//the routers are nested the way main.go nests them
+	endpoints := newRouter()
+	endpoints.Methods(http.MethodGet).Path("/api/users/{id}").Handler(ok)
+	endpoints.Methods(http.MethodGet).Path("/api/slow").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	endpoints.Methods(http.MethodGet).Path("/api/panic").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	api := mux.NewRouter()
+	MeasureRoutes(api)
+	api.PathPrefix("/api").Handler(endpoints)
+	r := mux.NewRouter()
+	MeasureRoutes(r)
+	r.Methods(http.MethodGet).Path("/stream").Handler(ok)
+	r.PathPrefix("/").Handler(http.TimeoutHandler(api, 50*time.Millisecond, ""))
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		route    string
+		code     string
+		timeouts map[string]float64
+		panics   map[string]float64
+	}{
+		{name: "Inner route", method: http.MethodGet, path: "/api/users/7", route: "/api/users/{id}", code: "200"},
+		{name: "Outer route", method: http.MethodGet, path: "/stream", route: "/stream", code: "200"},
+		{name: "Not found", method: http.MethodGet, path: "/api/doors", route: routeUnmatched, code: "404"},
+		{name: "Method not allowed", method: http.MethodPost, path: "/api/users/7", route: routeUnmatched, code: "405"},
+		{name: "Timeout", method: http.MethodGet, path: "/api/slow", route: "/api/slow", code: "503", timeouts: map[string]float64{"route /api/slow": 1}},
+		{name: "Panic", method: http.MethodGet, path: "/api/panic", route: "/api/panic", code: "500", panics: map[string]float64{"route /api/panic": 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests, duration, size := newLabelMetric(), newLabelMetric(), newLabelMetric()
+			inFlight, timeouts, panics := newLabelMetric(), newLabelMetric(), newLabelMetric()
+			h := NewHTTPMetricsHandler(&HTTPMetrics{
+				Requests:     labelCounter{requests},
+				Duration:     labelHistogram{duration},
+				ResponseSize: labelHistogram{size},
+				InFlight:     labelGauge{inFlight},
+				Timeouts:     labelCounter{timeouts},
+				Panics:       labelCounter{panics},
+			}, r)
+			func() {
+				defer func() {
+					if p := recover(); (p != nil) != (test.panics != nil) {
+						t.Errorf("unexpected panic %v", p)
+					}
+				}()
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, test.path, nil))
+			}()
+			want := map[string]float64{"route " + test.route + " code " + test.code: 1}
+			for name, got := range map[string]map[string]float64{"requests": requests.values, "duration": duration.values, "size": size.values} {
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("%v mismatch (-want +got):\n%s", name, diff)
+				}
+			}
+			if diff := cmp.Diff(test.timeouts, timeouts.values, cmpEmptyMap); diff != "" {
+				t.Errorf("timeouts mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.panics, panics.values, cmpEmptyMap); diff != "" {
+				t.Errorf("panics mismatch (-want +got):\n%s", diff)
+			}
+			//every route a request passed through is back to zero
+			for route, n := range inFlight.values {
+				if n != 0 {
+					t.Errorf("%v: %v in flight", route, n)
+				}
+			}
+		})
+	}
+}
+
+//cmpEmptyMap treats nil and empty maps as equal.
+var cmpEmptyMap = cmp.FilterValues(func(a, b map[string]float64) bool { return len(a) == 0 && len(b) == 0 }, cmp.Ignore())
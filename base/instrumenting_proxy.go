@@ -0,0 +1,122 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+)
+
+//ProxyMetrics are recorded per attempt, below the retries of MakeProxyEndpoints,
+//so a failing instance and the calls a retry rescued both show. Attempts and
+//AttemptDuration are labelled with service, instance, class (2xx to 5xx, error
+//when no response came back) and attempt. Connections counts the connections
+//attempts got by service, instance and state (new or reused), OpenConnections
+//is by service and instance.
+type ProxyMetrics struct {
+	Attempts        metrics.Counter
+	AttemptDuration metrics.Histogram
+	Connections     metrics.Counter
+	OpenConnections metrics.Gauge
+
+	mtx     sync.Mutex
+	clients map[string]*http.Client
+}
+
+//countProxyAttempts gives every call a fresh attempt counter, lb.Retry hands
+//the same context to each attempt.
+func countProxyAttempts(m *ProxyMetrics, next endpoint.Endpoint) endpoint.Endpoint {
+	if m == nil {
+		return next
+	}
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return next(context.WithValue(ctx, contextKeyAttempt, new(int32)), request)
+	}
+}
+
+func instrumentProxyAttempt(m *ProxyMetrics, service, instance string, next endpoint.Endpoint) endpoint.Endpoint {
+	if m == nil {
+		return next
+	}
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		attempt := int32(1)
+		if counter, ok := ctx.Value(contextKeyAttempt).(*int32); ok {
+			attempt = atomic.AddInt32(counter, 1)
+		}
+		status := new(int32)
+		ctx = context.WithValue(ctx, contextKeyProxyStatus, status)
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				state := "new"
+				if info.Reused {
+					state = "reused"
+				}
+				m.Connections.With("service", service, "instance", instance, "state", state).Add(1)
+			},
+		})
+		begin := time.Now()
+		response, err := next(ctx, request)
+		class := "error"
+		if code := atomic.LoadInt32(status); code > 0 {
+			class = strconv.Itoa(int(code)/100) + "xx"
+		}
+		labels := []string{"service", service, "instance", instance, "class", class, "attempt", strconv.Itoa(int(attempt))}
+		m.Attempts.With(labels...).Add(1)
+		m.AttemptDuration.With(labels...).Observe(time.Since(begin).Seconds())
+		return response, err
+	}
+}
+
+//recordProxyStatus hands the upstream status code to instrumentProxyAttempt.
+func recordProxyStatus(ctx context.Context, r *http.Response) context.Context {
+	if status, ok := ctx.Value(contextKeyProxyStatus).(*int32); ok {
+		atomic.StoreInt32(status, int32(r.StatusCode))
+	}
+	return ctx
+}
+
+//client returns the client of an upstream instance. Its endpoints share one
+//connection pool, whose open connections are tracked.
+func (m *ProxyMetrics) client(service, instance string, tlsConfig *tls.Config) *http.Client {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if c, ok := m.clients[service+" "+instance]; ok {
+		return c
+	}
+	transport := newTransport(tlsConfig)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		open := m.OpenConnections.With("service", service, "instance", instance)
+		open.Add(1)
+		return &trackedConn{Conn: conn, closed: func() { open.Add(-1) }}, nil
+	}
+	if m.clients == nil {
+		m.clients = map[string]*http.Client{}
+	}
+	m.clients[service+" "+instance] = &http.Client{Transport: transport}
+	return m.clients[service+" "+instance]
+}
+
+//trackedConn calls closed once, however often it is closed.
+type trackedConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
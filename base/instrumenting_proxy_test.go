@@ -0,0 +1,132 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProxyAttemptClass(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		class  string
+	}{
+		{name: "OK", status: http.StatusOK, class: "2xx"},
+		{name: "Redirect", status: http.StatusMovedPermanently, class: "3xx"},
+		{name: "Not found", status: http.StatusNotFound, class: "4xx"},
+		{name: "Unavailable", status: http.StatusServiceUnavailable, class: "5xx"},
+		{name: "No response", class: "error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts, duration := newLabelMetric(), newLabelMetric()
+			m := &ProxyMetrics{Attempts: labelCounter{attempts}, AttemptDuration: labelHistogram{duration}}
+			e := instrumentProxyAttempt(m, "users", "users:8080", func(ctx context.Context, request interface{}) (interface{}, error) {
+				if test.status == 0 {
+					return nil, errors.New("connection refused")
+				}
+				recordProxyStatus(ctx, &http.Response{StatusCode: test.status})
+				return nil, nil
+			})
+			e(context.Background(), nil)
+			want := map[string]float64{"service users instance users:8080 class " + test.class + " attempt 1": 1}
+			if diff := cmp.Diff(want, attempts.values); diff != "" {
+				t.Errorf("attempts mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(want, duration.values); diff != "" {
+				t.Errorf("duration mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the first call fails, the retry and everything after succeed
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(usermodel.User{Username: r.URL.Query().Get("username")})
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempts, duration := newLabelMetric(), newLabelMetric()
+	connections, open := newLabelMetric(), newLabelMetric()
+	m := &ProxyMetrics{
+		Attempts:        labelCounter{attempts},
+		AttemptDuration: labelHistogram{duration},
+		Connections:     labelCounter{connections},
+		OpenConnections: labelGauge{open},
+	}
+	e := MakeProxyEndpoints(http.MethodGet, ProxyConfig{URL: u, MaxAttempts: 3, MaxTime: 5 * time.Second, Service: "users", Metrics: m},
+		encodegetUsersInfoRequest, decodeGetUsersResponse, log.NewNopLogger())
+
+	//the first call takes two attempts, the second one; attempts count per call
+	for i := 0; i < 2; i++ {
+		response, err := e(context.Background(), "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user := response.(usermodel.User); user.Username != "abc" {
+			t.Fatalf("unexpected user %v", user)
+		}
+	}
+	labels := "service users instance " + u.Host
+	want := map[string]float64{
+		labels + " class 5xx attempt 1": 1,
+		labels + " class 2xx attempt 2": 1,
+		labels + " class 2xx attempt 1": 1,
+	}
+	if diff := cmp.Diff(want, attempts.values); diff != "" {
+		t.Errorf("attempts mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, duration.values); diff != "" {
+		t.Errorf("duration mismatch (-want +got):\n%s", diff)
+	}
+
+	//every attempt got a connection, the first one a new one
+	if n := connections.values[labels+" state new"] + connections.values[labels+" state reused"]; n != 3 {
+		t.Errorf("expected 3 connections, got %v", connections.values)
+	}
+	if connections.values[labels+" state new"] < 1 {
+		t.Errorf("expected a new connection, got %v", connections.values)
+	}
+	if open.values[labels] < 1 {
+		t.Errorf("expected open connections, got %v", open.values)
+	}
+	m.client("users", u.Host, nil).CloseIdleConnections()
+	if open.values[labels] != 0 {
+		t.Errorf("expected no open connections after closing them, got %v", open.values)
+	}
+
+	//a closed upstream gives no response on every attempt
+	upstream.Close()
+	attempts.values = map[string]float64{}
+	if _, err := e(context.Background(), "abc"); err == nil {
+		t.Fatal("expected an error from a closed upstream")
+	}
+	want = map[string]float64{
+		labels + " class error attempt 1": 1,
+		labels + " class error attempt 2": 1,
+		labels + " class error attempt 3": 1,
+	}
+	if diff := cmp.Diff(want, attempts.values); diff != "" {
+		t.Errorf("attempts mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,232 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	MatchDoor = "door"
+	MatchArea = "area"
+)
+
+//InvestigationRequest ...
+type InvestigationRequest struct {
+	Subject string
+	From    time.Time
+	To      time.Time
+	Window  time.Duration
+	Limit   int
+}
+
+//ContactEvidence is a pair of swipes that put the subject and a contact at the
+//same door, or in the same area, within the proximity window.
+type ContactEvidence struct {
+	Match      string      `json:"match"`
+	Area       string      `json:"area,omitempty"`
+	GapSeconds int64       `json:"gapseconds"`
+	Subject    model.Event `json:"subject"`
+	Contact    model.Event `json:"contact"`
+}
+
+//Contact is one ranked co-presence result. Score sums every piece of evidence,
+//a shared door weighs twice a shared area and closer swipes weigh more.
+type Contact struct {
+	Username     string            `json:"username"`
+	Score        float64           `json:"score"`
+	DoorMatches  int               `json:"doormatches"`
+	AreaMatches  int               `json:"areamatches"`
+	FirstContact time.Time         `json:"firstcontact"`
+	LastContact  time.Time         `json:"lastcontact"`
+	Evidence     []ContactEvidence `json:"evidence"`
+}
+
+//InvestigationReport ...
+type InvestigationReport struct {
+	Subject       string    `json:"subject"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	WindowSeconds int64     `json:"windowseconds"`
+	SubjectEvents int       `json:"subjectevents"`
+	Contacts      []Contact `json:"contacts"`
+}
+
+//Investigator correlates the history of every user in the roster with a
+//subject's to find who was near them.
+type Investigator struct {
+	doors         *Doors
+	usersService  UsersService
+	eventsService EventsService
+	roster        *UserRoster
+	logger        log.Logger
+}
+
+//NewInvestigator ...
+func NewInvestigator(doors *Doors, usersService UsersService, eventsService EventsService, roster *UserRoster, logger log.Logger) *Investigator {
+	return &Investigator{
+		doors:         doors,
+		usersService:  usersService,
+		eventsService: eventsService,
+		roster:        roster,
+		logger:        logger,
+	}
+}
+
+//Investigate ranks co-presence with req.Subject between req.From and req.To.
+//The actor from the request context must be an admin.
+func (i *Investigator) Investigate(ctx context.Context, req InvestigationRequest) (InvestigationReport, error) {
+	if err := checkAdmin(ctx, i.usersService); err != nil {
+		return InvestigationReport{}, err
+	}
+	report := InvestigationReport{
+		Subject:       req.Subject,
+		From:          req.From,
+		To:            req.To,
+		WindowSeconds: int64(req.Window / time.Second),
+		Contacts:      []Contact{},
+	}
+	subject, err := fetchEvents(ctx, i.eventsService, model.EventQuery{Username: req.Subject, From: req.From, To: req.To})
+	if err != nil {
+		return report, err
+	}
+	report.SubjectEvents = len(subject)
+	i.logger.Log("method", "Investigate", "actor", actor(ctx), "subject", req.Subject, "from", req.From, "to", req.To)
+	if len(subject) == 0 {
+		return report, nil
+	}
+
+	for _, username := range i.roster.List() {
+		if username == req.Subject {
+			continue
+		}
+		history, err := fetchEvents(ctx, i.eventsService, model.EventQuery{
+			Username: username,
+			From:     req.From.Add(-req.Window),
+			To:       req.To.Add(req.Window),
+		})
+		if err != nil {
+			return report, err
+		}
+		if contact, ok := i.correlate(username, subject, history, req.Window); ok {
+			report.Contacts = append(report.Contacts, contact)
+		}
+	}
+	sort.SliceStable(report.Contacts, func(a, b int) bool {
+		if report.Contacts[a].Score != report.Contacts[b].Score {
+			return report.Contacts[a].Score > report.Contacts[b].Score
+		}
+		return report.Contacts[a].Username < report.Contacts[b].Username
+	})
+	if req.Limit > 0 && len(report.Contacts) > req.Limit {
+		report.Contacts = report.Contacts[:req.Limit]
+	}
+	return report, nil
+}
+
+//correlate matches every swipe in history against the subject's swipes within
+//window. subject must be sorted by time.
+func (i *Investigator) correlate(username string, subject, history []model.Event, window time.Duration) (Contact, bool) {
+	contact := Contact{Username: username, Evidence: []ContactEvidence{}}
+	doors := i.doors.Catalog()
+	for _, event := range history {
+		area := doors[event.Door].Area
+		start := sort.Search(len(subject), func(n int) bool {
+			return !subject[n].Timestamp.Before(event.Timestamp.Add(-window))
+		})
+		for _, s := range subject[start:] {
+			if s.Timestamp.After(event.Timestamp.Add(window)) {
+				break
+			}
+			evidence := ContactEvidence{Subject: s, Contact: event}
+			weight := 1.0
+			switch {
+			case s.Door == event.Door:
+				evidence.Match = MatchDoor
+				weight = 2
+				contact.DoorMatches++
+			case area != "" && doors[s.Door].Area == area:
+				evidence.Match = MatchArea
+				evidence.Area = area
+				contact.AreaMatches++
+			default:
+				continue
+			}
+			gap := event.Timestamp.Sub(s.Timestamp)
+			if gap < 0 {
+				gap = -gap
+			}
+			evidence.GapSeconds = int64(gap / time.Second)
+			if window > 0 {
+				weight *= 1 - float64(gap)/float64(2*window)
+			}
+			contact.Score += weight
+			if contact.FirstContact.IsZero() || event.Timestamp.Before(contact.FirstContact) {
+				contact.FirstContact = event.Timestamp
+			}
+			if event.Timestamp.After(contact.LastContact) {
+				contact.LastContact = event.Timestamp
+			}
+			contact.Evidence = append(contact.Evidence, evidence)
+		}
+	}
+	return contact, len(contact.Evidence) > 0
+}
+
+//MakeInvestigationHandler mounts the investigation route under baseRoute.
+func MakeInvestigationHandler(i *Investigator, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	r.Methods(http.MethodGet).Path(baseRoute + "/investigations").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return i.Investigate(ctx, request.(InvestigationRequest))
+		},
+		decodeInvestigationRequest,
+		encodeResponse,
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	))
+	return r
+}
+
+func decodeInvestigationRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	params := r.URL.Query()
+	req := InvestigationRequest{Subject: params.Get("subject"), Window: 15 * time.Minute}
+	if req.Subject == "" {
+		return nil, errBadRequest
+	}
+	if req.From, err = parseTimeParam(params.Get("from")); err != nil {
+		return nil, errBadRequest
+	}
+	if req.To, err = parseTimeParam(params.Get("to")); err != nil {
+		return nil, errBadRequest
+	}
+	if req.To.IsZero() {
+		req.To = time.Now()
+	}
+	if req.From.IsZero() {
+		req.From = req.To.AddDate(0, 0, -14)
+	}
+	if !req.From.Before(req.To) {
+		return nil, errBadRequest
+	}
+	if window := params.Get("window"); window != "" {
+		seconds, err := strconv.ParseInt(window, 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, errBadRequest
+		}
+		req.Window = time.Duration(seconds) * time.Second
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if req.Limit, err = strconv.Atoi(limit); err != nil || req.Limit < 0 {
+			return nil, errBadRequest
+		}
+	}
+	return req, nil
+}
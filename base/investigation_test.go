@@ -0,0 +1,117 @@
+package base
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestInvestigationAdmin(t *testing.T) {
+	users := newFakeUsersService(
+		usermodel.User{Username: "admin", IsAdmin: true},
+		usermodel.User{Username: "abc"},
+	)
+	roster, _ := LoadUserRoster("")
+	i := NewInvestigator(testDoors(), users, newFakeEventsService(), roster, log.NewNopLogger())
+	trust, err := NewActorTrust([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewActorHandler(trust, MakeInvestigationHandler(i, log.NewNopLogger(), "/v2"))
+
+	tests := []struct {
+		name   string
+		remote string
+		actor  string
+		code   int
+	}{
+		{name: "Admin behind trusted proxy", remote: "10.0.0.1:4000", actor: "admin", code: http.StatusOK},
+		{name: "User behind trusted proxy", remote: "10.0.0.1:4000", actor: "abc", code: http.StatusForbidden},
+		{name: "No actor", remote: "10.0.0.1:4000", code: http.StatusForbidden},
+		{name: "Admin header from untrusted peer", remote: "203.0.113.9:4000", actor: "admin", code: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v2/investigations?subject=abc", nil)
+			r.RemoteAddr = test.remote
+			if test.actor != "" {
+				r.Header.Set("X-Actor", test.actor)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("expected status %v, got %v: %s", test.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestInvestigationContacts(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	at := func(minutes int) int64 { return start.Add(time.Duration(minutes) * time.Minute).Unix() }
+	events := newFakeEventsService()
+	events.add("abc", "HQ-In", at(0))
+	events.add("door", "HQ-In", at(5))
+	events.add("area", "HQ-Lab", at(10))
+	events.add("both", "HQ-In", at(15))
+	events.add("both", "HQ-Lab", at(-15))
+	events.add("far", "HQ-In", at(16))
+	events.add("other", "Lab-In", at(1))
+	roster, _ := LoadUserRoster("")
+	for _, username := range []string{"abc", "door", "area", "both", "far", "other"} {
+		roster.Add(username)
+	}
+	users := newFakeUsersService(usermodel.User{Username: "admin", IsAdmin: true})
+	i := NewInvestigator(testDoors(), users, events, roster, log.NewNopLogger())
+	ctx := withActor(context.Background(), "admin")
+
+	tests := []struct {
+		name     string
+		req      InvestigationRequest
+		contacts []Contact
+	}{
+		{
+			name: "Ranked by score",
+			req:  InvestigationRequest{Subject: "abc", From: start.Add(-time.Hour), To: start.Add(time.Hour), Window: 15 * time.Minute},
+			contacts: []Contact{
+				{Username: "door", Score: 2 * (1 - 5.0/30), DoorMatches: 1},
+				{Username: "both", Score: 2*(1-15.0/30) + 1*(1-15.0/30), DoorMatches: 1, AreaMatches: 1},
+				{Username: "area", Score: 1 - 10.0/30, AreaMatches: 1},
+			},
+		},
+		{
+			name: "Limit",
+			req:  InvestigationRequest{Subject: "abc", From: start.Add(-time.Hour), To: start.Add(time.Hour), Window: 15 * time.Minute, Limit: 1},
+			contacts: []Contact{
+				{Username: "door", Score: 2 * (1 - 5.0/30), DoorMatches: 1},
+			},
+		},
+		{
+			name:     "Subject outside the range",
+			req:      InvestigationRequest{Subject: "abc", From: start.Add(time.Minute), To: start.Add(time.Hour), Window: 15 * time.Minute},
+			contacts: []Contact{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := i.Investigate(ctx, test.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := cmp.Options{
+				cmpopts.IgnoreFields(Contact{}, "FirstContact", "LastContact", "Evidence"),
+				cmpopts.EquateApprox(0, 1e-9),
+			}
+			if diff := cmp.Diff(test.contacts, report.Contacts, opts); diff != "" {
+				t.Errorf("contacts mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
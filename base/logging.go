@@ -4,10 +4,15 @@ import (
 	"accessdoor/model"
 	"context"
 	eventmodel "events/model"
+	"fmt"
+	"net"
+	stdhttp "net/http"
+	"strings"
 	"time"
 	usermodel "users/model"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/handlers"
 )
@@ -50,11 +55,101 @@ func (pl panicLogger) Println(msgs ...interface{}) {
 
 func (mw loggingMiddleware) Check(ctx context.Context) (res bool, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "Check", "took", time.Since(begin), "err", err)
+		//health checks are frequent, a passing one is only worth a debug line
+		logger := level.Debug(requestLogger(ctx, mw.logger))
+		if err != nil {
+			logger = level.Error(requestLogger(ctx, mw.logger))
+		}
+		logger.Log("method", "Check", "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.Check(ctx)
 }
 
+//requestLogger binds the correlation fields of the request in ctx: request id,
+//trace id and the address of the calling client.
+func requestLogger(ctx context.Context, logger log.Logger) log.Logger {
+	return log.With(logger, "requestid", cid(ctx), "traceid", SpanFromContext(ctx).TraceID(), "sourceip", sourceIP(ctx))
+}
+
+//levelFor logs failures at error, a denied swipe at warn and everything else at
+//info. A denial is a decision, not something for the operator to fix.
+func levelFor(logger log.Logger, err error) log.Logger {
+	switch {
+	case IsAccessDenied(err):
+		return level.Warn(logger)
+	case err != nil:
+		return level.Error(logger)
+	}
+	return level.Info(logger)
+}
+
+//NewRequestIDHandler makes sure every request has an X-Request-Id, generating
+//one when the caller sent none, and returns it in the response headers.
+func NewRequestIDHandler(next stdhttp.Handler) stdhttp.Handler {
+	return stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = newID()
+			r.Header.Set("X-Request-Id", id)
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+//LogLevelOption maps debug, info, warn or error to the filter allowing that
+//level and above.
+func LogLevelOption(name string) (level.Option, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return level.AllowDebug(), nil
+	case "info", "":
+		return level.AllowInfo(), nil
+	case "warn":
+		return level.AllowWarn(), nil
+	case "error":
+		return level.AllowError(), nil
+	}
+	return nil, fmt.Errorf("unknown log level %q", name)
+}
+
+//Redacted replaces the values of sensitive keys.
+const Redacted = "[REDACTED]"
+
+//NewRedactingLogger replaces the value of every key in keys, matched case
+//insensitively, before it reaches next. It has to sit below log.With so the
+//bound values are redacted too.
+func NewRedactingLogger(next log.Logger, keys []string) log.Logger {
+	redact := map[string]bool{}
+	for _, key := range keys {
+		redact[strings.ToLower(key)] = true
+	}
+	return redactingLogger{next: next, redact: redact}
+}
+
+type redactingLogger struct {
+	next   log.Logger
+	redact map[string]bool
+}
+
+func (l redactingLogger) Log(keyvals ...interface{}) error {
+	var redacted []interface{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok || !l.redact[strings.ToLower(key)] {
+			continue
+		}
+		if redacted == nil {
+			redacted = append([]interface{}{}, keyvals...)
+		}
+		redacted[i+1] = Redacted
+	}
+	if redacted == nil {
+		return l.next.Log(keyvals...)
+	}
+	return l.next.Log(redacted...)
+}
+
 func cid(ctx context.Context) string {
 	cid, _ := ctx.Value(http.ContextKeyRequestXRequestID).(string)
 	return cid
@@ -63,23 +158,53 @@ func xff(ctx context.Context) string {
 	xff, _ := ctx.Value(http.ContextKeyRequestXForwardedFor).(string)
 	return xff
 }
-func (mw loggingMiddleware) GetUser(ctx context.Context, username string) (res model.UserResponse, err error) {
+
+type contextKey int
+
+const (
+	contextKeyActor contextKey = iota
+	contextKeySpan
+	contextKeyRoute
+	contextKeyAttempt
+	contextKeyProxyStatus
+)
+
+//sourceIP is the address NewActorHandler resolved, or the peer address
+//without it. X-Forwarded-For only counts from a trusted proxy.
+func sourceIP(ctx context.Context) string {
+	if id, ok := ctx.Value(contextKeyActor).(*identity); ok {
+		return id.sourceIP
+	}
+	remote, _ := ctx.Value(http.ContextKeyRequestRemoteAddr).(string)
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+func (mw loggingMiddleware) GetUser(ctx context.Context, query model.EventQuery) (res model.UserEvents, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "GetUser", "took", time.Since(begin), "err", err)
+		levelFor(requestLogger(ctx, mw.logger), err).Log("method", "GetUser", "username", query.Username, "door", query.Door,
+			"events", len(res.Events), "took", time.Since(begin), "err", err)
 	}(time.Now())
-	return mw.next.GetUser(ctx, username)
+	return mw.next.GetUser(ctx, query)
 }
 
 func (mw loggingMiddleware) UpdateUserAccess(ctx context.Context, req usermodel.UpdateAccessRequest) (err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "UpdateUserAccess", "took", time.Since(begin), "err", err)
+		securityLogger(levelFor(requestLogger(ctx, mw.logger), err)).Log("method", "UpdateUserAccess", "actor", actor(ctx), "username", req.Username,
+			"doors", len(req.Doors), "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.UpdateUserAccess(ctx, req)
 }
 
-func (mw loggingMiddleware) DoorAuthenticate(ctx context.Context, req usermodel.DoorAuthenticate) (hasaccess bool, err error) {
+func (mw loggingMiddleware) DoorAuthenticate(ctx context.Context, req model.AuthenticateRequest) (event model.Event, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "DoorAuthenticate", "took", time.Since(begin), "err", err)
+		logger := levelFor(requestLogger(ctx, mw.logger), err)
+		if event.Outcome == model.OutcomeDenied {
+			logger = securityLogger(logger)
+		}
+		logger.Log("method", "DoorAuthenticate", "username", req.Username, "door", req.AccessDoor,
+			"decision", event.Outcome, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.DoorAuthenticate(ctx, req)
 }
@@ -100,20 +225,21 @@ type userLoggingMiddleware struct {
 
 func (mw userLoggingMiddleware) GetUser(ctx context.Context, username string) (resp usermodel.User, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "GetUserProxy", "took", time.Since(begin), "err", err)
+		levelFor(requestLogger(ctx, mw.logger), err).Log("method", "GetUserProxy", "username", username, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.GetUser(ctx, username)
 }
 
 func (mw userLoggingMiddleware) UpdateUserAccess(ctx context.Context, req usermodel.UpdateAccessRequest) (resp string, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "UpdateUserAccessProxy", "took", time.Since(begin), "err", err)
+		levelFor(requestLogger(ctx, mw.logger), err).Log("method", "UpdateUserAccessProxy", "username", req.Username, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.UpdateUserAccess(ctx, req)
 }
 func (mw userLoggingMiddleware) DoorAuthenticate(ctx context.Context, req usermodel.DoorAuthenticate) (resp string, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "DoorAuthenticateProxy", "took", time.Since(begin), "err", err)
+		levelFor(requestLogger(ctx, mw.logger), err).Log("method", "DoorAuthenticateProxy", "username", req.Username, "door", req.AccessDoor,
+			"decision", resp, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.DoorAuthenticate(ctx, req)
 }
@@ -132,16 +258,16 @@ type eventsLoggingMiddleware struct {
 	logger log.Logger
 }
 
-func (mw eventsLoggingMiddleware) GetEvents(ctx context.Context, username string) (resp eventmodel.Events, err error) {
+func (mw eventsLoggingMiddleware) GetEvents(ctx context.Context, query model.EventQuery) (resp eventmodel.Events, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "GetEvents", "took", time.Since(begin), "err", err)
+		levelFor(requestLogger(ctx, mw.logger), err).Log("method", "GetEvents", "username", query.Username, "door", query.Door, "took", time.Since(begin), "err", err)
 	}(time.Now())
-	return mw.next.GetEvents(ctx, username)
+	return mw.next.GetEvents(ctx, query)
 }
 
 func (mw eventsLoggingMiddleware) UpdateEvents(ctx context.Context, request eventmodel.UpdateEventRequest) (err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "UpdateEvents", "took", time.Since(begin), "err", err)
+		levelFor(requestLogger(ctx, mw.logger), err).Log("method", "UpdateEvents", "username", request.Username, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.UpdateEvents(ctx, request)
 }
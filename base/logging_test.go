@@ -0,0 +1,115 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/go-cmp/cmp"
+)
+
+//recordingLogger keeps the keyvals of every Log call as strings.
+type recordingLogger struct {
+	lines [][]string
+}
+
+func (l *recordingLogger) Log(keyvals ...interface{}) error {
+	line := make([]string, 0, len(keyvals))
+	for _, kv := range keyvals {
+		line = append(line, fmt.Sprint(kv))
+	}
+	l.lines = append(l.lines, line)
+	return nil
+}
+
+func TestRedactingLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		keyvals []interface{}
+		want    []string
+	}{
+		{
+			name:    "Nothing configured",
+			keyvals: []interface{}{"username", "abc", "door", "Door1"},
+			want:    []string{"username", "abc", "door", "Door1"},
+		},
+		{
+			name:    "Configured keys",
+			keys:    []string{"username", "sourceip"},
+			keyvals: []interface{}{"method", "GetUser", "username", "abc", "sourceip", "10.0.0.1", "door", "Door1"},
+			want:    []string{"method", "GetUser", "username", Redacted, "sourceip", Redacted, "door", "Door1"},
+		},
+		{
+			name:    "Keys match in any case",
+			keys:    []string{"SourceIP"},
+			keyvals: []interface{}{"sourceIP", "10.0.0.1", "SOURCEIP", "10.0.0.2", "sourceip", "10.0.0.3"},
+			want:    []string{"sourceIP", Redacted, "SOURCEIP", Redacted, "sourceip", Redacted},
+		},
+		{
+			name:    "Values are not keys",
+			keys:    []string{"username"},
+			keyvals: []interface{}{"msg", "username", "actor", "username"},
+			want:    []string{"msg", "username", "actor", "username"},
+		},
+		{
+			name:    "Non string keys and a dangling key",
+			keys:    []string{"username"},
+			keyvals: []interface{}{1, "abc", "username", "abc", "username"},
+			want:    []string{"1", "abc", "username", Redacted, "username"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := &recordingLogger{}
+			keyvals := append([]interface{}{}, test.keyvals...)
+			NewRedactingLogger(next, test.keys).Log(keyvals...)
+			if diff := cmp.Diff([][]string{test.want}, next.lines); diff != "" {
+				t.Errorf("keyvals mismatch (-want +got):\n%s", diff)
+			}
+			//the caller's keyvals are left alone
+			if diff := cmp.Diff(test.keyvals, keyvals); diff != "" {
+				t.Errorf("caller keyvals changed (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLevelFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		filter level.Option
+		want   [][]string
+	}{
+		{name: "Success is info", filter: level.AllowInfo(), want: [][]string{{"level", "info", "method", "GetUser"}}},
+		{name: "Failure is error", err: errors.New("users-go unavailable"), filter: level.AllowInfo(), want: [][]string{{"level", "error", "method", "GetUser"}}},
+		{name: "Success filtered at error", filter: level.AllowError(), want: nil},
+		{name: "Failure kept at error", err: errors.New("users-go unavailable"), filter: level.AllowError(), want: [][]string{{"level", "error", "method", "GetUser"}}},
+		{name: "Denial is warn", err: accessDeniedError{door: "HQ-Lab"}, filter: level.AllowInfo(), want: [][]string{{"level", "warn", "method", "GetUser"}}},
+		{name: "Denial filtered at error", err: accessDeniedError{door: "HQ-Lab"}, filter: level.AllowError(), want: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := &recordingLogger{}
+			var logger log.Logger = level.NewFilter(next, test.filter)
+			levelFor(logger, test.err).Log("method", "GetUser")
+			if diff := cmp.Diff(test.want, next.lines); diff != "" {
+				t.Errorf("lines mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLogLevelOption(t *testing.T) {
+	for _, name := range []string{"debug", "info", "", "WARN", "error"} {
+		if _, err := LogLevelOption(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	if _, err := LogLevelOption("verbose"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
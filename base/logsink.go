@@ -0,0 +1,141 @@
+package base
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+//LogCategoryKey marks log lines that sinks route on their own.
+//LogCategorySecurity holds denials and access changes.
+const (
+	LogCategoryKey      = "category"
+	LogCategorySecurity = "security"
+)
+
+//securityLogger puts every line of logger in the security category.
+func securityLogger(logger log.Logger) log.Logger {
+	return log.With(logger, LogCategoryKey, LogCategorySecurity)
+}
+
+//NewMultiLogger writes every line to each of loggers. A failing sink does not
+//stop the others, the first error is returned.
+func NewMultiLogger(loggers ...log.Logger) log.Logger {
+	return multiLogger(loggers)
+}
+
+type multiLogger []log.Logger
+
+func (l multiLogger) Log(keyvals ...interface{}) error {
+	var first error
+	for _, logger := range l {
+		if err := logger.Log(keyvals...); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+//SyslogWriter sends one syslog message with severity. sd is its structured
+//data, - for none.
+type SyslogWriter interface {
+	WriteSyslog(severity syslog.Priority, sd, msg string) error
+}
+
+//NewSyslogLogger writes lines to w with the severity of their level, info when
+//they have none. The structured data is one RFC 5424 element named sdID
+//holding every key, the message is the value of msg when there is one.
+//Security lines go to security instead when it is not nil, so they can use
+//their own facility.
+func NewSyslogLogger(w, security SyslogWriter, sdID string) log.Logger {
+	return syslogLogger{w: w, security: security, sdID: sdID}
+}
+
+type syslogLogger struct {
+	w        SyslogWriter
+	security SyslogWriter
+	sdID     string
+}
+
+func (l syslogLogger) Log(keyvals ...interface{}) error {
+	var sd strings.Builder
+	var severity, msg string
+	w := l.w
+	sd.WriteString("[" + l.sdID)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := sdName(fmt.Sprint(keyvals[i]))
+		var value interface{} = log.ErrMissingValue
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		val := fmt.Sprint(value)
+		switch key {
+		case fmt.Sprint(level.Key()):
+			severity = val
+		case "msg":
+			msg = val
+			continue
+		case LogCategoryKey:
+			if val == LogCategorySecurity && l.security != nil {
+				w = l.security
+			}
+		}
+		sd.WriteString(" " + key + `="` + sdEscaper.Replace(val) + `"`)
+	}
+	sd.WriteString("]")
+	return w.WriteSyslog(syslogSeverity(severity), sd.String(), msg)
+}
+
+//syslogSeverity maps a go-kit level value to its syslog severity.
+func syslogSeverity(lvl string) syslog.Priority {
+	switch lvl {
+	case level.ErrorValue().String():
+		return syslog.LOG_ERR
+	case level.WarnValue().String():
+		return syslog.LOG_WARNING
+	case level.DebugValue().String():
+		return syslog.LOG_DEBUG
+	}
+	return syslog.LOG_INFO
+}
+
+//sdEscaper escapes the characters RFC 5424 reserves in PARAM-VALUE.
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+//sdName keeps the printable ASCII allowed in an RFC 5424 PARAM-NAME, at most
+//32 characters.
+func sdName(key string) string {
+	name := make([]byte, 0, len(key))
+	for i := 0; i < len(key) && len(name) < 32; i++ {
+		c := key[i]
+		if c > ' ' && c < 127 && c != '=' && c != ']' && c != '"' {
+			name = append(name, c)
+		}
+	}
+	if len(name) == 0 {
+		return "_"
+	}
+	return string(name)
+}
+
+//SyslogFacility maps a facility name such as auth, authpriv or local0 to its
+//priority.
+func SyslogFacility(name string) (syslog.Priority, error) {
+	facilities := map[string]syslog.Priority{
+		"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+		"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+		"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+		"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+		"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+		"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+		"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+	}
+	facility, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return facility, nil
+}
@@ -0,0 +1,236 @@
+package base
+
+import (
+	"bufio"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/go-cmp/cmp"
+)
+
+type syslogMessage struct {
+	Severity syslog.Priority
+	SD       string
+	Msg      string
+}
+
+//recordingSyslog keeps every message it is asked to send.
+type recordingSyslog struct {
+	messages []syslogMessage
+}
+
+func (r *recordingSyslog) WriteSyslog(severity syslog.Priority, sd, msg string) error {
+	r.messages = append(r.messages, syslogMessage{Severity: severity, SD: sd, Msg: msg})
+	return nil
+}
+
+func TestSyslogLogger(t *testing.T) {
+	tests := []struct {
+		name     string
+		log      func(log.Logger)
+		security bool
+		main     []syslogMessage
+		secure   []syslogMessage
+	}{
+		{
+			name: "Error",
+			log:  func(l log.Logger) { level.Error(l).Log("method", "GetUser", "err", "timeout") },
+			main: []syslogMessage{{Severity: syslog.LOG_ERR, SD: `[test@1 level="error" method="GetUser" err="timeout"]`}},
+		},
+		{
+			name: "Warning",
+			log:  func(l log.Logger) { level.Warn(l).Log("method", "GetUser") },
+			main: []syslogMessage{{Severity: syslog.LOG_WARNING, SD: `[test@1 level="warn" method="GetUser"]`}},
+		},
+		{
+			name: "Info",
+			log:  func(l log.Logger) { level.Info(l).Log("method", "GetUser") },
+			main: []syslogMessage{{Severity: syslog.LOG_INFO, SD: `[test@1 level="info" method="GetUser"]`}},
+		},
+		{
+			name: "Debug",
+			log:  func(l log.Logger) { level.Debug(l).Log("method", "Check") },
+			main: []syslogMessage{{Severity: syslog.LOG_DEBUG, SD: `[test@1 level="debug" method="Check"]`}},
+		},
+		{
+			name: "No level is info",
+			log:  func(l log.Logger) { l.Log("transport", "HTTP") },
+			main: []syslogMessage{{Severity: syslog.LOG_INFO, SD: `[test@1 transport="HTTP"]`}},
+		},
+		{
+			name: "Msg is the message",
+			log:  func(l log.Logger) { l.Log("msg", "starting", "port", 8080) },
+			main: []syslogMessage{{Severity: syslog.LOG_INFO, SD: `[test@1 port="8080"]`, Msg: "starting"}},
+		},
+		{
+			name: "Reserved characters are escaped",
+			log:  func(l log.Logger) { l.Log("door", `lab "B"`, "path", `C:\doors`, "list", "[a]") },
+			main: []syslogMessage{{Severity: syslog.LOG_INFO, SD: `[test@1 door="lab \"B\"" path="C:\\doors" list="[a\]"]`}},
+		},
+		{
+			name: "Missing value",
+			log:  func(l log.Logger) { l.Log("method") },
+			main: []syslogMessage{{Severity: syslog.LOG_INFO, SD: `[test@1 method="` + log.ErrMissingValue.Error() + `"]`}},
+		},
+		{
+			name:     "Security lines use their own writer",
+			log:      func(l log.Logger) { level.Info(securityLogger(l)).Log("method", "MusterStart") },
+			security: true,
+			secure:   []syslogMessage{{Severity: syslog.LOG_INFO, SD: `[test@1 level="info" category="security" method="MusterStart"]`}},
+		},
+		{
+			name: "Security lines stay without a security writer",
+			log:  func(l log.Logger) { securityLogger(l).Log("method", "MusterStart") },
+			main: []syslogMessage{{Severity: syslog.LOG_INFO, SD: `[test@1 category="security" method="MusterStart"]`}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			main, secure := &recordingSyslog{}, &recordingSyslog{}
+			var security SyslogWriter
+			if test.security {
+				security = secure
+			}
+			test.log(NewSyslogLogger(main, security, "test@1"))
+			if diff := cmp.Diff(test.main, main.messages); diff != "" {
+				t.Errorf("messages mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.secure, secure.messages); diff != "" {
+				t.Errorf("security messages mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSDName(t *testing.T) {
+	tests := []struct {
+		key  string
+		name string
+	}{
+		{key: "requestid", name: "requestid"},
+		{key: "source ip", name: "sourceip"},
+		{key: `a="b"]`, name: "ab"},
+		{key: "tür", name: "tr"},
+		{key: strings.Repeat("k", 40), name: strings.Repeat("k", 32)},
+		{key: " = ", name: "_"},
+		{key: "", name: "_"},
+	}
+	for _, test := range tests {
+		if got := sdName(test.key); got != test.name {
+			t.Errorf("sdName(%q) = %q, want %q", test.key, got, test.name)
+		}
+	}
+}
+
+func TestSyslogAlertSeverity(t *testing.T) {
+	tests := []struct {
+		severity string
+		want     syslog.Priority
+	}{
+		{severity: AlertCritical, want: syslog.LOG_CRIT},
+		{severity: AlertWarning, want: syslog.LOG_WARNING},
+		{severity: AlertInfo, want: syslog.LOG_INFO},
+	}
+	for _, test := range tests {
+		w := &recordingSyslog{}
+		NewSyslogAlertSink(w).Alert(Alert{Rule: "r", Severity: test.severity})
+		if len(w.messages) != 1 || w.messages[0].Severity != test.want || w.messages[0].SD != "-" {
+			t.Errorf("%v: unexpected messages %v", test.severity, w.messages)
+		}
+	}
+}
+
+func TestSyslogConn(t *testing.T) {
+	hostname, _ := os.Hostname()
+	at := time.Date(2020, time.September, 13, 9, 0, 0, 123456789, time.UTC)
+	header := "2020-09-13T09:00:00.123456Z " + headerField(hostname, 255) + " dooraccess " + strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name     string
+		severity syslog.Priority
+		sd       string
+		msg      string
+		frame    string
+	}{
+		{name: "Structured data and message", severity: syslog.LOG_ERR, sd: `[test@1 a="b"]`, msg: "failed", frame: "<83>1 " + header + ` - [test@1 a="b"] failed`},
+		{name: "Structured data only", severity: syslog.LOG_INFO, sd: `[test@1 a="b"]`, frame: "<86>1 " + header + ` - [test@1 a="b"]`},
+		{name: "Message only", severity: syslog.LOG_CRIT, sd: "-", msg: "alert", frame: "<82>1 " + header + " - - alert"},
+		{name: "Empty structured data", severity: syslog.LOG_DEBUG, frame: "<87>1 " + header + " - -"},
+	}
+
+	t.Run("UDP", func(t *testing.T) {
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		c, err := DialSyslog("udp", server.LocalAddr().String(), syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "door access")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.now = func() time.Time { return at }
+		buf := make([]byte, 2048)
+		for _, test := range tests {
+			if err := c.WriteSyslog(test.severity, test.sd, test.msg); err != nil {
+				t.Fatal(err)
+			}
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != test.frame {
+				t.Errorf("%v: frame\n%q, want\n%q", test.name, got, test.frame)
+			}
+		}
+	})
+
+	t.Run("TCP", func(t *testing.T) {
+		server, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		c, err := DialSyslog("tcp", server.Addr().String(), syslog.LOG_AUTHPRIV, "door access")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.now = func() time.Time { return at }
+		conn, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for _, test := range tests {
+			if err := c.WriteSyslog(test.severity, test.sd, test.msg); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			length, err := r.ReadString(' ')
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+			if err != nil {
+				t.Fatal(err)
+			}
+			frame := make([]byte, n)
+			if _, err := io.ReadFull(r, frame); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(frame); got != test.frame {
+				t.Errorf("%v: frame\n%q, want\n%q", test.name, got, test.frame)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+//Reasons label access decisions. A decision that could not be made because
+//users-go failed is counted with outcome error.
+const (
+	ReasonAccess        = "access"
+	ReasonNoAccess      = "no_access"
+	ReasonUpstreamError = "upstream_error"
+
+	outcomeError = "error"
+	//doorOther stands for doors outside the catalog so clients cannot grow the
+	//label set.
+	doorOther = "other"
+	zoneNone  = "none"
+)
+
+//decisionInstrumentingService counts DoorAuthenticate outcomes by door, zone
+//and reason, and keeps the time of the last granted access per door.
+type decisionInstrumentingService struct {
+	doors      *Doors
+	decisions  metrics.Counter
+	lastAccess metrics.Gauge
+	Service
+}
+
+//NewDecisionInstrumentingService records decisions with the labels door, zone,
+//outcome and reason, and lastAccess with the label door in unix seconds.
+func NewDecisionInstrumentingService(doors *Doors, decisions metrics.Counter, lastAccess metrics.Gauge) Middleware {
+	return func(next Service) Service {
+		return decisionInstrumentingService{
+			doors:      doors,
+			decisions:  decisions,
+			lastAccess: lastAccess,
+			Service:    next,
+		}
+	}
+}
+
+func (s decisionInstrumentingService) DoorAuthenticate(ctx context.Context, req model.AuthenticateRequest) (event model.Event, err error) {
+	defer func() {
+		outcome, reason := event.Outcome, ReasonAccess
+		switch {
+		case IsAccessDenied(err):
+			reason = ReasonNoAccess
+		case err != nil:
+			outcome, reason = outcomeError, ReasonUpstreamError
+		}
+		door := req.AccessDoor
+		doors := s.doors.Catalog()
+		info, known := doors[door]
+		if !known {
+			door = doorOther
+		}
+		zone := info.Area
+		if zone == "" {
+			zone = zoneNone
+		}
+		s.decisions.With("door", door, "zone", zone, "outcome", outcome, "reason", reason).Add(1)
+		if outcome == model.OutcomeGranted {
+			s.lastAccess.With("door", door).Set(float64(event.Timestamp.Unix()))
+		}
+	}()
+	return s.Service.DoorAuthenticate(ctx, req)
+}
+
+//AccessChangeMetrics counts access changes by the role of their actor.
+type AccessChangeMetrics struct {
+	changes metrics.Counter
+}
+
+//NewAccessChangeMetrics records changes with the label role.
+func NewAccessChangeMetrics(changes metrics.Counter) *AccessChangeMetrics {
+	return &AccessChangeMetrics{changes: changes}
+}
+
+//OnAccessChange implements AccessChangeListener.
+func (m *AccessChangeMetrics) OnAccessChange(_ context.Context, change model.AccessChange) {
+	role := change.ActorRole
+	if role == "" {
+		role = model.RoleUnknown
+	}
+	m.changes.With("role", role).Add(1)
+}
+
+//ParseBuckets reads comma separated histogram bucket bounds in seconds. They
+//must be positive and are sorted.
+func ParseBuckets(val string) ([]float64, error) {
+	buckets := []float64{}
+	for _, field := range splitList(val) {
+		bound, err := strconv.ParseFloat(field, 64)
+		if err != nil || bound <= 0 {
+			return nil, errors.New("invalid histogram bucket " + field)
+		}
+		buckets = append(buckets, bound)
+	}
+	if len(buckets) == 0 {
+		return nil, errors.New("no histogram buckets")
+	}
+	sort.Float64s(buckets)
+	return buckets, nil
+}
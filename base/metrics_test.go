@@ -0,0 +1,219 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/google/go-cmp/cmp"
+)
+
+//labelMetric is a counter and gauge keeping its value per label set.
+type labelMetric struct {
+	values map[string]float64
+	labels []string
+}
+
+func newLabelMetric() *labelMetric {
+	return &labelMetric{values: map[string]float64{}}
+}
+
+func (m *labelMetric) with(labelValues []string) *labelMetric {
+	return &labelMetric{values: m.values, labels: append(append([]string{}, m.labels...), labelValues...)}
+}
+
+func (m *labelMetric) key() string {
+	return strings.Join(m.labels, " ")
+}
+
+type labelCounter struct{ *labelMetric }
+
+func (c labelCounter) With(labelValues ...string) metrics.Counter {
+	return labelCounter{c.with(labelValues)}
+}
+
+func (c labelCounter) Add(delta float64) { c.values[c.key()] += delta }
+
+type labelGauge struct{ *labelMetric }
+
+func (g labelGauge) With(labelValues ...string) metrics.Gauge {
+	return labelGauge{g.with(labelValues)}
+}
+
+func (g labelGauge) Set(value float64) { g.values[g.key()] = value }
+
+func (g labelGauge) Add(delta float64) { g.values[g.key()] += delta }
+
+//failingDoorAuthenticate fails every authentication like an unreachable users-go.
+type failingDoorAuthenticate struct {
+	UsersService
+}
+
+func (failingDoorAuthenticate) DoorAuthenticate(context.Context, usermodel.DoorAuthenticate) (string, error) {
+	return "", errors.New("users-go unavailable")
+}
+
+func TestDecisionLabels(t *testing.T) {
+	users := newFakeUsersService(usermodel.User{Username: "abc", DoorAccess: usermodel.Doors{"HQ-In": true, "Yard": true, "Nowhere": true}})
+	tests := []struct {
+		name    string
+		doors   *Doors
+		users   UsersService
+		door    string
+		counted map[string]float64
+		last    []string
+	}{
+		{
+			name:    "Granted",
+			doors:   testDoors(),
+			users:   users,
+			door:    "HQ-In",
+			counted: map[string]float64{"door HQ-In zone HQ outcome granted reason access": 1},
+			last:    []string{"door HQ-In"},
+		},
+		{
+			name:    "Denied",
+			doors:   testDoors(),
+			users:   users,
+			door:    "HQ-Lab",
+			counted: map[string]float64{"door HQ-Lab zone HQ outcome denied reason no_access": 1},
+		},
+		{
+			name:    "Door without an area",
+			doors:   testDoors(),
+			users:   users,
+			door:    "Yard",
+			counted: map[string]float64{"door Yard zone none outcome granted reason access": 1},
+			last:    []string{"door Yard"},
+		},
+		{
+			name:    "Unknown door",
+			doors:   testDoors(),
+			users:   users,
+			door:    "Nowhere",
+			counted: map[string]float64{"door other zone none outcome granted reason access": 1},
+			last:    []string{"door other"},
+		},
+		{
+			name:    "Unknown door with an empty catalog",
+			doors:   NewDoors(DoorCatalog{}),
+			users:   users,
+			door:    "Nowhere",
+			counted: map[string]float64{"door other zone none outcome granted reason access": 1},
+			last:    []string{"door other"},
+		},
+		{
+			name:    "Upstream error",
+			doors:   testDoors(),
+			users:   failingDoorAuthenticate{users},
+			door:    "HQ-In",
+			counted: map[string]float64{"door HQ-In zone HQ outcome error reason upstream_error": 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decisions, lastAccess := newLabelMetric(), newLabelMetric()
+			s := NewService(log.NewNopLogger(), test.users, newFakeEventsService())
+			s = NewDecisionInstrumentingService(test.doors, labelCounter{decisions}, labelGauge{lastAccess})(s)
+			s.DoorAuthenticate(context.Background(), model.AuthenticateRequest{Username: "abc", AccessDoor: test.door})
+			if diff := cmp.Diff(test.counted, decisions.values); diff != "" {
+				t.Errorf("decisions mismatch (-want +got):\n%s", diff)
+			}
+			last := []string{}
+			for labels := range lastAccess.values {
+				last = append(last, labels)
+			}
+			if diff := cmp.Diff(test.last, last, cmpEmpty); diff != "" {
+				t.Errorf("last access mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+//cmpEmpty treats nil and empty slices as equal.
+var cmpEmpty = cmp.FilterValues(func(a, b []string) bool { return len(a) == 0 && len(b) == 0 }, cmp.Ignore())
+
+func TestAccessChangeRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     func(context.Context) context.Context
+		checked bool
+		role    string
+	}{
+		{name: "No actor", ctx: func(ctx context.Context) context.Context { return ctx }, role: model.RoleUnknown},
+		{name: "Admin changing their own access", ctx: func(ctx context.Context) context.Context { return withActor(ctx, "abc") }, role: model.RoleAdmin},
+		{name: "Unchecked actor", ctx: func(ctx context.Context) context.Context { return withActor(ctx, "ops") }, role: model.RoleUnknown},
+		{name: "Checked admin", ctx: func(ctx context.Context) context.Context { return withActor(ctx, "root") }, checked: true, role: model.RoleAdmin},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users := newFakeUsersService(
+				usermodel.User{Username: "abc", IsAdmin: true, DoorAccess: usermodel.Doors{"HQ-In": true}},
+				usermodel.User{Username: "ops"},
+				usermodel.User{Username: "root", IsAdmin: true},
+			)
+			changes := &recordingChanges{}
+			roles := newLabelMetric()
+			s := NewService(log.NewNopLogger(), users, newFakeEventsService(),
+				WithAccessChangeListener(changes), WithAccessChangeListener(NewAccessChangeMetrics(labelCounter{roles})))
+			ctx := test.ctx(context.Background())
+			if test.checked {
+				if err := checkAdmin(ctx, users); err != nil {
+					t.Fatal(err)
+				}
+			}
+			gets := users.gets
+			if err := s.UpdateUserAccess(ctx, usermodel.UpdateAccessRequest{Username: "abc", Doors: usermodel.Doors{"HQ-In": false}}); err != nil {
+				t.Fatal(err)
+			}
+			//the target is read before and after the update, the actor never
+			if users.gets-gets != 2 {
+				t.Errorf("expected 2 users-go reads, got %v", users.gets-gets)
+			}
+			if len(changes.changes) != 1 || changes.changes[0].ActorRole != test.role {
+				t.Fatalf("expected one change by %v, got %v", test.role, changes.changes)
+			}
+			if diff := cmp.Diff(map[string]float64{"role " + test.role: 1}, roles.values); diff != "" {
+				t.Errorf("roles mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	roles := newLabelMetric()
+	NewAccessChangeMetrics(labelCounter{roles}).OnAccessChange(context.Background(), model.AccessChange{})
+	if diff := cmp.Diff(map[string]float64{"role " + model.RoleUnknown: 1}, roles.values); diff != "" {
+		t.Errorf("roles mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		val     string
+		buckets []float64
+		err     bool
+	}{
+		{val: "0.005,0.01,0.1,1", buckets: []float64{0.005, 0.01, 0.1, 1}},
+		{val: " 1 , 0.1,0.5 ", buckets: []float64{0.1, 0.5, 1}},
+		{val: "2.5", buckets: []float64{2.5}},
+		{val: "", err: true},
+		{val: " , ", err: true},
+		{val: "0.1,0", err: true},
+		{val: "0.1,-1", err: true},
+		{val: "0.1,fast", err: true},
+	}
+	for _, test := range tests {
+		buckets, err := ParseBuckets(test.val)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.val, err)
+			continue
+		}
+		if diff := cmp.Diff(test.buckets, buckets); diff != "" {
+			t.Errorf("%q: buckets mismatch (-want +got):\n%s", test.val, diff)
+		}
+	}
+}
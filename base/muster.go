@@ -0,0 +1,331 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+var (
+	errMusterActive  = errors.New("a muster session is already running")
+	errMusterRunning = errors.New("muster session has not finished")
+)
+
+//CheckIn ...
+type CheckIn struct {
+	Username    string    `json:"username"`
+	MusterPoint string    `json:"musterpoint"`
+	Time        time.Time `json:"time"`
+}
+
+//MusterSession snapshots who was inside when it started and tracks check-ins
+//at muster points until it is ended.
+type MusterSession struct {
+	ID        string              `json:"id"`
+	Area      string              `json:"area,omitempty"`
+	StartedBy string              `json:"startedby"`
+	StartedAt time.Time           `json:"startedat"`
+	EndedAt   *time.Time          `json:"endedat,omitempty"`
+	Expected  map[string]Presence `json:"-"`
+	CheckIns  map[string]CheckIn  `json:"-"`
+}
+
+//MusterReport is the state of a session. Unexpected are check-ins of people the
+//snapshot did not place inside.
+type MusterReport struct {
+	MusterSession
+	ExpectedCount int        `json:"expectedcount"`
+	Accounted     []CheckIn  `json:"accounted"`
+	Unaccounted   []Presence `json:"unaccounted"`
+	Unexpected    []CheckIn  `json:"unexpected"`
+}
+
+//MusterRequest ...
+type MusterRequest struct {
+	Area string `json:"area"`
+}
+
+//Muster runs evacuation roll calls on top of the occupancy model.
+type Muster struct {
+	mtx          sync.Mutex
+	doors        *Doors
+	occupancy    *Occupancy
+	usersService UsersService
+	sessions     []*MusterSession
+	active       *MusterSession
+	keep         int
+	logger       log.Logger
+}
+
+//NewMuster keeps the keep most recent finished sessions besides the active one.
+//Starting and ending a session is logged as a security event.
+func NewMuster(doors *Doors, occupancy *Occupancy, usersService UsersService, keep int, logger log.Logger) *Muster {
+	return &Muster{
+		doors:        doors,
+		occupancy:    occupancy,
+		usersService: usersService,
+		keep:         keep,
+		logger:       logger,
+	}
+}
+
+//Start snapshots current occupancy, optionally limited to one area. The actor
+//from the request context must be an admin.
+func (m *Muster) Start(ctx context.Context, req MusterRequest) (report MusterReport, err error) {
+	defer func() {
+		securityLogger(levelFor(requestLogger(ctx, m.logger), err)).Log("method", "MusterStart", "actor", actor(ctx),
+			"session", report.ID, "area", req.Area, "expected", report.ExpectedCount, "err", err)
+	}()
+	if err := checkAdmin(ctx, m.usersService); err != nil {
+		return MusterReport{}, err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.active != nil {
+		return MusterReport{}, errMusterActive
+	}
+	session := &MusterSession{
+		ID:        newID(),
+		Area:      req.Area,
+		StartedBy: actor(ctx),
+		StartedAt: time.Now().UTC(),
+		Expected:  map[string]Presence{},
+		CheckIns:  map[string]CheckIn{},
+	}
+	for _, p := range m.occupancy.Present() {
+		if req.Area == "" || p.Area == req.Area {
+			session.Expected[p.Username] = p
+		}
+	}
+	m.sessions = append(m.sessions, session)
+	m.active = session
+	return session.report(), nil
+}
+
+//End finishes session id.
+func (m *Muster) End(ctx context.Context, id string) (report MusterReport, err error) {
+	defer func() {
+		securityLogger(levelFor(requestLogger(ctx, m.logger), err)).Log("method", "MusterEnd", "actor", actor(ctx),
+			"session", id, "unaccounted", len(report.Unaccounted), "err", err)
+	}()
+	if err := checkAdmin(ctx, m.usersService); err != nil {
+		return MusterReport{}, err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	session := m.find(id)
+	if session == nil {
+		return MusterReport{}, errNotFound
+	}
+	if session.EndedAt == nil {
+		ended := time.Now().UTC()
+		session.EndedAt = &ended
+	}
+	if m.active == session {
+		m.active = nil
+	}
+	m.prune()
+	return session.report(), nil
+}
+
+//Report ...
+func (m *Muster) Report(id string) (MusterReport, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	session := m.find(id)
+	if session == nil {
+		return MusterReport{}, errNotFound
+	}
+	return session.report(), nil
+}
+
+//Sessions lists every session, newest first, without the people lists.
+func (m *Muster) Sessions() []MusterSession {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	sessions := make([]MusterSession, 0, len(m.sessions))
+	for i := len(m.sessions) - 1; i >= 0; i-- {
+		sessions = append(sessions, *m.sessions[i])
+	}
+	return sessions
+}
+
+//OnDecision implements DecisionListener. Any read at a muster point counts,
+//the reader does not need to grant access.
+func (m *Muster) OnDecision(_ context.Context, event model.Event) {
+	if m.doors.Catalog()[event.Door].Type != DoorMuster {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.active == nil {
+		return
+	}
+	if _, ok := m.active.CheckIns[event.Username]; ok {
+		return
+	}
+	m.active.CheckIns[event.Username] = CheckIn{
+		Username:    event.Username,
+		MusterPoint: event.Door,
+		Time:        event.Timestamp,
+	}
+}
+
+//prune drops the oldest finished sessions beyond m.keep. m.mtx must be held.
+func (m *Muster) prune() {
+	ended := 0
+	for _, session := range m.sessions {
+		if session.EndedAt != nil {
+			ended++
+		}
+	}
+	sessions := m.sessions[:0]
+	for _, session := range m.sessions {
+		if session.EndedAt != nil && ended > m.keep {
+			ended--
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	for i := len(sessions); i < len(m.sessions); i++ {
+		m.sessions[i] = nil
+	}
+	m.sessions = sessions
+}
+
+func (m *Muster) find(id string) *MusterSession {
+	for _, session := range m.sessions {
+		if session.ID == id {
+			return session
+		}
+	}
+	return nil
+}
+
+func (s *MusterSession) report() MusterReport {
+	report := MusterReport{
+		MusterSession: *s,
+		ExpectedCount: len(s.Expected),
+		Accounted:     []CheckIn{},
+		Unaccounted:   []Presence{},
+		Unexpected:    []CheckIn{},
+	}
+	for username, p := range s.Expected {
+		if _, ok := s.CheckIns[username]; !ok {
+			report.Unaccounted = append(report.Unaccounted, p)
+		}
+	}
+	for username, c := range s.CheckIns {
+		if _, ok := s.Expected[username]; ok {
+			report.Accounted = append(report.Accounted, c)
+		} else {
+			report.Unexpected = append(report.Unexpected, c)
+		}
+	}
+	sort.Slice(report.Unaccounted, func(i, j int) bool { return report.Unaccounted[i].Username < report.Unaccounted[j].Username })
+	sort.Slice(report.Accounted, func(i, j int) bool { return report.Accounted[i].Username < report.Accounted[j].Username })
+	sort.Slice(report.Unexpected, func(i, j int) bool { return report.Unexpected[i].Username < report.Unexpected[j].Username })
+	return report
+}
+
+//MakeMusterHandler mounts the muster routes under baseRoute.
+func MakeMusterHandler(m *Muster, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	}
+	r.Methods(http.MethodPost).Path(baseRoute + "/muster").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return m.Start(ctx, request.(MusterRequest))
+		},
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			var req MusterRequest
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					return nil, errBadRequest
+				}
+			}
+			return req, nil
+		},
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/muster").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return m.Sessions(), nil
+		},
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/muster/{id}").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return m.Report(request.(string))
+		},
+		decodeIDRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodPost).Path(baseRoute + "/muster/{id}/end").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return m.End(ctx, request.(string))
+		},
+		decodeIDRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/muster/{id}/export").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			report, err := m.Report(request.(string))
+			if err != nil {
+				return nil, err
+			}
+			if report.EndedAt == nil {
+				return nil, errMusterRunning
+			}
+			return report, nil
+		},
+		decodeIDRequest,
+		encodeMusterCSV,
+		options...,
+	))
+	return r
+}
+
+func encodeMusterCSV(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	report := response.(MusterReport)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=muster-"+report.ID+".csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"username", "status", "area", "lastdoor", "lastseen", "musterpoint", "checkedin"})
+	for _, c := range report.Accounted {
+		p := report.Expected[c.Username]
+		cw.Write([]string{c.Username, "accounted", p.Area, p.Door, formatCSVTime(p.LastSeen), c.MusterPoint, formatCSVTime(c.Time)})
+	}
+	for _, p := range report.Unaccounted {
+		cw.Write([]string{p.Username, "unaccounted", p.Area, p.Door, formatCSVTime(p.LastSeen), "", ""})
+	}
+	for _, c := range report.Unexpected {
+		cw.Write([]string{c.Username, "unexpected", "", "", "", c.MusterPoint, formatCSVTime(c.Time)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
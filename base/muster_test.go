@@ -0,0 +1,60 @@
+package base
+
+import (
+	"context"
+	"testing"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestMusterKeepsRecentSessions(t *testing.T) {
+	users := newFakeUsersService(usermodel.User{Username: "root", IsAdmin: true})
+	m := NewMuster(NewDoors(DoorCatalog{}), NewOccupancy(NewDoors(DoorCatalog{}), 0), users, 2, log.NewNopLogger())
+	ctx := withActor(context.Background(), "root")
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		report, err := m.Start(ctx, MusterRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, report.ID)
+		if _, err := m.End(ctx, report.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	active, err := m.Start(ctx, MusterRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := m.Sessions()
+	got := []string{}
+	for _, s := range sessions {
+		got = append(got, s.ID)
+	}
+	expected := []string{active.ID, ids[3], ids[2]}
+	if len(got) != len(expected) {
+		t.Fatalf("expected sessions %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected sessions %v, got %v", expected, got)
+		}
+	}
+	if _, err := m.Report(ids[0]); err != errNotFound {
+		t.Fatalf("expected the oldest session to be dropped, got %v", err)
+	}
+}
+
+func TestMusterNeedsAdmin(t *testing.T) {
+	users := newFakeUsersService(usermodel.User{Username: "bob"})
+	m := NewMuster(NewDoors(DoorCatalog{}), NewOccupancy(NewDoors(DoorCatalog{}), 0), users, 2, log.NewNopLogger())
+	if _, err := m.Start(withActor(context.Background(), "bob"), MusterRequest{}); err != errNotAdmin {
+		t.Fatalf("expected %v, got %v", errNotAdmin, err)
+	}
+	if _, err := m.Start(context.Background(), MusterRequest{}); err != errNotAdmin {
+		t.Fatalf("expected %v, got %v", errNotAdmin, err)
+	}
+}
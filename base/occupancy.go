@@ -0,0 +1,194 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+//Presence is where a user was last placed by a granted swipe.
+type Presence struct {
+	Username string    `json:"username"`
+	Area     string    `json:"area"`
+	Door     string    `json:"door"`
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"lastseen"`
+}
+
+//AreaOccupancy ...
+type AreaOccupancy struct {
+	Area      string     `json:"area"`
+	Count     int        `json:"count"`
+	Occupants []Presence `json:"occupants"`
+}
+
+//Occupancy tracks who is inside each area from granted decisions at classified
+//doors. A presence not refreshed within staleAfter is no longer reported.
+type Occupancy struct {
+	mtx        sync.RWMutex
+	doors      *Doors
+	presence   map[string]Presence
+	staleAfter time.Duration
+	now        func() time.Time
+	//lastSeen is the newest swipe applied per user, kept after they exit so
+	//Rebuild cannot replay an older one over it.
+	lastSeen map[string]time.Time
+}
+
+//NewOccupancy ...
+func NewOccupancy(doors *Doors, staleAfter time.Duration) *Occupancy {
+	return &Occupancy{
+		doors:      doors,
+		presence:   map[string]Presence{},
+		lastSeen:   map[string]time.Time{},
+		staleAfter: staleAfter,
+		now:        time.Now,
+	}
+}
+
+//OnDecision implements DecisionListener.
+func (o *Occupancy) OnDecision(_ context.Context, event model.Event) {
+	if event.Outcome != model.OutcomeGranted {
+		return
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.apply(event)
+}
+
+func (o *Occupancy) apply(event model.Event) {
+	door, ok := o.doors.Catalog()[event.Door]
+	if !ok || door.Area == "" {
+		return
+	}
+	if event.Timestamp.Before(o.lastSeen[event.Username]) {
+		//out of order, a newer swipe already placed or removed this user
+		return
+	}
+	o.lastSeen[event.Username] = event.Timestamp
+	current, present := o.presence[event.Username]
+	switch door.Type {
+	case DoorExit:
+		if present && current.Area == door.Area {
+			delete(o.presence, event.Username)
+		}
+	case DoorEntry, DoorInternal, "":
+		if !present || current.Area != door.Area {
+			current = Presence{Username: event.Username, Area: door.Area, Since: event.Timestamp}
+		}
+		current.Door = event.Door
+		current.LastSeen = event.Timestamp
+		o.presence[event.Username] = current
+	}
+}
+
+//Rebuild replays the recent history of every user in roster. Only events within
+//the stale window can still place someone, so older history is not fetched.
+//History older than a decision made meanwhile is dropped by apply.
+func (o *Occupancy) Rebuild(ctx context.Context, eventsService EventsService, roster *UserRoster, logger log.Logger) {
+	var from time.Time
+	if o.staleAfter > 0 {
+		from = o.now().Add(-o.staleAfter)
+	}
+	events := []model.Event{}
+	for _, username := range roster.List() {
+		history, err := fetchEvents(ctx, eventsService, model.EventQuery{Username: username, From: from})
+		if err != nil {
+			logger.Log("method", "OccupancyRebuild", "username", username, "err", err)
+			continue
+		}
+		events = append(events, history...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Timestamp.Before(events[j].Timestamp) })
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for _, event := range events {
+		o.apply(event)
+	}
+	logger.Log("method", "OccupancyRebuild", "users", len(roster.List()), "events", len(events), "present", len(o.presence))
+}
+
+//Present returns the current presence of every user, dropping stale entries.
+func (o *Occupancy) Present() []Presence {
+	cutoff := o.now().Add(-o.staleAfter)
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for username, seen := range o.lastSeen {
+		if o.staleAfter > 0 && seen.Before(cutoff) {
+			delete(o.lastSeen, username)
+		}
+	}
+	present := make([]Presence, 0, len(o.presence))
+	for username, p := range o.presence {
+		if o.staleAfter > 0 && p.LastSeen.Before(cutoff) {
+			delete(o.presence, username)
+			continue
+		}
+		present = append(present, p)
+	}
+	sort.Slice(present, func(i, j int) bool { return present[i].Username < present[j].Username })
+	return present
+}
+
+//Areas groups the current presence by area. area limits the report to one area.
+func (o *Occupancy) Areas(area string) []AreaOccupancy {
+	byArea := map[string]*AreaOccupancy{}
+	for _, info := range o.doors.Catalog() {
+		if info.Area != "" && (area == "" || info.Area == area) {
+			byArea[info.Area] = &AreaOccupancy{Area: info.Area, Occupants: []Presence{}}
+		}
+	}
+	for _, p := range o.Present() {
+		if a, ok := byArea[p.Area]; ok {
+			a.Occupants = append(a.Occupants, p)
+			a.Count++
+		}
+	}
+	areas := make([]AreaOccupancy, 0, len(byArea))
+	for _, a := range byArea {
+		areas = append(areas, *a)
+	}
+	sort.Slice(areas, func(i, j int) bool { return areas[i].Area < areas[j].Area })
+	return areas
+}
+
+//MakeOccupancyHandler mounts the occupancy report under baseRoute.
+func MakeOccupancyHandler(o *Occupancy, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	}
+	r.Methods(http.MethodGet).Path(baseRoute + "/occupancy").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return o.Areas(""), nil
+		},
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/occupancy/{area}").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			areas := o.Areas(request.(string))
+			if len(areas) == 0 {
+				return nil, errNotFound
+			}
+			return areas[0], nil
+		},
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			return mux.Vars(r)["area"], nil
+		},
+		encodeResponse,
+		options...,
+	))
+	return r
+}
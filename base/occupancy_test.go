@@ -0,0 +1,167 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	eventmodel "events/model"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testDoors() *Doors {
+	return NewDoors(DoorCatalog{
+		"HQ-In":   {Area: "HQ", Type: DoorEntry, Perimeter: true},
+		"HQ-Out":  {Area: "HQ", Type: DoorExit, Perimeter: true},
+		"HQ-Lab":  {Area: "HQ", Type: DoorInternal, Sensitivity: 3},
+		"Lab-In":  {Area: "Lab", Type: DoorEntry},
+		"Lab-Out": {Area: "Lab", Type: DoorExit},
+		"Yard":    {Type: DoorMuster},
+	})
+}
+
+func TestOccupancyAreas(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	granted := func(username, door string, minutes int) model.Event {
+		return model.Event{Username: username, Door: door, Timestamp: at(minutes), Outcome: model.OutcomeGranted}
+	}
+	tests := []struct {
+		name   string
+		events []model.Event
+		areas  map[string][]string
+	}{
+		{
+			name:   "Entry places the user",
+			events: []model.Event{granted("abc", "HQ-In", 0)},
+			areas:  map[string][]string{"HQ": {"abc"}, "Lab": {}},
+		},
+		{
+			name:   "Exit removes the user",
+			events: []model.Event{granted("abc", "HQ-In", 0), granted("abc", "HQ-Out", 5)},
+			areas:  map[string][]string{"HQ": {}, "Lab": {}},
+		},
+		{
+			name:   "Exit of another area is ignored",
+			events: []model.Event{granted("abc", "HQ-In", 0), granted("abc", "Lab-Out", 5)},
+			areas:  map[string][]string{"HQ": {"abc"}, "Lab": {}},
+		},
+		{
+			name:   "Entry to another area moves the user",
+			events: []model.Event{granted("abc", "HQ-In", 0), granted("abc", "Lab-In", 5), granted("def", "HQ-Lab", 6)},
+			areas:  map[string][]string{"HQ": {"def"}, "Lab": {"abc"}},
+		},
+		{
+			name: "Denied, unknown and muster doors are ignored",
+			events: []model.Event{
+				{Username: "abc", Door: "HQ-In", Timestamp: at(0), Outcome: model.OutcomeDenied},
+				granted("def", "Garage", 1),
+				granted("ghi", "Yard", 2),
+			},
+			areas: map[string][]string{"HQ": {}, "Lab": {}},
+		},
+		{
+			name:   "Older swipe does not undo a newer one",
+			events: []model.Event{granted("abc", "HQ-In", 10), granted("abc", "HQ-Out", 5)},
+			areas:  map[string][]string{"HQ": {"abc"}, "Lab": {}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := NewOccupancy(testDoors(), 0)
+			for _, event := range test.events {
+				o.OnDecision(context.Background(), event)
+			}
+			areas := map[string][]string{}
+			for _, a := range o.Areas("") {
+				areas[a.Area] = []string{}
+				for _, p := range a.Occupants {
+					areas[a.Area] = append(areas[a.Area], p.Username)
+				}
+				if a.Count != len(a.Occupants) {
+					t.Fatalf("%v: count %v with %v occupants", a.Area, a.Count, len(a.Occupants))
+				}
+			}
+			if diff := cmp.Diff(areas, test.areas); diff != "" {
+				t.Fatalf("differs: (-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOccupancyPresence(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	o := NewOccupancy(testDoors(), time.Hour)
+	o.now = func() time.Time { return start.Add(30 * time.Minute) }
+	o.OnDecision(context.Background(), model.Event{Username: "abc", Door: "HQ-In", Timestamp: start, Outcome: model.OutcomeGranted})
+	o.OnDecision(context.Background(), model.Event{Username: "abc", Door: "HQ-Lab", Timestamp: start.Add(10 * time.Minute), Outcome: model.OutcomeGranted})
+
+	//an internal door refreshes the presence but keeps when the user came in
+	want := []Presence{{Username: "abc", Area: "HQ", Door: "HQ-Lab", Since: start, LastSeen: start.Add(10 * time.Minute)}}
+	if diff := cmp.Diff(o.Present(), want); diff != "" {
+		t.Fatalf("differs: (-got +want)\n%s", diff)
+	}
+	if areas := o.Areas("Lab"); len(areas) != 1 || areas[0].Count != 0 {
+		t.Fatalf("unexpected Lab occupancy %+v", areas)
+	}
+	if areas := o.Areas("Garage"); len(areas) != 0 {
+		t.Fatalf("expected no unknown area, got %+v", areas)
+	}
+
+	//an hour after the last swipe the presence is stale
+	o.now = func() time.Time { return start.Add(71 * time.Minute) }
+	if present := o.Present(); len(present) != 0 {
+		t.Fatalf("expected the stale presence to expire, got %+v", present)
+	}
+}
+
+//liveEvents calls during after every history fetch, like a decision made while
+//Rebuild is still reading.
+type liveEvents struct {
+	EventsService
+	during func(username string)
+}
+
+func (e liveEvents) GetEvents(ctx context.Context, query model.EventQuery) (eventmodel.Events, error) {
+	events, err := e.EventsService.GetEvents(ctx, query)
+	e.during(query.Username)
+	return events, err
+}
+
+func TestOccupancyRebuild(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	history := newFakeEventsService()
+	history.add("abc", "HQ-In", start.Unix())
+	history.add("def", "HQ-In", start.Unix())
+	history.add("ghi", "HQ-In", start.Unix())
+	roster, _ := LoadUserRoster("")
+	for _, username := range []string{"abc", "def", "ghi"} {
+		roster.Add(username)
+	}
+	o := NewOccupancy(testDoors(), time.Hour)
+	o.now = func() time.Time { return start.Add(30 * time.Minute) }
+	live := map[string]model.Event{
+		//abc leaves while the history still has them inside
+		"abc": {Username: "abc", Door: "HQ-Out", Timestamp: start.Add(20 * time.Minute), Outcome: model.OutcomeGranted},
+		//ghi moves on to the lab
+		"ghi": {Username: "ghi", Door: "Lab-In", Timestamp: start.Add(20 * time.Minute), Outcome: model.OutcomeGranted},
+	}
+	events := liveEvents{EventsService: history, during: func(username string) {
+		if event, ok := live[username]; ok {
+			o.OnDecision(context.Background(), event)
+		}
+	}}
+	o.Rebuild(context.Background(), events, roster, log.NewNopLogger())
+
+	areas := map[string][]string{}
+	for _, a := range o.Areas("") {
+		for _, p := range a.Occupants {
+			areas[a.Area] = append(areas[a.Area], p.Username)
+		}
+	}
+	if diff := cmp.Diff(map[string][]string{"HQ": {"def"}, "Lab": {"ghi"}}, areas); diff != "" {
+		t.Fatalf("areas mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,258 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+//OTLPConfig selects where spans go. Endpoint is an OTLP/HTTP traces URL such as
+//http://localhost:4318/v1/traces, Path a file that gets one OTLP/JSON export
+//request per line. Both may be set.
+type OTLPConfig struct {
+	Endpoint  string
+	Path      string
+	BatchSize int
+	Interval  time.Duration
+	Timeout   time.Duration
+}
+
+//OTLPExporter batches ended spans and writes them as OTLP/JSON. Spans that do
+//not fit the queue are dropped rather than slowing requests down.
+type OTLPExporter struct {
+	config      OTLPConfig
+	serviceName string
+	client      *http.Client
+	file        *os.File
+	logger      log.Logger
+	queue       chan *Span
+	mtx         sync.RWMutex
+	closed      bool
+	done        chan struct{}
+}
+
+//NewOTLPExporter ...
+func NewOTLPExporter(config OTLPConfig, serviceName string, logger log.Logger) (*OTLPExporter, error) {
+	if config.Endpoint == "" && config.Path == "" {
+		return nil, errors.New("otlp exporter needs an endpoint or a file")
+	}
+	if config.BatchSize < 1 {
+		config.BatchSize = 512
+	}
+	if config.Interval <= 0 {
+		config.Interval = 5 * time.Second
+	}
+	e := &OTLPExporter{
+		config:      config,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: config.Timeout},
+		logger:      logger,
+		queue:       make(chan *Span, config.BatchSize*4),
+		done:        make(chan struct{}),
+	}
+	if config.Path != "" {
+		f, err := os.OpenFile(config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		e.file = f
+	}
+	go e.run()
+	return e, nil
+}
+
+//Export implements SpanExporter.
+func (e *OTLPExporter) Export(span *Span) {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- span:
+	default:
+	}
+}
+
+//Close writes out the queued spans and waits for ctx.
+func (e *OTLPExporter) Close(ctx context.Context) error {
+	e.mtx.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mtx.Unlock()
+	select {
+	case <-e.done:
+		if e.file != nil {
+			return e.file.Close()
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, e.config.BatchSize)
+	for {
+		select {
+		case span, ok := <-e.queue:
+			if !ok {
+				e.write(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < e.config.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		e.write(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *OTLPExporter) write(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		e.logger.Log("method", "OTLPExport", "err", err)
+		return
+	}
+	if e.file != nil {
+		if _, err := e.file.Write(append(body, '\n')); err != nil {
+			e.logger.Log("method", "OTLPExport", "path", e.config.Path, "err", err)
+		}
+	}
+	if e.config.Endpoint != "" {
+		if err := e.post(body); err != nil {
+			e.logger.Log("method", "OTLPExport", "endpoint", e.config.Endpoint, "spans", len(batch), "err", err)
+		}
+	}
+}
+
+func (e *OTLPExporter) post(body []byte) error {
+	resp, err := e.client.Post(e.config.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned %v", resp.StatusCode)
+	}
+	return nil
+}
+
+//otlp* mirror the JSON encoding of ExportTraceServiceRequest.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (e *OTLPExporter) request(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mtx.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			TraceState:        s.traceState,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, attr := range s.attributes {
+			span.Attributes = append(span.Attributes, otlpAttribute(attr.key, attr.value))
+		}
+		//1 is ok, 2 is error
+		span.Status.Code = 1
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		s.mtx.Unlock()
+		spans = append(spans, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{otlpAttribute("service.name", e.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "accessdoor"}, Spans: spans}},
+	}}}
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value = map[string]interface{}{"stringValue": v}
+	case bool:
+		kv.Value = map[string]interface{}{"boolValue": v}
+	case int:
+		kv.Value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		kv.Value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		kv.Value = map[string]interface{}{"doubleValue": v}
+	default:
+		kv.Value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return kv
+}
@@ -1,8 +1,10 @@
 package base
 
 import (
+	"accessdoor/model"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	eventmodel "events/model"
@@ -10,6 +12,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 	usermodel "users/model"
 
@@ -26,21 +29,41 @@ type ProxyConfig struct {
 	Method      string
 	MaxAttempts int
 	MaxTime     time.Duration
+	//Tracer wraps every attempt in a client span, nil disables it.
+	Tracer *Tracer
+	//Service names the upstream in metrics.
+	Service string
+	//Metrics records every attempt and the connection pool, nil disables it.
+	Metrics *ProxyMetrics
+	//TLS is used when URL is https, nil uses the system CAs without a client
+	//certificate.
+	TLS *tls.Config
 }
 
 func MakeProxyEndpoints(method string, config ProxyConfig, encoder kithttp.EncodeRequestFunc, decoder kithttp.DecodeResponseFunc, logger log.Logger) endpoint.Endpoint {
 	var endpointer sd.FixedEndpointer
 	var e endpoint.Endpoint
 
+	options := []kithttp.ClientOption{kithttp.ClientAfter(traceProxyResponse)}
+	if config.Metrics != nil {
+		options = append(options,
+			kithttp.ClientAfter(recordProxyStatus),
+			kithttp.SetClient(config.Metrics.client(config.Service, config.URL.Host, config.TLS)))
+	} else if config.TLS != nil {
+		options = append(options, kithttp.SetClient(&http.Client{Transport: newTransport(config.TLS)}))
+	}
 	e = kithttp.NewClient(
 		method, config.URL,
 		encoder,
 		decoder,
+		options...,
 	).Endpoint()
+	e = instrumentProxyAttempt(config.Metrics, config.Service, config.URL.Host, e)
+	e = traceProxyCall(config.Tracer, method, config.URL, e)
 
 	endpointer = append(endpointer, e)
 	balancer := lb.NewRoundRobin(endpointer)
-	return lb.Retry(config.MaxAttempts, config.MaxTime, balancer)
+	return countProxyAttempts(config.Metrics, lb.Retry(config.MaxAttempts, config.MaxTime, balancer))
 }
 
 type EventsProxy func(EventsService) EventsService
@@ -50,7 +73,7 @@ func NewEventsProxy(ctx context.Context, geteventconfig, updateventconfig ProxyC
 		return func(next EventsService) EventsService { return next }
 	}
 
-	getEventProxy := MakeProxyEndpoints(geteventconfig.Method, geteventconfig, encodegetUsersInfoRequest, decodeGetEventResponse, logger)
+	getEventProxy := MakeProxyEndpoints(geteventconfig.Method, geteventconfig, encodeGetEventsRequest, decodeGetEventResponse, logger)
 	updateEventProxy := MakeProxyEndpoints(updateventconfig.Method, updateventconfig, encodePOSTRequest, decodeUpdateEventsResponse, logger)
 
 	return func(next EventsService) EventsService {
@@ -64,7 +87,7 @@ func NewEventsProxy(ctx context.Context, geteventconfig, updateventconfig ProxyC
 }
 
 type EventsService interface {
-	GetEvents(ctx context.Context, username string) (eventmodel.Events, error)
+	GetEvents(ctx context.Context, query model.EventQuery) (eventmodel.Events, error)
 	UpdateEvents(ctx context.Context, request eventmodel.UpdateEventRequest) (err error)
 }
 
@@ -75,8 +98,8 @@ type eventsService struct {
 	EventsService
 }
 
-func (s eventsService) GetEvents(ctx context.Context, username string) (eventmodel.Events, error) {
-	response, err := s.GetEventsEndpoint(ctx, username)
+func (s eventsService) GetEvents(ctx context.Context, query model.EventQuery) (eventmodel.Events, error) {
+	response, err := s.GetEventsEndpoint(ctx, query)
 	if err != nil {
 		return eventmodel.Events{}, err
 	}
@@ -180,6 +203,29 @@ func encodegetUsersInfoRequest(ctx context.Context, r *http.Request, req interfa
 	}
 	return nil
 }
+
+//encodeGetEventsRequest pushes the filters events-go understands down as query
+//parameters. Ordering and paging are always applied locally.
+func encodeGetEventsRequest(ctx context.Context, r *http.Request, req interface{}) error {
+	setRequestHeaders(ctx, r, req)
+	query, ok := req.(model.EventQuery)
+	if !ok {
+		return errors.New("invalid events query during proxy call")
+	}
+	q := r.URL.Query()
+	q.Add("username", query.Username)
+	if query.Door != "" {
+		q.Add("door", query.Door)
+	}
+	if !query.From.IsZero() {
+		q.Add("from", strconv.FormatInt(query.From.Unix(), 10))
+	}
+	if !query.To.IsZero() {
+		q.Add("to", strconv.FormatInt(query.To.Unix(), 10))
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
 func decodeGetUsersResponse(_ context.Context, r *http.Response) (interface{}, error) {
 	defer r.Body.Close()
 	if r.StatusCode != http.StatusOK {
@@ -223,5 +269,6 @@ func setRequestHeaders(ctx context.Context, r *http.Request, req interface{}) er
 	r.Header.Set("Accept", "*/*")
 	r.Header.Set("X-Forwarded-For", xff(ctx))
 	r.Header.Set("X-Request-Id", cid(ctx))
+	setTraceHeaders(ctx, r)
 	return nil
 }
@@ -0,0 +1,32 @@
+package base
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+//Readiness tells whether the instance takes new traffic. Once it is stopped the
+//health check fails, so Consul and load balancers route elsewhere while the
+//requests in flight drain.
+type Readiness struct {
+	stopped int32
+}
+
+//Stop ...
+func (r *Readiness) Stop() {
+	atomic.StoreInt32(&r.stopped, 1)
+}
+
+//Ready ...
+func (r *Readiness) Ready() bool {
+	return atomic.LoadInt32(&r.stopped) == 0
+}
+
+//WithReadiness makes Check fail with 503 once r is stopped.
+func WithReadiness(r *Readiness) ServiceOption {
+	return func(s *baseService) {
+		s.readiness = r
+	}
+}
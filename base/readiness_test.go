@@ -0,0 +1,49 @@
+package base
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestReadiness(t *testing.T) {
+	readiness := &Readiness{}
+	s := NewService(log.NewNopLogger(), newFakeUsersService(), newFakeEventsService(), WithReadiness(readiness))
+	h := MakeHTTPHandler(s, log.NewNopLogger(), "v1", "accessdoor")
+	check := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+		return w.Code
+	}
+
+	if !readiness.Ready() {
+		t.Fatal("expected a new Readiness to be ready")
+	}
+	if ok, err := s.Check(context.Background()); !ok || err != nil {
+		t.Fatalf("expected the check to pass, got %v %v", ok, err)
+	}
+	if code := check(); code != http.StatusOK {
+		t.Fatalf("expected /healthcheck to answer 200, got %v", code)
+	}
+
+	readiness.Stop()
+	readiness.Stop()
+	if readiness.Ready() {
+		t.Fatal("expected a stopped Readiness not to be ready")
+	}
+	if ok, err := s.Check(context.Background()); ok || err != errShuttingDown {
+		t.Fatalf("expected the check to fail with %v, got %v %v", errShuttingDown, ok, err)
+	}
+	if code := check(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected /healthcheck to answer 503 after Stop, got %v", code)
+	}
+
+	//without a Readiness the check always passes
+	s = NewService(log.NewNopLogger(), newFakeUsersService(), newFakeEventsService())
+	if ok, err := s.Check(context.Background()); !ok || err != nil {
+		t.Fatalf("expected the check to pass, got %v %v", ok, err)
+	}
+}
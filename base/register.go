@@ -1,6 +1,7 @@
 package base
 
 import (
+	"fmt"
 	"math/rand"
 	"strconv"
 	"time"
@@ -11,8 +12,17 @@ import (
 	"github.com/hashicorp/consul/api"
 )
 
+// Consul service metadata keys. MetaScheme is http or https, MetaTLSServerName
+// is the name instances present in their certificate when it is not their address.
+const (
+	MetaScheme        = "scheme"
+	MetaTLSServerName = "tls_server_name"
+)
+
 // Register func
-func Register(serviceName string, consulAddress string, httpAddr string, httpPort int,
+// scheme is http or https, it is published in the service metadata so clients
+// know how to reach this instance.
+func Register(serviceName string, consulAddress string, scheme string, httpAddr string, httpPort int,
 	dependencies []string, logger log.Logger) (*api.Client, sd.Registrar, error) {
 
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -31,9 +41,11 @@ func Register(serviceName string, consulAddress string, httpAddr string, httpPor
 		client = consulsd.NewClient(consulClient)
 	}
 
+	// the agent only checks liveness, it is not given our CA
 	checks := api.AgentServiceChecks{}
 	checks = append(checks, &api.AgentServiceCheck{
-		HTTP:                           "http://" + httpAddr + ":" + strconv.Itoa(httpPort) + "/healthcheck",
+		HTTP:                           scheme + "://" + httpAddr + ":" + strconv.Itoa(httpPort) + "/healthcheck",
+		TLSSkipVerify:                  true,
 		Interval:                       "1s",
 		Timeout:                        "1s",
 		DeregisterCriticalServiceAfter: "72h",
@@ -45,7 +57,8 @@ func Register(serviceName string, consulAddress string, httpAddr string, httpPor
 	if len(dependencies) > 0 {
 		for _, dependency := range dependencies {
 			checks = append(checks, &api.AgentServiceCheck{
-				HTTP:                           "http://" + httpAddr + ":" + strconv.Itoa(httpPort) + "/healthcheck/" + dependency,
+				HTTP:                           scheme + "://" + httpAddr + ":" + strconv.Itoa(httpPort) + "/healthcheck/" + dependency,
+				TLSSkipVerify:                  true,
 				Interval:                       "1s",
 				Timeout:                        "1s",
 				DeregisterCriticalServiceAfter: "72h",
@@ -60,8 +73,22 @@ func Register(serviceName string, consulAddress string, httpAddr string, httpPor
 		Name:    serviceName,
 		Address: httpAddr,
 		Port:    httpPort,
+		Meta:    map[string]string{MetaScheme: scheme},
 		Checks:  checks,
 	}
 
 	return consulClient, consulsd.NewRegistrar(client, &asr, logger), err
 }
+
+//HealthyInstance returns a passing instance of service from Consul. Its
+//metadata has the scheme and the certificate name to reach it with.
+func HealthyInstance(client *api.Client, service string) (*api.AgentService, error) {
+	entries, _, err := client.Health().Service(service, "", true, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || entries[0].Service == nil {
+		return nil, fmt.Errorf("no healthy %v instance in consul", service)
+	}
+	return entries[0].Service, nil
+}
@@ -0,0 +1,137 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	eventmodel "events/model"
+	"net/http"
+	"sync/atomic"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+)
+
+//The switches below hold a part of the service that a config reload replaces.
+//Swap takes effect for calls that start after it, calls in flight finish on
+//what they started with.
+
+//UsersSwitch is a UsersService whose upstream can be swapped.
+type UsersSwitch struct {
+	v atomic.Value
+}
+
+type usersHolder struct{ UsersService }
+
+//NewUsersSwitch ...
+func NewUsersSwitch(next UsersService) *UsersSwitch {
+	s := &UsersSwitch{}
+	s.Swap(next)
+	return s
+}
+
+//Swap ...
+func (s *UsersSwitch) Swap(next UsersService) {
+	s.v.Store(usersHolder{next})
+}
+
+func (s *UsersSwitch) current() UsersService {
+	return s.v.Load().(usersHolder).UsersService
+}
+
+//GetUser ...
+func (s *UsersSwitch) GetUser(ctx context.Context, username string) (usermodel.User, error) {
+	return s.current().GetUser(ctx, username)
+}
+
+//UpdateUserAccess ...
+func (s *UsersSwitch) UpdateUserAccess(ctx context.Context, req usermodel.UpdateAccessRequest) (string, error) {
+	return s.current().UpdateUserAccess(ctx, req)
+}
+
+//DoorAuthenticate ...
+func (s *UsersSwitch) DoorAuthenticate(ctx context.Context, req usermodel.DoorAuthenticate) (string, error) {
+	return s.current().DoorAuthenticate(ctx, req)
+}
+
+//EventsSwitch is an EventsService whose upstream can be swapped.
+type EventsSwitch struct {
+	v atomic.Value
+}
+
+type eventsHolder struct{ EventsService }
+
+//NewEventsSwitch ...
+func NewEventsSwitch(next EventsService) *EventsSwitch {
+	s := &EventsSwitch{}
+	s.Swap(next)
+	return s
+}
+
+//Swap ...
+func (s *EventsSwitch) Swap(next EventsService) {
+	s.v.Store(eventsHolder{next})
+}
+
+func (s *EventsSwitch) current() EventsService {
+	return s.v.Load().(eventsHolder).EventsService
+}
+
+//GetEvents ...
+func (s *EventsSwitch) GetEvents(ctx context.Context, query model.EventQuery) (eventmodel.Events, error) {
+	return s.current().GetEvents(ctx, query)
+}
+
+//UpdateEvents ...
+func (s *EventsSwitch) UpdateEvents(ctx context.Context, request eventmodel.UpdateEventRequest) error {
+	return s.current().UpdateEvents(ctx, request)
+}
+
+//HandlerSwitch is an http.Handler that can be swapped, e.g. to change the
+//timeout of the TimeoutHandler in front of the API.
+type HandlerSwitch struct {
+	v atomic.Value
+}
+
+type handlerHolder struct{ http.Handler }
+
+//NewHandlerSwitch ...
+func NewHandlerSwitch(next http.Handler) *HandlerSwitch {
+	s := &HandlerSwitch{}
+	s.Swap(next)
+	return s
+}
+
+//Swap ...
+func (s *HandlerSwitch) Swap(next http.Handler) {
+	s.v.Store(handlerHolder{next})
+}
+
+func (s *HandlerSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.v.Load().(handlerHolder).ServeHTTP(w, r)
+}
+
+//LoggerSwitch is a log.Logger that can be swapped. It sits below log.With so
+//the bound values and the caller depth stay the same, e.g. to change the level
+//filter and redaction in front of the sinks.
+type LoggerSwitch struct {
+	v atomic.Value
+}
+
+type loggerHolder struct{ log.Logger }
+
+//NewLoggerSwitch ...
+func NewLoggerSwitch(next log.Logger) *LoggerSwitch {
+	s := &LoggerSwitch{}
+	s.Swap(next)
+	return s
+}
+
+//Swap ...
+func (s *LoggerSwitch) Swap(next log.Logger) {
+	s.v.Store(loggerHolder{next})
+}
+
+//Log ...
+func (s *LoggerSwitch) Log(keyvals ...interface{}) error {
+	return s.v.Load().(loggerHolder).Log(keyvals...)
+}
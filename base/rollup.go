@@ -0,0 +1,256 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	GroupByDoor    = "door"
+	GroupByUser    = "user"
+	GroupByHour    = "hour"
+	GroupByDay     = "day"
+	GroupByWeekday = "weekday"
+)
+
+var errInvalidGroupBy = errors.New("groupby must be door, user and at most one of hour, day or weekday")
+
+type rollupKey struct {
+	hour     int64
+	door     string
+	username string
+	outcome  string
+}
+
+//AggregateQuery ...
+type AggregateQuery struct {
+	GroupBy  []string
+	From     time.Time
+	To       time.Time
+	Door     string
+	Username string
+	Outcome  string
+	Location *time.Location
+}
+
+//AggregateRow is one point of a count series. Only the grouped fields are set.
+type AggregateRow struct {
+	Door     string `json:"door,omitempty"`
+	Username string `json:"username,omitempty"`
+	Bucket   string `json:"bucket,omitempty"`
+	Count    int64  `json:"count"`
+}
+
+//Rollup keeps hourly access counts per door, user and outcome so usage queries
+//never need full histories. Hours older than retention are dropped.
+type Rollup struct {
+	mtx       sync.RWMutex
+	counts    map[rollupKey]int64
+	pruned    int64
+	retention time.Duration
+	now       func() time.Time
+}
+
+//NewRollup ...
+func NewRollup(retention time.Duration) *Rollup {
+	return &Rollup{
+		counts:    map[rollupKey]int64{},
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+//OnDecision implements DecisionListener.
+func (r *Rollup) OnDecision(_ context.Context, event model.Event) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.add(event)
+	r.prune()
+}
+
+func (r *Rollup) add(event model.Event) {
+	r.counts[rollupKey{
+		hour:     event.Timestamp.Unix() / 3600,
+		door:     event.Door,
+		username: event.Username,
+		outcome:  event.Outcome,
+	}]++
+}
+
+//Rebuild seeds the rollup with the retained history of every user in roster.
+//Live decisions recorded meanwhile are counted once, history is only loaded up
+//to the moment the rebuild started.
+func (r *Rollup) Rebuild(ctx context.Context, eventsService EventsService, roster *UserRoster, logger log.Logger) {
+	to := r.now()
+	var from time.Time
+	if r.retention > 0 {
+		from = to.Add(-r.retention)
+	}
+	events := 0
+	for _, username := range roster.List() {
+		history, err := fetchEvents(ctx, eventsService, model.EventQuery{Username: username, From: from, To: to})
+		if err != nil {
+			logger.Log("method", "RollupRebuild", "username", username, "err", err)
+			continue
+		}
+		r.mtx.Lock()
+		for _, event := range history {
+			r.add(event)
+		}
+		r.mtx.Unlock()
+		events += len(history)
+	}
+	logger.Log("method", "RollupRebuild", "users", len(roster.List()), "events", events)
+}
+
+//prune drops hours that fell out of retention, at most once per hour.
+func (r *Rollup) prune() {
+	if r.retention <= 0 {
+		return
+	}
+	cutoff := r.now().Add(-r.retention).Unix() / 3600
+	if cutoff <= r.pruned {
+		return
+	}
+	r.pruned = cutoff
+	for key := range r.counts {
+		if key.hour < cutoff {
+			delete(r.counts, key)
+		}
+	}
+}
+
+//Aggregate sums the hourly counts matching q by its GroupBy dimensions. Day and
+//weekday buckets follow q.Location, whole hours are assigned to the day they start in.
+func (r *Rollup) Aggregate(q AggregateQuery) ([]AggregateRow, error) {
+	var byDoor, byUser bool
+	var bucket string
+	for _, g := range q.GroupBy {
+		switch g {
+		case GroupByDoor:
+			byDoor = true
+		case GroupByUser:
+			byUser = true
+		case GroupByHour, GroupByDay, GroupByWeekday:
+			if bucket != "" {
+				return nil, errInvalidGroupBy
+			}
+			bucket = g
+		default:
+			return nil, errInvalidGroupBy
+		}
+	}
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	rows := map[AggregateRow]int64{}
+	r.mtx.RLock()
+	for key, count := range r.counts {
+		start := time.Unix(key.hour*3600, 0).In(loc)
+		if (!q.From.IsZero() && start.Before(q.From.Truncate(time.Hour))) ||
+			(!q.To.IsZero() && !start.Before(q.To)) ||
+			(q.Door != "" && key.door != q.Door) ||
+			(q.Username != "" && key.username != q.Username) ||
+			(q.Outcome != "" && key.outcome != q.Outcome) {
+			continue
+		}
+		var row AggregateRow
+		if byDoor {
+			row.Door = key.door
+		}
+		if byUser {
+			row.Username = key.username
+		}
+		switch bucket {
+		case GroupByHour:
+			row.Bucket = start.Format(time.RFC3339)
+		case GroupByDay:
+			row.Bucket = start.Format("2006-01-02")
+		case GroupByWeekday:
+			row.Bucket = start.Weekday().String()
+		}
+		rows[row] += count
+	}
+	r.mtx.RUnlock()
+
+	series := make([]AggregateRow, 0, len(rows))
+	for row, count := range rows {
+		row.Count = count
+		series = append(series, row)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i], series[j]
+		if a.Door != b.Door {
+			return a.Door < b.Door
+		}
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+		if bucket == GroupByWeekday {
+			return weekdayIndex(a.Bucket) < weekdayIndex(b.Bucket)
+		}
+		return a.Bucket < b.Bucket
+	})
+	return series, nil
+}
+
+func weekdayIndex(name string) int {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if d.String() == name {
+			return int(d)
+		}
+	}
+	return -1
+}
+
+//MakeRollupHandler mounts the usage aggregation route under baseRoute. It
+//needs an admin actor.
+func MakeRollupHandler(r *Rollup, usersService UsersService, logger log.Logger, baseRoute string) http.Handler {
+	router := newRouter()
+	router.Methods(http.MethodGet).Path(baseRoute + "/usage").Handler(httptransport.NewServer(
+		requireAdmin(usersService)(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return r.Aggregate(request.(AggregateQuery))
+		}),
+		decodeAggregateRequest,
+		encodeResponse,
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	))
+	return router
+}
+
+func decodeAggregateRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	params := r.URL.Query()
+	query := AggregateQuery{
+		GroupBy:  splitList(params.Get("groupby")),
+		Door:     params.Get("door"),
+		Username: params.Get("user"),
+		Outcome:  params.Get("outcome"),
+	}
+	if len(query.GroupBy) == 0 {
+		query.GroupBy = []string{GroupByDoor}
+	}
+	if query.From, err = parseTimeParam(params.Get("from")); err != nil {
+		return nil, errBadRequest
+	}
+	if query.To, err = parseTimeParam(params.Get("to")); err != nil {
+		return nil, errBadRequest
+	}
+	if tz := params.Get("tz"); tz != "" {
+		if query.Location, err = time.LoadLocation(tz); err != nil {
+			return nil, errBadRequest
+		}
+	}
+	return query, nil
+}
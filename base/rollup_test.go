@@ -0,0 +1,192 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRollupAggregate(t *testing.T) {
+	//Sunday 2020-09-13 21:00 UTC is Sunday 23:00 in Berlin and Monday 06:00 in Tokyo
+	start := time.Date(2020, time.September, 13, 21, 0, 0, 0, time.UTC)
+	r := NewRollup(0)
+	for _, event := range []model.Event{
+		{Username: "abc", Door: "Door1", Timestamp: start.Add(5 * time.Minute), Outcome: model.OutcomeGranted},
+		{Username: "abc", Door: "Door1", Timestamp: start.Add(59 * time.Minute), Outcome: model.OutcomeGranted},
+		{Username: "def", Door: "Door1", Timestamp: start.Add(30 * time.Minute), Outcome: model.OutcomeDenied},
+		{Username: "abc", Door: "Door1", Timestamp: start.Add(time.Hour), Outcome: model.OutcomeGranted},
+		{Username: "abc", Door: "Door2", Timestamp: start.Add(3 * time.Hour), Outcome: model.OutcomeGranted},
+	} {
+		r.OnDecision(context.Background(), event)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+
+	tests := []struct {
+		name  string
+		query AggregateQuery
+		rows  []AggregateRow
+		err   error
+	}{
+		{
+			name:  "By door",
+			query: AggregateQuery{GroupBy: []string{GroupByDoor}},
+			rows:  []AggregateRow{{Door: "Door1", Count: 4}, {Door: "Door2", Count: 1}},
+		},
+		{
+			name:  "By hour",
+			query: AggregateQuery{GroupBy: []string{GroupByHour}},
+			rows: []AggregateRow{
+				{Bucket: "2020-09-13T21:00:00Z", Count: 3},
+				{Bucket: "2020-09-13T22:00:00Z", Count: 1},
+				{Bucket: "2020-09-14T00:00:00Z", Count: 1},
+			},
+		},
+		{
+			name:  "By user and hour for one outcome",
+			query: AggregateQuery{GroupBy: []string{GroupByUser, GroupByHour}, Outcome: model.OutcomeGranted},
+			rows: []AggregateRow{
+				{Username: "abc", Bucket: "2020-09-13T21:00:00Z", Count: 2},
+				{Username: "abc", Bucket: "2020-09-13T22:00:00Z", Count: 1},
+				{Username: "abc", Bucket: "2020-09-14T00:00:00Z", Count: 1},
+			},
+		},
+		{
+			name:  "By day in UTC",
+			query: AggregateQuery{GroupBy: []string{GroupByDay}},
+			rows:  []AggregateRow{{Bucket: "2020-09-13", Count: 4}, {Bucket: "2020-09-14", Count: 1}},
+		},
+		{
+			name:  "By day in Berlin",
+			query: AggregateQuery{GroupBy: []string{GroupByDay}, Location: berlin},
+			rows:  []AggregateRow{{Bucket: "2020-09-13", Count: 3}, {Bucket: "2020-09-14", Count: 2}},
+		},
+		{
+			name:  "By weekday in Tokyo",
+			query: AggregateQuery{GroupBy: []string{GroupByDoor, GroupByWeekday}, Location: tokyo},
+			rows:  []AggregateRow{{Door: "Door1", Bucket: "Monday", Count: 4}, {Door: "Door2", Bucket: "Monday", Count: 1}},
+		},
+		{
+			name:  "Weekdays in week order",
+			query: AggregateQuery{GroupBy: []string{GroupByWeekday}, Location: berlin},
+			rows:  []AggregateRow{{Bucket: "Sunday", Count: 3}, {Bucket: "Monday", Count: 2}},
+		},
+		{
+			name:  "From inside an hour counts the whole hour",
+			query: AggregateQuery{GroupBy: []string{GroupByDoor}, From: start.Add(40 * time.Minute), To: start.Add(2 * time.Hour)},
+			rows:  []AggregateRow{{Door: "Door1", Count: 4}},
+		},
+		{
+			name:  "To is exclusive",
+			query: AggregateQuery{GroupBy: []string{GroupByDoor}, To: start.Add(time.Hour)},
+			rows:  []AggregateRow{{Door: "Door1", Count: 3}},
+		},
+		{
+			name:  "Two time buckets",
+			query: AggregateQuery{GroupBy: []string{GroupByHour, GroupByDay}},
+			err:   errInvalidGroupBy,
+		},
+		{
+			name:  "Unknown dimension",
+			query: AggregateQuery{GroupBy: []string{"device"}},
+			err:   errInvalidGroupBy,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, err := r.Aggregate(test.query)
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(test.rows, rows); diff != "" {
+				t.Errorf("rows mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRollupRetention(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	now := start
+	r := NewRollup(2 * time.Hour)
+	r.now = func() time.Time { return now }
+	decide := func(at time.Time) {
+		r.OnDecision(context.Background(), model.Event{Username: "abc", Door: "Door1", Timestamp: at, Outcome: model.OutcomeGranted})
+	}
+	hours := func() []AggregateRow {
+		rows, _ := r.Aggregate(AggregateQuery{GroupBy: []string{GroupByHour}})
+		return rows
+	}
+
+	decide(start.Add(-90 * time.Minute))
+	decide(start.Add(-30 * time.Minute))
+	decide(start)
+	want := []AggregateRow{
+		{Bucket: "2020-09-13T07:00:00Z", Count: 1},
+		{Bucket: "2020-09-13T08:00:00Z", Count: 1},
+		{Bucket: "2020-09-13T09:00:00Z", Count: 1},
+	}
+	if diff := cmp.Diff(want, hours()); diff != "" {
+		t.Fatalf("rows mismatch (-want +got):\n%s", diff)
+	}
+
+	//the 07:00 hour leaves retention at 10:00, the next decision prunes it
+	now = start.Add(time.Hour)
+	decide(now)
+	want = []AggregateRow{
+		{Bucket: "2020-09-13T08:00:00Z", Count: 1},
+		{Bucket: "2020-09-13T09:00:00Z", Count: 1},
+		{Bucket: "2020-09-13T10:00:00Z", Count: 1},
+	}
+	if diff := cmp.Diff(want, hours()); diff != "" {
+		t.Fatalf("rows mismatch (-want +got):\n%s", diff)
+	}
+
+	//pruning runs once per hour, a late event for a dropped hour stays until the next one
+	decide(start.Add(-2 * time.Hour))
+	if rows := hours(); len(rows) != 4 {
+		t.Fatalf("expected the late hour to be kept until the next prune, got %v", rows)
+	}
+	now = start.Add(2 * time.Hour)
+	decide(now)
+	want = []AggregateRow{
+		{Bucket: "2020-09-13T09:00:00Z", Count: 1},
+		{Bucket: "2020-09-13T10:00:00Z", Count: 1},
+		{Bucket: "2020-09-13T11:00:00Z", Count: 1},
+	}
+	if diff := cmp.Diff(want, hours()); diff != "" {
+		t.Fatalf("rows mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRollupRebuild(t *testing.T) {
+	start := time.Date(2020, time.September, 13, 9, 0, 0, 0, time.UTC)
+	events := newFakeEventsService()
+	events.add("abc", "Door1", start.Add(-3*time.Hour).Unix())
+	events.add("abc", "Door1", start.Add(-time.Hour).Unix())
+	events.add("abc", "Door2", start.Unix())
+	events.add("def", "Door2", start.Add(time.Hour).Unix())
+	roster, _ := LoadUserRoster("")
+	roster.Add("abc")
+	roster.Add("def")
+
+	r := NewRollup(2 * time.Hour)
+	r.now = func() time.Time { return start }
+	r.Rebuild(context.Background(), events, roster, log.NewNopLogger())
+	rows, err := r.Aggregate(AggregateQuery{GroupBy: []string{GroupByDoor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//only retained history up to the rebuild is loaded, To is exclusive
+	want := []AggregateRow{{Door: "Door1", Count: 1}}
+	if diff := cmp.Diff(want, rows); diff != "" {
+		t.Errorf("rows mismatch (-want +got):\n%s", diff)
+	}
+}
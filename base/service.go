@@ -16,71 +16,233 @@ import (
 //Service ...
 type Service interface {
 	Check(ctx context.Context) (bool, error)
-	GetUser(ctx context.Context, username string) (model.UserResponse, error)
+	GetUser(ctx context.Context, query model.EventQuery) (model.UserEvents, error)
 	UpdateUserAccess(ctx context.Context, req usermodel.UpdateAccessRequest) error
-	DoorAuthenticate(ctx context.Context, req usermodel.DoorAuthenticate) (bool, error)
+	DoorAuthenticate(ctx context.Context, req model.AuthenticateRequest) (model.Event, error)
+}
+
+//accessDeniedError is returned by DoorAuthenticate alongside the denied decision.
+type accessDeniedError struct {
+	door string
+}
+
+func (e accessDeniedError) Error() string {
+	return "User does not have access to " + e.door
+}
+
+//IsAccessDenied reports whether err is a denied access decision rather than a failure.
+func IsAccessDenied(err error) bool {
+	_, ok := err.(accessDeniedError)
+	return ok
 }
 
 type baseService struct {
-	logger        log.Logger
-	usersService  UsersService
-	eventsService EventsService
+	logger            log.Logger
+	usersService      UsersService
+	eventsService     EventsService
+	decisionListeners []DecisionListener
+	changeListeners   []AccessChangeListener
+	attemptListeners  []AccessAttemptListener
+	readiness         *Readiness
+}
+
+//DecisionListener is told about every access decision DoorAuthenticate makes.
+//OnDecision is called on the request path and must not block.
+type DecisionListener interface {
+	OnDecision(ctx context.Context, event model.Event)
+}
+
+//AccessChangeListener is told about every access change UpdateUserAccess makes.
+//OnAccessChange is called on the request path and must not block.
+type AccessChangeListener interface {
+	OnAccessChange(ctx context.Context, change model.AccessChange)
+}
+
+//AccessAttemptListener is told about every UpdateUserAccess call, denied and
+//failed ones included. OnAccessAttempt is called on the request path and must
+//not block.
+type AccessAttemptListener interface {
+	OnAccessAttempt(ctx context.Context, change model.AccessChange)
+}
+
+//ServiceOption configures optional collaborators of the service.
+type ServiceOption func(*baseService)
+
+//WithDecisionListener registers l to receive every access decision.
+func WithDecisionListener(l DecisionListener) ServiceOption {
+	return func(s *baseService) {
+		s.decisionListeners = append(s.decisionListeners, l)
+	}
+}
+
+//WithAccessChangeListener registers l to receive every access change.
+func WithAccessChangeListener(l AccessChangeListener) ServiceOption {
+	return func(s *baseService) {
+		s.changeListeners = append(s.changeListeners, l)
+	}
+}
+
+//WithAccessAttemptListener registers l to receive every access change attempt.
+func WithAccessAttemptListener(l AccessAttemptListener) ServiceOption {
+	return func(s *baseService) {
+		s.attemptListeners = append(s.attemptListeners, l)
+	}
 }
 
 //NewService ...
-func NewService(l log.Logger, usersService UsersService, eventsService EventsService) Service {
-	return baseService{
+func NewService(l log.Logger, usersService UsersService, eventsService EventsService, options ...ServiceOption) Service {
+	s := baseService{
 		logger:        l,
 		usersService:  usersService,
 		eventsService: eventsService,
 	}
+	for _, option := range options {
+		option(&s)
+	}
+	return s
 }
 
 //Check ...
 func (s baseService) Check(ctx context.Context) (bool, error) {
+	if s.readiness != nil && !s.readiness.Ready() {
+		return false, errShuttingDown
+	}
 	return true, nil
 }
 
-func (s baseService) GetUser(ctx context.Context, username string) (model.UserResponse, error) {
-	userinformation, err := s.usersService.GetUser(ctx, username)
+func (s baseService) GetUser(ctx context.Context, query model.EventQuery) (model.UserEvents, error) {
+	userinformation, err := s.usersService.GetUser(ctx, query.Username)
+	if err != nil {
+		return model.UserEvents{}, err
+	}
+	userevents, err := s.eventsService.GetEvents(ctx, query)
 	if err != nil {
-		return model.UserResponse{}, err
+		return model.UserEvents{}, err
 	}
-	userevents, err := s.eventsService.GetEvents(ctx, username)
+	page, next, err := api.QueryEvents(userevents, query)
 	if err != nil {
-		return model.UserResponse{}, err
+		return model.UserEvents{}, err
 	}
-	return api.FormatEvents(userinformation, userevents), nil
+	response := api.FormatUserEvents(userinformation, page)
+	response.NextCursor = next
+	return response, nil
 }
+
 func (s baseService) UpdateUserAccess(ctx context.Context, req usermodel.UpdateAccessRequest) error {
+	change := model.AccessChange{
+		Actor:     actor(ctx),
+		Username:  req.Username,
+		Doors:     req.Doors,
+		Timestamp: time.Now().UTC().Truncate(time.Second),
+		RequestID: cid(ctx),
+		SourceIP:  sourceIP(ctx),
+	}
 	userinfo, err := s.usersService.GetUser(ctx, req.Username)
+	change.ActorRole = actorRole(ctx, userinfo)
 	if err != nil {
+		s.attempted(ctx, change, model.OutcomeFailed, err)
 		return err
 	}
-	if userinfo.IsAdmin {
-		_, err := s.usersService.UpdateUserAccess(ctx, req)
-		if err != nil {
-			return err
-		}
+	change.Before = userinfo.DoorAccess
+	change.After = userinfo.DoorAccess
+	//an actor checkAdmin verified, e.g. revoking unused grants, may change any user
+	if !userinfo.IsAdmin && !verifiedAdmin(ctx) {
+		err := errors.New("only admin users can update access")
+		s.attempted(ctx, change, model.OutcomeDenied, err)
+		return err
+	}
+	if _, err := s.usersService.UpdateUserAccess(ctx, req); err != nil {
+		s.attempted(ctx, change, model.OutcomeFailed, err)
+		return err
+	}
+	if len(s.changeListeners) == 0 && len(s.attemptListeners) == 0 {
+		return nil
+	}
+	updated, err := s.usersService.GetUser(ctx, req.Username)
+	if err == nil {
+		change.After = updated.DoorAccess
 	} else {
-		return errors.New("only admin users can update access")
+		//the update went through, fall back to applying the request locally
+		s.logger.Log("method", "UpdateUserAccess", "msg", "could not read back access", "err", err)
+		change.After = usermodel.Doors{}
+		for door, access := range userinfo.DoorAccess {
+			change.After[door] = access
+		}
+		for door, access := range req.Doors {
+			change.After[door] = access
+		}
+	}
+	change.Outcome = model.OutcomeApplied
+	for _, l := range s.changeListeners {
+		l.OnAccessChange(ctx, change)
 	}
+	s.attempted(ctx, change, model.OutcomeApplied, nil)
 	return nil
 }
-func (s baseService) DoorAuthenticate(ctx context.Context, req usermodel.DoorAuthenticate) (bool, error) {
-	hasaccess, err := s.usersService.DoorAuthenticate(ctx, req)
+
+//attempted tells the attempt listeners about change with its outcome.
+func (s baseService) attempted(ctx context.Context, change model.AccessChange, outcome string, err error) {
+	change.Outcome = outcome
 	if err != nil {
-		return false, err
+		change.Error = err.Error()
+	}
+	for _, l := range s.attemptListeners {
+		l.OnAccessAttempt(ctx, change)
+	}
+}
+
+//actorRole is the role checkAdmin found for the actor of the request in ctx.
+//Without one only an actor changing their own access has a known role, that
+//of target, so no lookup is made for it.
+func actorRole(ctx context.Context, target usermodel.User) string {
+	id, ok := ctx.Value(contextKeyActor).(*identity)
+	switch {
+	case !ok || id.actor == "":
+		return model.RoleUnknown
+	case id.role != "":
+		return id.role
+	case id.actor != target.Username:
+		return model.RoleUnknown
+	case target.IsAdmin:
+		return model.RoleAdmin
+	}
+	return model.RoleUser
+}
+
+func (s baseService) DoorAuthenticate(ctx context.Context, req model.AuthenticateRequest) (model.Event, error) {
+	hasaccess, err := s.usersService.DoorAuthenticate(ctx, usermodel.DoorAuthenticate{
+		Username:   req.Username,
+		AccessDoor: req.AccessDoor,
+	})
+	if err != nil {
+		return model.Event{}, err
+	}
+	event := model.Event{
+		Username:  req.Username,
+		Door:      req.AccessDoor,
+		Timestamp: time.Now().UTC().Truncate(time.Second),
+		Device:    req.Device,
+		RequestID: cid(ctx),
 	}
 	if !strings.Contains(hasaccess, "not") {
+		event.Outcome = model.OutcomeGranted
 		s.eventsService.UpdateEvents(ctx, eventmodel.UpdateEventRequest{
 			Username: req.Username,
 			Event: map[string]int64{
-				req.AccessDoor: time.Now().Unix(),
+				req.AccessDoor: event.Timestamp.Unix(),
 			},
 		})
-		return true, nil
+		s.notifyDecision(ctx, event)
+		return event, nil
 	} else {
-		return false, errors.New("User does not have access to " + req.AccessDoor)
+		event.Outcome = model.OutcomeDenied
+		s.notifyDecision(ctx, event)
+		return event, accessDeniedError{door: req.AccessDoor}
+	}
+}
+
+func (s baseService) notifyDecision(ctx context.Context, event model.Event) {
+	for _, l := range s.decisionListeners {
+		l.OnDecision(ctx, event)
 	}
 }
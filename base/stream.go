@@ -0,0 +1,263 @@
+package base
+
+import (
+	"accessdoor/model"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	//PolicyDisconnect closes a subscriber that falls behind. The client reconnects
+	//with Last-Event-ID and catches up from the ring buffer.
+	PolicyDisconnect = "disconnect"
+	//PolicyDrop skips events a slow subscriber has no room for.
+	PolicyDrop = "drop"
+)
+
+type streamEvent struct {
+	ID    uint64
+	Event model.Event
+}
+
+//StreamFilter selects the decisions a subscriber receives. Empty fields match everything.
+type StreamFilter struct {
+	Door     string
+	Username string
+	Outcome  string
+}
+
+func (f StreamFilter) match(event model.Event) bool {
+	return (f.Door == "" || f.Door == event.Door) &&
+		(f.Username == "" || f.Username == event.Username) &&
+		(f.Outcome == "" || f.Outcome == event.Outcome)
+}
+
+type subscriber struct {
+	events  chan streamEvent
+	filter  StreamFilter
+	policy  string
+	dropped uint64
+	closed  bool
+}
+
+//Hub fans access decisions out to live subscribers and keeps the most recent
+//ones in a bounded ring buffer so reconnecting clients can resume.
+type Hub struct {
+	mtx         sync.Mutex
+	ring        []streamEvent
+	next        int
+	lastID      uint64
+	subscribers map[*subscriber]struct{}
+	bufferSize  int
+	closed      bool
+}
+
+//NewHub returns a hub retaining ringSize decisions, with bufferSize pending
+//events allowed per subscriber.
+func NewHub(ringSize, bufferSize int) *Hub {
+	if ringSize < 1 {
+		ringSize = 1
+	}
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	return &Hub{
+		ring:        make([]streamEvent, 0, ringSize),
+		subscribers: map[*subscriber]struct{}{},
+		bufferSize:  bufferSize,
+	}
+}
+
+//OnDecision implements DecisionListener.
+func (h *Hub) OnDecision(_ context.Context, event model.Event) {
+	h.Publish(event)
+}
+
+//Publish records event and delivers it to every matching subscriber without blocking.
+func (h *Hub) Publish(event model.Event) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.lastID++
+	se := streamEvent{ID: h.lastID, Event: event}
+	if len(h.ring) < cap(h.ring) {
+		h.ring = append(h.ring, se)
+	} else {
+		h.ring[h.next] = se
+		h.next = (h.next + 1) % cap(h.ring)
+	}
+	for sub := range h.subscribers {
+		if !sub.filter.match(event) {
+			continue
+		}
+		select {
+		case sub.events <- se:
+		default:
+			if sub.policy == PolicyDrop {
+				sub.dropped++
+				continue
+			}
+			h.remove(sub)
+		}
+	}
+}
+
+//subscribe registers a subscriber and returns the retained decisions newer than
+//lastID that it should replay first. Both happen under the lock, so nothing
+//published in between is lost or repeated.
+func (h *Hub) subscribe(filter StreamFilter, policy string, lastID uint64) (*subscriber, []streamEvent) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	sub := &subscriber{
+		events: make(chan streamEvent, h.bufferSize),
+		filter: filter,
+		policy: policy,
+	}
+	h.subscribers[sub] = struct{}{}
+	if h.closed {
+		h.remove(sub)
+	}
+
+	replay := []streamEvent{}
+	for i := 0; i < len(h.ring); i++ {
+		se := h.ring[(h.next+i)%len(h.ring)]
+		if se.ID > lastID && filter.match(se.Event) {
+			replay = append(replay, se)
+		}
+	}
+	return sub, replay
+}
+
+//unsubscribe removes sub and returns how many events it dropped.
+func (h *Hub) unsubscribe(sub *subscriber) uint64 {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.remove(sub)
+	return sub.dropped
+}
+
+//Close ends every stream so a shutdown does not wait for them, clients resume
+//elsewhere with Last-Event-ID. Streams opened afterwards end after the replay.
+func (h *Hub) Close() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		h.remove(sub)
+	}
+}
+
+func (h *Hub) isClosed() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.closed
+}
+
+func (h *Hub) remove(sub *subscriber) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(h.subscribers, sub)
+	close(sub.events)
+}
+
+//MakeStreamHandler serves decisions as Server-Sent Events. It must not be
+//wrapped in http.TimeoutHandler, which buffers the response.
+func MakeStreamHandler(hub *Hub, logger log.Logger, heartbeat time.Duration) http.Handler {
+	if heartbeat <= 0 {
+		heartbeat = 15 * time.Second
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			encodeError(r.Context(), fmt.Errorf("streaming unsupported"), w)
+			return
+		}
+		params := r.URL.Query()
+		filter := StreamFilter{
+			Door:     params.Get("door"),
+			Username: params.Get("user"),
+			Outcome:  params.Get("outcome"),
+		}
+		policy := params.Get("policy")
+		if policy == "" {
+			policy = PolicyDisconnect
+		}
+		if policy != PolicyDisconnect && policy != PolicyDrop {
+			encodeError(r.Context(), errBadRequest, w)
+			return
+		}
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = params.Get("lastEventId")
+		}
+		var lastID uint64
+		if lastEventID != "" {
+			var err error
+			if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+				encodeError(r.Context(), errBadRequest, w)
+				return
+			}
+		}
+
+		sub, replay := hub.subscribe(filter, policy, lastID)
+		defer func() {
+			if dropped := hub.unsubscribe(sub); dropped > 0 {
+				logger.Log("method", "EventStream", "dropped", dropped)
+			}
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		for _, se := range replay {
+			if err := writeStreamEvent(w, se); err != nil {
+				return
+			}
+			lastID = se.ID
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case se, ok := <-sub.events:
+				if !ok {
+					if !hub.isClosed() {
+						logger.Log("method", "EventStream", "msg", "subscriber too slow, disconnecting", "lastEventId", lastID)
+					}
+					return
+				}
+				if err := writeStreamEvent(w, se); err != nil {
+					return
+				}
+				lastID = se.ID
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func writeStreamEvent(w http.ResponseWriter, se streamEvent) error {
+	data, err := json.Marshal(se.Event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: decision\ndata: %s\n\n", se.ID, data)
+	return err
+}
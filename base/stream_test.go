@@ -0,0 +1,191 @@
+package base
+
+import (
+	"accessdoor/model"
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func streamIDs(events []streamEvent) []uint64 {
+	ids := []uint64{}
+	for _, se := range events {
+		ids = append(ids, se.ID)
+	}
+	return ids
+}
+
+func TestHubReplay(t *testing.T) {
+	hub := NewHub(3, 8)
+	for _, door := range []string{"Door1", "Door2", "Door1", "Door2", "Door1"} {
+		hub.Publish(model.Event{Username: "abc", Door: door, Outcome: model.OutcomeGranted})
+	}
+	tests := []struct {
+		name   string
+		filter StreamFilter
+		lastID uint64
+		replay []uint64
+	}{
+		{name: "ring only keeps the newest", lastID: 0, replay: []uint64{3, 4, 5}},
+		{name: "resumes after last id", lastID: 3, replay: []uint64{4, 5}},
+		{name: "nothing newer", lastID: 5, replay: []uint64{}},
+		{name: "filtered", filter: StreamFilter{Door: "Door1"}, lastID: 0, replay: []uint64{3, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, replay := hub.subscribe(tt.filter, PolicyDisconnect, tt.lastID)
+			defer hub.unsubscribe(sub)
+			if diff := cmp.Diff(streamIDs(replay), tt.replay); diff != "" {
+				t.Fatalf("replay differs: (-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStreamFilterMatch(t *testing.T) {
+	event := model.Event{Username: "abc", Door: "Door1", Outcome: model.OutcomeDenied}
+	tests := []struct {
+		name   string
+		filter StreamFilter
+		match  bool
+	}{
+		{name: "empty", filter: StreamFilter{}, match: true},
+		{name: "door", filter: StreamFilter{Door: "Door1"}, match: true},
+		{name: "other door", filter: StreamFilter{Door: "Door2"}, match: false},
+		{name: "user and outcome", filter: StreamFilter{Username: "abc", Outcome: model.OutcomeDenied}, match: true},
+		{name: "other outcome", filter: StreamFilter{Username: "abc", Outcome: model.OutcomeGranted}, match: false},
+		{name: "other user", filter: StreamFilter{Username: "def"}, match: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.match(event); got != tt.match {
+				t.Fatalf("expected %v, got %v", tt.match, got)
+			}
+		})
+	}
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	hub := NewHub(8, 1)
+	disconnect, _ := hub.subscribe(StreamFilter{}, PolicyDisconnect, 0)
+	drop, _ := hub.subscribe(StreamFilter{}, PolicyDrop, 0)
+	other, _ := hub.subscribe(StreamFilter{Door: "Door2"}, PolicyDisconnect, 0)
+	hub.Publish(model.Event{Door: "Door1"})
+	hub.Publish(model.Event{Door: "Door1"})
+
+	if se := <-disconnect.events; se.ID != 1 {
+		t.Fatalf("expected event 1 before the disconnect, got %v", se.ID)
+	}
+	if _, ok := <-disconnect.events; ok {
+		t.Fatal("expected the slow subscriber to be disconnected")
+	}
+	if dropped := hub.unsubscribe(drop); dropped != 1 {
+		t.Fatalf("expected 1 dropped event, got %v", dropped)
+	}
+	if se := <-drop.events; se.ID != 1 {
+		t.Fatalf("expected event 1 to be kept, got %v", se.ID)
+	}
+	if other.closed {
+		t.Fatal("expected a subscriber not matching the events to stay")
+	}
+}
+
+func TestStreamHandlerLastEventID(t *testing.T) {
+	hub := NewHub(8, 8)
+	for _, door := range []string{"Door1", "Door2", "Door1"} {
+		hub.Publish(model.Event{Username: "abc", Door: door})
+	}
+	server := httptest.NewServer(MakeStreamHandler(hub, log.NewNopLogger(), time.Minute))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"?door=Door1", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	//a live decision follows the replay, then closing the hub ends the stream
+	hub.Publish(model.Event{Username: "abc", Door: "Door1"})
+	ids := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "id: ") {
+			ids = append(ids, strings.TrimPrefix(scanner.Text(), "id: "))
+			if len(ids) == 2 {
+				hub.Close()
+			}
+		}
+	}
+	if diff := cmp.Diff(ids, []string{"3", "4"}); diff != "" {
+		t.Fatalf("ids differ: (-got +want)\n%s", diff)
+	}
+}
+
+func TestStreamHandlerBadRequest(t *testing.T) {
+	hub := NewHub(8, 8)
+	for _, query := range []string{"?policy=wait", "?lastEventId=abc"} {
+		w := httptest.NewRecorder()
+		MakeStreamHandler(hub, log.NewNopLogger(), time.Minute).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %v", query, w.Code)
+		}
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub(8, 8)
+	hub.Publish(model.Event{Door: "Door1"})
+	live, _ := hub.subscribe(StreamFilter{}, PolicyDisconnect, 0)
+	hub.Close()
+	if _, ok := <-live.events; ok {
+		t.Fatal("expected the live subscriber to be ended")
+	}
+	//closing twice and unsubscribing after the close are fine
+	hub.Close()
+	hub.unsubscribe(live)
+
+	//a stream opened after the close gets its replay, then ends
+	hub.Publish(model.Event{Door: "Door1"})
+	late, replay := hub.subscribe(StreamFilter{}, PolicyDisconnect, 0)
+	if diff := cmp.Diff([]uint64{1, 2}, streamIDs(replay)); diff != "" {
+		t.Fatalf("replay mismatch (-want +got):\n%s", diff)
+	}
+	if _, ok := <-late.events; ok {
+		t.Fatal("expected a subscriber after the close to be ended")
+	}
+}
+
+func TestHubCloseOnShutdown(t *testing.T) {
+	hub := NewHub(8, 8)
+	server := httptest.NewUnstartedServer(MakeStreamHandler(hub, log.NewNopLogger(), time.Minute))
+	server.Config.RegisterOnShutdown(hub.Close)
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	//the stream would run until the client leaves, the shutdown ends it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("expected the shutdown to drain the stream, got %v", err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+}
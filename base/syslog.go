@@ -0,0 +1,114 @@
+package base
+
+import (
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//rfc5424Time is the TIMESTAMP of RFC 5424, at most microseconds.
+const rfc5424Time = "2006-01-02T15:04:05.000000Z07:00"
+
+//SyslogConn sends RFC 5424 messages to a syslog server, one datagram per
+//message over UDP and octet counted as in RFC 6587 over TCP. A write that
+//fails redials once, so a restarted server is picked up again.
+type SyslogConn struct {
+	mtx      sync.Mutex
+	network  string
+	addr     string
+	facility syslog.Priority
+	header   string
+	conn     net.Conn
+	now      func() time.Time
+}
+
+//DialSyslog connects to addr. facility is one of the syslog.LOG_ facilities,
+//app is the APP-NAME of every message.
+func DialSyslog(network, addr string, facility syslog.Priority, app string) (*SyslogConn, error) {
+	hostname, _ := os.Hostname()
+	c := &SyslogConn{
+		network:  network,
+		addr:     addr,
+		facility: facility &^ 7,
+		header:   headerField(hostname, 255) + " " + headerField(app, 48) + " " + strconv.Itoa(os.Getpid()),
+		now:      time.Now,
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *SyslogConn) connect() error {
+	conn, err := net.Dial(c.network, c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+//WriteSyslog implements SyslogWriter.
+func (c *SyslogConn) WriteSyslog(severity syslog.Priority, sd, msg string) error {
+	frame := c.frame(severity, sd, msg)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn != nil {
+		if _, err := c.conn.Write(frame); err == nil {
+			return nil
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+	if err := c.connect(); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+//frame is <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG without a MSGID.
+func (c *SyslogConn) frame(severity syslog.Priority, sd, msg string) []byte {
+	if sd == "" {
+		sd = "-"
+	}
+	line := "<" + strconv.Itoa(int(c.facility|severity&7)) + ">1 " + c.now().UTC().Format(rfc5424Time) +
+		" " + c.header + " - " + sd
+	if msg != "" {
+		line += " " + msg
+	}
+	if c.network == "tcp" || c.network == "tcp4" || c.network == "tcp6" {
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+	return []byte(line)
+}
+
+//Close ...
+func (c *SyslogConn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+//headerField keeps the printable ASCII an RFC 5424 header field allows, at
+//most max characters, and is the nil value - when nothing is left.
+func headerField(val string, max int) string {
+	field := make([]byte, 0, len(val))
+	for i := 0; i < len(val) && len(field) < max; i++ {
+		if c := val[i]; c > ' ' && c < 127 {
+			field = append(field, c)
+		}
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
@@ -0,0 +1,185 @@
+package base
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Client certificate modes of the API listener. With ClientAuthRequire the
+//handshake still accepts clients without a certificate, so the Consul health
+//check gets through, and RequireClientCert rejects their other requests.
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+//keyPairCheckInterval limits how often the certificate files are checked for
+//changes.
+const keyPairCheckInterval = time.Second
+
+var errClientCertRequired = errors.New("client certificate required")
+
+//KeyPair serves a certificate and key read from files. The files are read
+//again when they change, so a rotated certificate is used for new handshakes
+//without a restart. A pair that fails to load keeps the previous one in use.
+type KeyPair struct {
+	certFile string
+	keyFile  string
+	mtx      sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+//LoadKeyPair ...
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	k := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+//load reads the pair. k.mtx must be held or k not shared yet.
+func (k *KeyPair) load() error {
+	modTime, err := k.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading %v: %v", k.certFile, err)
+	}
+	k.cert, k.modTime, k.checked = &cert, modTime, time.Now()
+	return nil
+}
+
+func (k *KeyPair) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, path := range []string{k.certFile, k.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+//Certificate returns the current certificate, reading the files again when
+//they changed.
+func (k *KeyPair) Certificate() *tls.Certificate {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if time.Since(k.checked) < keyPairCheckInterval {
+		return k.cert
+	}
+	k.checked = time.Now()
+	if modTime, err := k.lastModified(); err == nil && !modTime.Equal(k.modTime) {
+		k.load()
+	}
+	return k.cert
+}
+
+//GetCertificate implements tls.Config.GetCertificate.
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+//GetClientCertificate implements tls.Config.GetClientCertificate.
+func (k *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+//LoadCertPool reads PEM encoded CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %v", path)
+	}
+	return pool, nil
+}
+
+//ServerTLSConfig serves keyPair. Client certificates are verified against the
+//CAs in clientCAFile according to clientAuth, one of the ClientAuth modes.
+func ServerTLSConfig(keyPair *KeyPair, clientCAFile, clientAuth string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: keyPair.GetCertificate,
+	}
+	switch clientAuth {
+	case ClientAuthNone, "":
+		return config, nil
+	case ClientAuthOptional, ClientAuthRequire:
+	default:
+		return nil, fmt.Errorf("unknown client auth %q", clientAuth)
+	}
+	pool, err := LoadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+//ClientTLSConfig verifies servers against the CAs in caFile, the system ones
+//when it is empty, and presents keyPair when it is not nil.
+func ClientTLSConfig(caFile string, keyPair *KeyPair) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if keyPair != nil {
+		config.GetClientCertificate = keyPair.GetClientCertificate
+	}
+	return config, nil
+}
+
+//RequireClientCert rejects requests without a verified client certificate,
+//except for the paths in exempt and below them, so /healthcheck covers the
+//dependency checks at /healthcheck/<dependency> too.
+func RequireClientCert(next http.Handler, exempt ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range exempt {
+			if r.URL.Path == path || strings.HasPrefix(r.URL.Path, path+"/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			encodeError(r.Context(), errClientCertRequired, w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//newTransport returns a transport with its own connection pool, using
+//tlsConfig for https upstreams when it is not nil.
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport
+}
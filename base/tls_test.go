@@ -0,0 +1,347 @@
+package base
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+)
+
+//testCA issues certificates for the tests, all of them in one directory.
+type testCA struct {
+	t      *testing.T
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key = ca.issue("ca", nil, nil, true)
+	ca.write("ca.pem", "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+func (ca *testCA) issue(name string, ips []net.IP, usage []x509.ExtKeyUsage, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           ips,
+		ExtKeyUsage:           usage,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (ca *testCA) write(name, block string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: block, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+//pair issues a certificate and writes it to name.pem and name-key.pem.
+func (ca *testCA) pair(name string, usage ...x509.ExtKeyUsage) (string, string, *x509.Certificate) {
+	cert, key := ca.issue(name, []net.IP{net.ParseIP("127.0.0.1")}, usage, false)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return ca.write(name+".pem", "CERTIFICATE", cert.Raw), ca.write(name+"-key.pem", "EC PRIVATE KEY", der), cert
+}
+
+func TestKeyPairRotation(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile, first := ca.pair("server", x509.ExtKeyUsageServerAuth)
+	k, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		leaf, err := x509.ParseCertificate(k.Certificate().Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+	//rotate writes a pair over the files with a newer modification time
+	rotate := func(cert, key []byte) {
+		for path, data := range map[string][]byte{certFile: cert, keyFile: key} {
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			later := time.Now().Add(time.Minute)
+			if err := os.Chtimes(path, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if s := serial(); s != first.SerialNumber.Int64() {
+		t.Fatalf("expected serial %v, got %v", first.SerialNumber, s)
+	}
+
+	_, _, second := ca.pair("rotated", x509.ExtKeyUsageServerAuth)
+	cert, _ := ioutil.ReadFile(filepath.Join(ca.dir, "rotated.pem"))
+	key, _ := ioutil.ReadFile(filepath.Join(ca.dir, "rotated-key.pem"))
+	rotate(cert, key)
+	//the files are not looked at again within keyPairCheckInterval
+	if s := serial(); s != first.SerialNumber.Int64() {
+		t.Fatalf("expected serial %v before the check interval, got %v", first.SerialNumber, s)
+	}
+	k.checked = time.Time{}
+	if s := serial(); s != second.SerialNumber.Int64() {
+		t.Fatalf("expected the rotated serial %v, got %v", second.SerialNumber, s)
+	}
+
+	//a broken pair keeps the last good one in use
+	rotate([]byte("not a certificate"), key)
+	k.checked = time.Time{}
+	if s := serial(); s != second.SerialNumber.Int64() {
+		t.Fatalf("expected serial %v to stay, got %v", second.SerialNumber, s)
+	}
+
+	if _, err := LoadKeyPair(filepath.Join(ca.dir, "missing.pem"), keyFile); err == nil {
+		t.Error("expected an error for a missing certificate")
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	h := RequireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/healthcheck")
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	tests := []struct {
+		path string
+		tls  *tls.ConnectionState
+		code int
+	}{
+		{path: "/healthcheck", code: http.StatusOK},
+		{path: "/healthcheck/users", code: http.StatusOK},
+		{path: "/healthcheckz", code: http.StatusUnauthorized},
+		{path: "/dooraccess/v2/doors", code: http.StatusUnauthorized},
+		{path: "/dooraccess/v2/doors", tls: &tls.ConnectionState{}, code: http.StatusUnauthorized},
+		{path: "/dooraccess/v2/doors", tls: verified, code: http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.TLS = test.tls
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%v with %v: expected %v, got %v", test.path, test.tls, test.code, w.Code)
+		}
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile, _ := ca.pair("server", x509.ExtKeyUsageServerAuth)
+	k, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(ca.dir, "ca.pem")
+	tests := []struct {
+		clientAuth string
+		caFile     string
+		mode       tls.ClientAuthType
+		pool       bool
+		err        bool
+	}{
+		{clientAuth: "", mode: tls.NoClientCert},
+		{clientAuth: ClientAuthNone, caFile: caFile, mode: tls.NoClientCert},
+		{clientAuth: ClientAuthOptional, caFile: caFile, mode: tls.VerifyClientCertIfGiven, pool: true},
+		{clientAuth: ClientAuthRequire, caFile: caFile, mode: tls.VerifyClientCertIfGiven, pool: true},
+		{clientAuth: ClientAuthRequire, err: true},
+		{clientAuth: ClientAuthRequire, caFile: certFile + ".missing", err: true},
+		{clientAuth: "always", caFile: caFile, err: true},
+	}
+	for _, test := range tests {
+		config, err := ServerTLSConfig(k, test.caFile, test.clientAuth)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.clientAuth, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if config.ClientAuth != test.mode || (config.ClientCAs != nil) != test.pool || config.MinVersion != tls.VersionTLS12 {
+			t.Errorf("%q: unexpected client auth %v with pool %v", test.clientAuth, config.ClientAuth, config.ClientCAs != nil)
+		}
+	}
+}
+
+func TestClientCertHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile, _ := ca.pair("server", x509.ExtKeyUsageServerAuth)
+	serverPair, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(ca.dir, "ca.pem")
+	serverConfig, err := ServerTLSConfig(serverPair, caFile, ClientAuthRequire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//StartTLS would put its own certificate in front of GetCertificate
+	server := httptest.NewUnstartedServer(RequireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/healthcheck"))
+	server.Listener = tls.NewListener(server.Listener, serverConfig)
+	server.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	server.Start()
+	defer server.Close()
+	url := "https://" + server.Listener.Addr().String()
+
+	certFile, keyFile, _ = ca.pair("controller", x509.ExtKeyUsageClientAuth)
+	clientPair, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		keyPair *KeyPair
+		path    string
+		code    int
+	}{
+		{name: "Client certificate", keyPair: clientPair, path: "/dooraccess/v2/doors", code: http.StatusOK},
+		{name: "No client certificate", path: "/dooraccess/v2/doors", code: http.StatusUnauthorized},
+		{name: "Health check without a certificate", path: "/healthcheck", code: http.StatusOK},
+		{name: "Dependency check without a certificate", path: "/healthcheck/users", code: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ClientTLSConfig(caFile, test.keyPair)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: newTransport(config)}
+			resp, err := client.Get(url + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.code {
+				t.Errorf("expected %v, got %v", test.code, resp.StatusCode)
+			}
+		})
+	}
+
+	//the system CAs do not know the test CA
+	config, err := ClientTLSConfig("", clientPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: newTransport(config)}).Get(url + "/healthcheck"); err == nil {
+		t.Error("expected the server certificate to be rejected")
+	}
+}
+
+//fakeConsul answers the agent registration and health calls of the Consul API.
+type fakeConsul struct {
+	registered api.AgentServiceRegistration
+	healthy    []*api.ServiceEntry
+	status     int
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/agent/service/register":
+		json.NewDecoder(r.Body).Decode(&c.registered)
+	case "/v1/health/service/users":
+		json.NewEncoder(w).Encode(c.healthy)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestConsulSchemeMetadata(t *testing.T) {
+	consul := &fakeConsul{}
+	server := httptest.NewServer(consul)
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	client, registrar, err := Register("dooraccess", addr, "https", "10.0.0.1", 8090, nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar.Register()
+	if scheme := consul.registered.Meta[MetaScheme]; scheme != "https" {
+		t.Errorf("expected the scheme metadata https, got %q", scheme)
+	}
+	if check := consul.registered.Checks[0]; check.HTTP != "https://10.0.0.1:8090/healthcheck" {
+		t.Errorf("unexpected health check %v", check.HTTP)
+	}
+
+	tests := []struct {
+		name     string
+		healthy  []*api.ServiceEntry
+		status   int
+		instance *api.AgentService
+		err      bool
+	}{
+		{
+			name:     "Instance",
+			healthy:  []*api.ServiceEntry{{Service: &api.AgentService{Address: "10.0.0.2", Port: 8080, Meta: map[string]string{MetaScheme: "https", MetaTLSServerName: "users.internal"}}}},
+			instance: &api.AgentService{Address: "10.0.0.2", Port: 8080, Meta: map[string]string{MetaScheme: "https", MetaTLSServerName: "users.internal"}},
+		},
+		{name: "No healthy instance", healthy: []*api.ServiceEntry{}, err: true},
+		{name: "Consul error", status: http.StatusInternalServerError, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			consul.healthy, consul.status = test.healthy, test.status
+			instance, err := HealthyInstance(client, "users")
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if instance.Address != test.instance.Address || instance.Port != test.instance.Port ||
+				instance.Meta[MetaScheme] != test.instance.Meta[MetaScheme] || instance.Meta[MetaTLSServerName] != test.instance.Meta[MetaTLSServerName] {
+				t.Errorf("unexpected instance %+v", instance)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package base
+
+import (
+	"accessdoor/model"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	eventmodel "events/model"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+)
+
+//SpanKind follows the OTLP enum.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+const (
+	headerTraceParent = "traceparent"
+	headerTraceState  = "tracestate"
+)
+
+//SpanExporter receives every sampled span once it has ended. Export must not block.
+type SpanExporter interface {
+	Export(span *Span)
+}
+
+//Tracer starts spans and hands the sampled ones to the exporter. Spans are
+//created and propagated even without an exporter, so trace context always
+//flows through to users-go and events-go.
+type Tracer struct {
+	exporter    SpanExporter
+	sampleRatio float64
+}
+
+//NewTracer samples sampleRatio of the traces started here. Traces continued
+//from an inbound traceparent keep the caller's decision.
+func NewTracer(exporter SpanExporter, sampleRatio float64) *Tracer {
+	return &Tracer{exporter: exporter, sampleRatio: sampleRatio}
+}
+
+//Span is a timed operation within a trace.
+type Span struct {
+	mtx        sync.Mutex
+	tracer     *Tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	sampled    bool
+	remote     bool
+	traceState string
+	name       string
+	kind       SpanKind
+	start      time.Time
+	end        time.Time
+	attributes []spanAttribute
+	err        error
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+//Start begins a span that is a child of the span in ctx, if any.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(span.spanID[:])
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.sampled = parent.sampled
+		span.traceState = parent.traceState
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = t.sampleRatio >= 1 || mathrand.Float64() < t.sampleRatio
+	}
+	return context.WithValue(ctx, contextKeySpan, span), span
+}
+
+//SpanFromContext ...
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKeySpan).(*Span)
+	return span
+}
+
+//TraceID is the hex trace id, empty for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+//SetName ...
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.name = name
+	s.mtx.Unlock()
+}
+
+//SetAttribute sets key, replacing an earlier value.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i := range s.attributes {
+		if s.attributes[i].key == key {
+			s.attributes[i].value = value
+			return
+		}
+	}
+	s.attributes = append(s.attributes, spanAttribute{key: key, value: value})
+}
+
+//End records err as the span status and exports the span if it is sampled.
+//Only the first call counts.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if !s.end.IsZero() {
+		s.mtx.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.mtx.Unlock()
+	if s.sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+func (s *Span) traceParent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+//parseTraceParent reads a W3C traceparent into a remote parent span. Versions
+//above 00 are read by their 00 prefix as the spec asks.
+func parseTraceParent(traceParent, traceState string) (*Span, bool) {
+	if len(traceParent) < 55 || (len(traceParent) > 55 && traceParent[55] != '-') {
+		return nil, false
+	}
+	parts := strings.Split(traceParent[:55], "-")
+	if len(parts) != 4 || parts[0] == "ff" || (parts[0] == "00" && len(traceParent) != 55) {
+		return nil, false
+	}
+	span := &Span{remote: true, traceState: traceState}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || strings.ToLower(parts[1]) != parts[1] || strings.ToLower(parts[2]) != parts[2] {
+		return nil, false
+	}
+	if n, err := hex.Decode(span.traceID[:], []byte(parts[1])); err != nil || n != 16 || span.traceID == [16]byte{} {
+		return nil, false
+	}
+	if n, err := hex.Decode(span.spanID[:], []byte(parts[2])); err != nil || n != 8 || span.spanID == [8]byte{} {
+		return nil, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return nil, false
+	}
+	span.sampled = flags[0]&1 == 1
+	if len(span.traceState) > 512 {
+		span.traceState = ""
+	}
+	return span, true
+}
+
+//setTraceHeaders propagates the span in ctx to an outbound request.
+func setTraceHeaders(ctx context.Context, r *http.Request) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	r.Header.Set(headerTraceParent, span.traceParent())
+	if span.traceState != "" {
+		r.Header.Set(headerTraceState, span.traceState)
+	}
+}
+
+//NewTracingHandler starts a server span for every inbound request, continuing
+//the caller's trace when it sends a valid traceparent. Routers built with
+//newRouter rename it after the matched route template.
+func NewTracingHandler(t *Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := parseTraceParent(r.Header.Get(headerTraceParent), r.Header.Get(headerTraceState)); ok {
+			ctx = context.WithValue(ctx, contextKeySpan, parent)
+		}
+		ctx, span := t.Start(ctx, r.Method, SpanKindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttribute("http.status_code", sw.status)
+		var err error
+		if sw.status >= http.StatusInternalServerError {
+			err = errorStatus(sw.status)
+		}
+		span.End(err)
+	})
+}
+
+//TraceRoute names the request span after the route template mux matched.
+func TraceRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if span := SpanFromContext(r.Context()); span != nil && !span.remote {
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					span.SetName(r.Method + " " + template)
+					span.SetAttribute("http.route", template)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//newRouter is mux.NewRouter with route names on request spans and metrics.
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(TraceRoute)
+	MeasureRoutes(r)
+	return r
+}
+
+type errorStatus int
+
+func (e errorStatus) Error() string {
+	return http.StatusText(int(e))
+}
+
+//statusWriter remembers the status code and the size of the body. It keeps
+//http.Flusher working for the streaming routes and http.Hijacker for upgrades.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+//traceProxyCall wraps a single proxy attempt in a client span. The span is in
+//the context the request encoder sees, so setRequestHeaders propagates it.
+func traceProxyCall(t *Tracer, method string, u *url.URL, next endpoint.Endpoint) endpoint.Endpoint {
+	if t == nil {
+		return next
+	}
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		ctx, span := t.Start(ctx, method+" "+u.Host+u.Path, SpanKindClient)
+		span.SetAttribute("http.method", method)
+		span.SetAttribute("http.url", u.String())
+		response, err := next(ctx, request)
+		span.End(err)
+		return response, err
+	}
+}
+
+//traceProxyResponse records the upstream status code on the attempt span.
+func traceProxyResponse(ctx context.Context, r *http.Response) context.Context {
+	SpanFromContext(ctx).SetAttribute("http.status_code", r.StatusCode)
+	return ctx
+}
+
+//NewTracingMiddleware adds a span per service method around next. main puts
+//one around every middleware layer, named after the layer, so each layer's span
+//is a child of the one around it.
+func NewTracingMiddleware(t *Tracer, layer string) Middleware {
+	return func(next Service) Service {
+		return tracingMiddleware{next: next, tracer: t, layer: layer}
+	}
+}
+
+type tracingMiddleware struct {
+	next   Service
+	tracer *Tracer
+	layer  string
+}
+
+func (mw tracingMiddleware) Check(ctx context.Context) (res bool, err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".Check", SpanKindInternal)
+	defer func() { span.End(err) }()
+	return mw.next.Check(ctx)
+}
+
+func (mw tracingMiddleware) GetUser(ctx context.Context, query model.EventQuery) (res model.UserEvents, err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".GetUser", SpanKindInternal)
+	span.SetAttribute("username", query.Username)
+	defer func() { span.End(err) }()
+	return mw.next.GetUser(ctx, query)
+}
+
+func (mw tracingMiddleware) UpdateUserAccess(ctx context.Context, req usermodel.UpdateAccessRequest) (err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".UpdateUserAccess", SpanKindInternal)
+	span.SetAttribute("username", req.Username)
+	defer func() { span.End(err) }()
+	return mw.next.UpdateUserAccess(ctx, req)
+}
+
+//DoorAuthenticate records a denial in the outcome attribute, only a failure to
+//decide is an error.
+func (mw tracingMiddleware) DoorAuthenticate(ctx context.Context, req model.AuthenticateRequest) (event model.Event, err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".DoorAuthenticate", SpanKindInternal)
+	span.SetAttribute("username", req.Username)
+	span.SetAttribute("door", req.AccessDoor)
+	defer func() {
+		span.SetAttribute("outcome", event.Outcome)
+		if IsAccessDenied(err) {
+			span.End(nil)
+			return
+		}
+		span.End(err)
+	}()
+	return mw.next.DoorAuthenticate(ctx, req)
+}
+
+//NewUsersProxyTracingMiddleware adds a span per users-go call around next, one
+//per middleware layer like NewTracingMiddleware.
+func NewUsersProxyTracingMiddleware(t *Tracer, layer string) UsersProxy {
+	return func(next UsersService) UsersService {
+		return usersTracingMiddleware{next: next, tracer: t, layer: layer}
+	}
+}
+
+type usersTracingMiddleware struct {
+	next   UsersService
+	tracer *Tracer
+	layer  string
+}
+
+func (mw usersTracingMiddleware) GetUser(ctx context.Context, username string) (resp usermodel.User, err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".GetUser", SpanKindInternal)
+	span.SetAttribute("username", username)
+	defer func() { span.End(err) }()
+	return mw.next.GetUser(ctx, username)
+}
+
+func (mw usersTracingMiddleware) UpdateUserAccess(ctx context.Context, req usermodel.UpdateAccessRequest) (resp string, err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".UpdateUserAccess", SpanKindInternal)
+	span.SetAttribute("username", req.Username)
+	defer func() { span.End(err) }()
+	return mw.next.UpdateUserAccess(ctx, req)
+}
+
+func (mw usersTracingMiddleware) DoorAuthenticate(ctx context.Context, req usermodel.DoorAuthenticate) (resp string, err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".DoorAuthenticate", SpanKindInternal)
+	span.SetAttribute("username", req.Username)
+	span.SetAttribute("door", req.AccessDoor)
+	defer func() { span.End(err) }()
+	return mw.next.DoorAuthenticate(ctx, req)
+}
+
+//NewEventsProxyTracingMiddleware adds a span per events-go call around next, one
+//per middleware layer like NewTracingMiddleware.
+func NewEventsProxyTracingMiddleware(t *Tracer, layer string) EventsProxy {
+	return func(next EventsService) EventsService {
+		return eventsTracingMiddleware{next: next, tracer: t, layer: layer}
+	}
+}
+
+type eventsTracingMiddleware struct {
+	next   EventsService
+	tracer *Tracer
+	layer  string
+}
+
+func (mw eventsTracingMiddleware) GetEvents(ctx context.Context, query model.EventQuery) (resp eventmodel.Events, err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".GetEvents", SpanKindInternal)
+	span.SetAttribute("username", query.Username)
+	defer func() { span.End(err) }()
+	return mw.next.GetEvents(ctx, query)
+}
+
+func (mw eventsTracingMiddleware) UpdateEvents(ctx context.Context, request eventmodel.UpdateEventRequest) (err error) {
+	ctx, span := mw.tracer.Start(ctx, mw.layer+".UpdateEvents", SpanKindInternal)
+	span.SetAttribute("username", request.Username)
+	defer func() { span.End(err) }()
+	return mw.next.UpdateEvents(ctx, request)
+}
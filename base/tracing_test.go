@@ -0,0 +1,281 @@
+package base
+
+import (
+	"accessdoor/model"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name        string
+		traceParent string
+		traceState  string
+		ok          bool
+		sampled     bool
+		state       string
+	}{
+		{name: "Sampled", traceParent: "00-" + traceID + "-" + spanID + "-01", traceState: "congo=t61rcWkgMzE", ok: true, sampled: true, state: "congo=t61rcWkgMzE"},
+		{name: "Not sampled", traceParent: "00-" + traceID + "-" + spanID + "-00", ok: true},
+		{name: "Other flags", traceParent: "00-" + traceID + "-" + spanID + "-03", ok: true, sampled: true},
+		{name: "Future version with more fields", traceParent: "01-" + traceID + "-" + spanID + "-01-extra", ok: true, sampled: true},
+		{name: "Future version", traceParent: "cc-" + traceID + "-" + spanID + "-01", ok: true, sampled: true},
+		{name: "Version 00 with more fields", traceParent: "00-" + traceID + "-" + spanID + "-01-extra"},
+		{name: "Version ff", traceParent: "ff-" + traceID + "-" + spanID + "-01"},
+		{name: "Upper case", traceParent: "00-" + strings.ToUpper(traceID) + "-" + spanID + "-01"},
+		{name: "Zero trace id", traceParent: "00-" + strings.Repeat("0", 32) + "-" + spanID + "-01"},
+		{name: "Zero span id", traceParent: "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01"},
+		{name: "Not hex", traceParent: "00-" + traceID + "-" + spanID + "-0x"},
+		{name: "Short", traceParent: "00-" + traceID + "-" + spanID[:15] + "-01"},
+		{name: "Empty"},
+		{name: "Long trace state dropped", traceParent: "00-" + traceID + "-" + spanID + "-01", traceState: strings.Repeat("a", 513), ok: true, sampled: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			span, ok := parseTraceParent(test.traceParent, test.traceState)
+			if ok != test.ok {
+				t.Fatalf("expected ok %v, got %v", test.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if span.TraceID() != traceID || span.sampled != test.sampled || span.traceState != test.state || !span.remote {
+				t.Errorf("unexpected span trace %v sampled %v state %q remote %v", span.TraceID(), span.sampled, span.traceState, span.remote)
+			}
+			//a child keeps the trace and the sampling decision of the remote span
+			ctx := context.WithValue(context.Background(), contextKeySpan, span)
+			_, child := NewTracer(nil, 0).Start(ctx, "child", SpanKindServer)
+			if child.traceID != span.traceID || child.parentID != span.spanID || child.sampled != test.sampled {
+				t.Errorf("unexpected child traceparent %v", child.traceParent())
+			}
+		})
+	}
+}
+
+//hijackRecorder is a ResponseRecorder that can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+func TestStatusWriterHijack(t *testing.T) {
+	h := NewTracingHandler(NewTracer(nil, 1), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("expected the traced response writer to be an http.Hijacker")
+		}
+		if _, _, err := h.Hijack(); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if !w.hijacked {
+		t.Error("expected the connection to be hijacked")
+	}
+
+	sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	if _, _, err := sw.Hijack(); err == nil {
+		t.Error("expected an error from a writer that cannot be hijacked")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var mtx sync.Mutex
+	posted := []otlpRequest{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mtx.Lock()
+		posted = append(posted, req)
+		mtx.Unlock()
+	}))
+	defer collector.Close()
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewOTLPExporter(OTLPConfig{Endpoint: collector.URL, Path: path, BatchSize: 2, Interval: time.Hour}, "accessdoor", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(exporter, 1)
+	ctx, root := tracer.Start(context.Background(), "GET /healthcheck", SpanKindServer)
+	root.SetAttribute("http.status_code", 200)
+	root.SetAttribute("http.status_code", 503)
+	names := []string{"Check", "GetUserProxy", "GetEvents", "UpdateEvents"}
+	for i, name := range names {
+		_, span := tracer.Start(ctx, name, SpanKindInternal)
+		var err error
+		if i == 1 {
+			err = errors.New("users-go unavailable")
+		}
+		span.End(err)
+	}
+	root.End(nil)
+	//nothing is exported twice
+	root.End(errors.New("late"))
+	if err := exporter.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	//spans after Close are dropped
+	_, late := tracer.Start(context.Background(), "late", SpanKindInternal)
+	late.End(nil)
+
+	spans := func(requests []otlpRequest) ([]int, []otlpSpan) {
+		sizes := []int{}
+		all := []otlpSpan{}
+		for _, req := range requests {
+			batch := req.ResourceSpans[0].ScopeSpans[0].Spans
+			sizes = append(sizes, len(batch))
+			all = append(all, batch...)
+		}
+		return sizes, all
+	}
+	sizes, got := spans(posted)
+	if diff := cmp.Diff([]int{2, 2, 1}, sizes); diff != "" {
+		t.Fatalf("batch sizes mismatch (-want +got):\n%s", diff)
+	}
+	want := []otlpSpan{}
+	for i, name := range append(names, "GET /healthcheck") {
+		span := otlpSpan{TraceID: root.TraceID(), ParentSpanID: got[4].SpanID, Name: name, Kind: SpanKindInternal, Status: otlpStatus{Code: 1}}
+		if i == 1 {
+			span.Status = otlpStatus{Code: 2, Message: "users-go unavailable"}
+		}
+		if i == 4 {
+			span.ParentSpanID = ""
+			span.Kind = SpanKindServer
+			span.Attributes = []otlpKeyValue{{Key: "http.status_code", Value: map[string]interface{}{"intValue": "503"}}}
+		}
+		want = append(want, span)
+	}
+	ignore := cmp.FilterPath(func(p cmp.Path) bool {
+		switch p.Last().String() {
+		case ".SpanID", ".StartTimeUnixNano", ".EndTimeUnixNano":
+			return true
+		}
+		return false
+	}, cmp.Ignore())
+	if diff := cmp.Diff(want, got, ignore); diff != "" {
+		t.Errorf("spans mismatch (-want +got):\n%s", diff)
+	}
+	if service := posted[0].ResourceSpans[0].Resource.Attributes[0]; service.Key != "service.name" || service.Value["stringValue"] != "accessdoor" {
+		t.Errorf("unexpected resource attribute %v", service)
+	}
+
+	//the file gets the same export requests, one per line
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := []otlpRequest{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var req otlpRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, req)
+	}
+	if diff := cmp.Diff(posted, written); diff != "" {
+		t.Errorf("file mismatch (-want +got):\n%s", diff)
+	}
+}
+
+//recordingExporter keeps every exported span.
+type recordingExporter struct {
+	mtx   sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(span *Span) {
+	e.mtx.Lock()
+	e.spans = append(e.spans, span)
+	e.mtx.Unlock()
+}
+
+func TestTracingMiddlewareLayers(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter, 1)
+	users := newFakeUsersService(usermodel.User{Username: "abc", DoorAccess: map[string]bool{"HQ-In": true}})
+	s := NewService(log.NewNopLogger(), users, newFakeEventsService())
+	s = NewTracingMiddleware(tracer, "service")(s)
+	s = NewLoggingMiddleware(log.NewNopLogger())(s)
+	s = NewTracingMiddleware(tracer, "service.logging")(s)
+
+	type span struct {
+		Name    string
+		Parent  string
+		Outcome interface{}
+		Err     bool
+	}
+	tests := []struct {
+		name  string
+		door  string
+		spans []span
+	}{
+		{
+			name: "Granted",
+			door: "HQ-In",
+			spans: []span{
+				{Name: "service.DoorAuthenticate", Parent: "service.logging.DoorAuthenticate", Outcome: model.OutcomeGranted},
+				{Name: "service.logging.DoorAuthenticate", Outcome: model.OutcomeGranted},
+			},
+		},
+		{
+			name: "Denial is not an error",
+			door: "HQ-Lab",
+			spans: []span{
+				{Name: "service.DoorAuthenticate", Parent: "service.logging.DoorAuthenticate", Outcome: model.OutcomeDenied},
+				{Name: "service.logging.DoorAuthenticate", Outcome: model.OutcomeDenied},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter.spans = nil
+			if _, err := s.DoorAuthenticate(context.Background(), model.AuthenticateRequest{Username: "abc", AccessDoor: test.door}); test.door == "HQ-Lab" && !IsAccessDenied(err) {
+				t.Fatalf("expected a denial, got %v", err)
+			}
+			names := map[[8]byte]string{}
+			for _, s := range exporter.spans {
+				names[s.spanID] = s.name
+			}
+			got := []span{}
+			for _, s := range exporter.spans {
+				var outcome interface{}
+				for _, attribute := range s.attributes {
+					if attribute.key == "outcome" {
+						outcome = attribute.value
+					}
+				}
+				got = append(got, span{Name: s.name, Parent: names[s.parentID], Outcome: outcome, Err: s.err != nil})
+			}
+			if diff := cmp.Diff(test.spans, got); diff != "" {
+				t.Errorf("spans mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,617 @@
+package base
+
+import (
+	"accessdoor/model"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	WebhookAccessGranted = "access.granted"
+	WebhookAccessDenied  = "access.denied"
+	WebhookAccessChanged = "access.changed"
+	WebhookAlertFired    = "alert.fired"
+)
+
+var (
+	errInvalidWebhook = errors.New("webhook needs an absolute http(s) url and known event types")
+	errWebhookTarget  = errors.New("webhook url must reach a public or allowed address")
+	errNotFound       = errors.New("not found")
+	errUnsubscribed   = errors.New("the subscription of this delivery was removed")
+
+	webhookEventTypes = map[string]bool{
+		WebhookAccessGranted: true,
+		WebhookAccessDenied:  true,
+		WebhookAccessChanged: true,
+		WebhookAlertFired:    true,
+	}
+)
+
+//WebhookSubscription is a registered receiver. Secret is only returned when the
+//subscription is created.
+type WebhookSubscription struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"eventtypes"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"createdat"`
+}
+
+func (s WebhookSubscription) wants(eventType string) bool {
+	for _, t := range s.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+//WebhookPayload is the signed body POSTed to subscribers.
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+//DeadLetter is a delivery that ran out of attempts. It can be redelivered.
+type DeadLetter struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscriptionid"`
+	Type           string          `json:"type"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"lasterror"`
+	FailedAt       time.Time       `json:"failedat"`
+}
+
+type delivery struct {
+	id             string
+	subscriptionID string
+	eventType      string
+	body           []byte
+	attempt        int
+}
+
+//WebhookConfig ...
+type WebhookConfig struct {
+	Workers       int
+	OutboxSize    int
+	MaxAttempts   int
+	BaseBackoff   time.Duration
+	MaxBackoff    time.Duration
+	Timeout       time.Duration
+	MaxDeadLetter int
+	//Allow lists the hosts, IPs and CIDRs receivers may use besides public
+	//addresses.
+	Allow []string
+	//Path is the file the subscriptions and dead letters are kept in, nothing
+	//is kept across restarts without it.
+	Path string
+}
+
+//webhookRegistry is the contents of WebhookConfig.Path.
+type webhookRegistry struct {
+	Subscriptions []WebhookSubscription `json:"subscriptions"`
+	DeadLetters   []DeadLetter          `json:"deadletters"`
+}
+
+//privateNetworks are refused as webhook receivers unless allowed, so a
+//subscription cannot reach the services next to this one.
+var privateNetworks = func() []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+//webhookTargets decides which addresses receivers may have.
+type webhookTargets struct {
+	networks []*net.IPNet
+	names    map[string]bool
+}
+
+func (t webhookTargets) permit(ip net.IP) bool {
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+//resolve returns the addresses of host receivers may be reached at. An allowed
+//name is not resolved.
+func (t webhookTargets) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if t.names[host] {
+		return nil, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if t.permit(addr.IP) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errWebhookTarget
+	}
+	return ips, nil
+}
+
+//dialContext connects to a permitted address of addr only. The address is
+//checked on every connection, so a name cannot be repointed after Subscribe.
+func (t webhookTargets) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	ips, err := t.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if ips == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+}
+
+//scheduledRetry is a failed delivery waiting for its backoff.
+type scheduledRetry struct {
+	delivery delivery
+	timer    *time.Timer
+}
+
+//WebhookDispatcher keeps the subscription registry and delivers access decisions
+//and access changes to it from an in-memory outbox. Failed deliveries wait for
+//their backoff outside the outbox, so they hold no worker.
+type WebhookDispatcher struct {
+	config        WebhookConfig
+	targets       webhookTargets
+	client        *http.Client
+	logger        log.Logger
+	outbox        chan delivery
+	mtx           sync.RWMutex
+	subscriptions map[string]WebhookSubscription
+	deadLetters   []DeadLetter
+	retries       map[string]scheduledRetry
+	closed        bool
+	wg            sync.WaitGroup
+}
+
+//NewWebhookDispatcher loads the registry from config.Path and starts
+//config.Workers delivery workers.
+func NewWebhookDispatcher(config WebhookConfig, logger log.Logger) (*WebhookDispatcher, error) {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+	networks, names, err := parseAddresses(config.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook allow %v", err)
+	}
+	targets := webhookTargets{networks: networks, names: names}
+	transport := newTransport(nil)
+	transport.Proxy = nil
+	transport.DialContext = targets.dialContext
+	d := &WebhookDispatcher{
+		config:        config,
+		targets:       targets,
+		client:        &http.Client{Timeout: config.Timeout, Transport: transport},
+		logger:        logger,
+		outbox:        make(chan delivery, config.OutboxSize),
+		subscriptions: map[string]WebhookSubscription{},
+		retries:       map[string]scheduledRetry{},
+	}
+	if err := d.load(); err != nil {
+		return nil, fmt.Errorf("webhook registry %v: %v", config.Path, err)
+	}
+	for i := 0; i < config.Workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	return d, nil
+}
+
+//Subscribe validates and registers sub, generating a secret when none is given.
+//The url must resolve to a public address or one in config.Allow.
+func (d *WebhookDispatcher) Subscribe(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	u, err := url.Parse(sub.URL)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || len(sub.EventTypes) == 0 {
+		return WebhookSubscription{}, errInvalidWebhook
+	}
+	for _, t := range sub.EventTypes {
+		if !webhookEventTypes[t] {
+			return WebhookSubscription{}, errInvalidWebhook
+		}
+	}
+	if _, err := d.targets.resolve(ctx, u.Hostname()); err != nil {
+		return WebhookSubscription{}, errWebhookTarget
+	}
+	if sub.Secret == "" {
+		sub.Secret = newID() + newID()
+	}
+	sub.ID = newID()
+	sub.CreatedAt = time.Now().UTC()
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.subscriptions[sub.ID] = sub
+	if err := d.save(); err != nil {
+		delete(d.subscriptions, sub.ID)
+		return WebhookSubscription{}, err
+	}
+	return sub, nil
+}
+
+//Unsubscribe ...
+func (d *WebhookDispatcher) Unsubscribe(id string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	sub, ok := d.subscriptions[id]
+	if !ok {
+		return errNotFound
+	}
+	delete(d.subscriptions, id)
+	if err := d.save(); err != nil {
+		d.subscriptions[id] = sub
+		return err
+	}
+	return nil
+}
+
+//Subscriptions lists the registry with secrets removed.
+func (d *WebhookDispatcher) Subscriptions() []WebhookSubscription {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	subs := make([]WebhookSubscription, 0, len(d.subscriptions))
+	for _, sub := range d.subscriptions {
+		sub.Secret = ""
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	return subs
+}
+
+//DeadLetters ...
+func (d *WebhookDispatcher) DeadLetters() []DeadLetter {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return append([]DeadLetter{}, d.deadLetters...)
+}
+
+//Redeliver moves a dead letter back into the outbox. A dead letter whose
+//subscription was removed stays where it is.
+func (d *WebhookDispatcher) Redeliver(id string) error {
+	d.mtx.Lock()
+	i := 0
+	for i < len(d.deadLetters) && d.deadLetters[i].ID != id {
+		i++
+	}
+	if i == len(d.deadLetters) {
+		d.mtx.Unlock()
+		return errNotFound
+	}
+	dl := d.deadLetters[i]
+	if _, ok := d.subscriptions[dl.SubscriptionID]; !ok {
+		d.mtx.Unlock()
+		return errUnsubscribed
+	}
+	d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+	if err := d.save(); err != nil {
+		d.logger.Log("method", "WebhookRedeliver", "delivery", dl.ID, "err", err)
+	}
+	d.mtx.Unlock()
+	d.enqueue(delivery{id: dl.ID, subscriptionID: dl.SubscriptionID, eventType: dl.Type, body: dl.Payload})
+	return nil
+}
+
+//Backlog is the number of deliveries waiting in the outbox or for a retry.
+func (d *WebhookDispatcher) Backlog() int {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return len(d.outbox) + len(d.retries)
+}
+
+//OnDecision implements DecisionListener.
+func (d *WebhookDispatcher) OnDecision(_ context.Context, event model.Event) {
+	eventType := WebhookAccessGranted
+	if event.Outcome != model.OutcomeGranted {
+		eventType = WebhookAccessDenied
+	}
+	d.Dispatch(eventType, event)
+}
+
+//OnAccessChange implements AccessChangeListener.
+func (d *WebhookDispatcher) OnAccessChange(_ context.Context, change model.AccessChange) {
+	d.Dispatch(WebhookAccessChanged, change)
+}
+
+//Dispatch queues data for every subscription interested in eventType. It never
+//blocks, a full outbox dead-letters the delivery instead.
+func (d *WebhookDispatcher) Dispatch(eventType string, data interface{}) {
+	d.mtx.RLock()
+	subs := []WebhookSubscription{}
+	for _, sub := range d.subscriptions {
+		if sub.wants(eventType) {
+			subs = append(subs, sub)
+		}
+	}
+	d.mtx.RUnlock()
+
+	for _, sub := range subs {
+		payload := WebhookPayload{
+			ID:        newID(),
+			Type:      eventType,
+			Timestamp: time.Now().UTC(),
+			Data:      data,
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			d.logger.Log("method", "WebhookDispatch", "type", eventType, "err", err)
+			continue
+		}
+		d.enqueue(delivery{id: payload.ID, subscriptionID: sub.ID, eventType: eventType, body: body})
+	}
+}
+
+func (d *WebhookDispatcher) enqueue(dl delivery) {
+	d.mtx.RLock()
+	queued := false
+	if !d.closed {
+		select {
+		case d.outbox <- dl:
+			queued = true
+		default:
+		}
+	}
+	d.mtx.RUnlock()
+	if !queued {
+		d.deadLetter(dl, 0, errors.New("outbox full or closed"))
+	}
+}
+
+func (d *WebhookDispatcher) work() {
+	defer d.wg.Done()
+	for dl := range d.outbox {
+		d.deliver(dl)
+	}
+}
+
+//Close stops accepting work and waits for the outbox to drain or ctx to expire.
+//Deliveries waiting for a retry get their next attempt right away, a failure
+//dead-letters them.
+func (d *WebhookDispatcher) Close(ctx context.Context) error {
+	d.mtx.Lock()
+	if !d.closed {
+		d.closed = true
+		pending := make([]delivery, 0, len(d.retries))
+		for id, retry := range d.retries {
+			retry.timer.Stop()
+			pending = append(pending, retry.delivery)
+			delete(d.retries, id)
+		}
+		go func() {
+			for _, dl := range pending {
+				d.outbox <- dl
+			}
+			close(d.outbox)
+		}()
+	}
+	d.mtx.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//deliver makes one attempt and schedules the next after a failure.
+func (d *WebhookDispatcher) deliver(dl delivery) {
+	d.mtx.RLock()
+	sub, ok := d.subscriptions[dl.subscriptionID]
+	d.mtx.RUnlock()
+	if !ok {
+		//unsubscribed while queued
+		return
+	}
+	dl.attempt++
+	err := d.post(sub, dl)
+	if err == nil {
+		return
+	}
+	d.logger.Log("method", "WebhookDeliver", "subscription", sub.ID, "delivery", dl.id, "attempt", dl.attempt, "err", err)
+	if dl.attempt >= d.config.MaxAttempts || !d.scheduleRetry(dl) {
+		d.deadLetter(dl, dl.attempt, err)
+	}
+}
+
+//backoff is the wait before the attempt after attempt, doubled every time.
+func (d *WebhookDispatcher) backoff(attempt int) time.Duration {
+	backoff := d.config.BaseBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if d.config.MaxBackoff > 0 && backoff > d.config.MaxBackoff {
+			return d.config.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+//scheduleRetry queues dl again after its backoff. It fails once Close started.
+func (d *WebhookDispatcher) scheduleRetry(dl delivery) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.closed {
+		return false
+	}
+	d.retries[dl.id] = scheduledRetry{
+		delivery: dl,
+		timer:    time.AfterFunc(d.backoff(dl.attempt), func() { d.retry(dl.id) }),
+	}
+	return true
+}
+
+//retry moves a delivery whose backoff passed to the outbox, unless Close took
+//it already.
+func (d *WebhookDispatcher) retry(id string) {
+	d.mtx.Lock()
+	retry, ok := d.retries[id]
+	if !ok {
+		d.mtx.Unlock()
+		return
+	}
+	delete(d.retries, id)
+	queued := false
+	select {
+	case d.outbox <- retry.delivery:
+		queued = true
+	default:
+	}
+	d.mtx.Unlock()
+	if !queued {
+		d.deadLetter(retry.delivery, retry.delivery.attempt, errors.New("outbox full"))
+	}
+}
+
+func (d *WebhookDispatcher) post(sub WebhookSubscription, dl delivery) error {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	req.Header.Set("X-Webhook-Id", dl.id)
+	req.Header.Set("X-Webhook-Event", dl.eventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhook(sub.Secret, timestamp, dl.body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook receiver returned %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) deadLetter(dl delivery, attempts int, err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.deadLetters = append(d.deadLetters, DeadLetter{
+		ID:             dl.id,
+		SubscriptionID: dl.subscriptionID,
+		Type:           dl.eventType,
+		Payload:        dl.body,
+		Attempts:       attempts,
+		LastError:      err.Error(),
+		FailedAt:       time.Now().UTC(),
+	})
+	if d.config.MaxDeadLetter > 0 && len(d.deadLetters) > d.config.MaxDeadLetter {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-d.config.MaxDeadLetter:]
+	}
+	if err := d.save(); err != nil {
+		d.logger.Log("method", "WebhookDeadLetter", "delivery", dl.id, "err", err)
+	}
+}
+
+//load reads the registry config.Path left, a missing file is an empty one.
+func (d *WebhookDispatcher) load() error {
+	if d.config.Path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(d.config.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var registry webhookRegistry
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return err
+	}
+	for _, sub := range registry.Subscriptions {
+		d.subscriptions[sub.ID] = sub
+	}
+	d.deadLetters = registry.DeadLetters
+	d.logger.Log("method", "NewWebhookDispatcher", "path", d.config.Path, "subscriptions", len(d.subscriptions), "deadletters", len(d.deadLetters))
+	return nil
+}
+
+//save replaces the registry at config.Path with the one in memory. d.mtx must
+//be held.
+func (d *WebhookDispatcher) save() error {
+	if d.config.Path == "" {
+		return nil
+	}
+	registry := webhookRegistry{Subscriptions: make([]WebhookSubscription, 0, len(d.subscriptions)), DeadLetters: d.deadLetters}
+	for _, sub := range d.subscriptions {
+		registry.Subscriptions = append(registry.Subscriptions, sub)
+	}
+	sort.Slice(registry.Subscriptions, func(i, j int) bool {
+		return registry.Subscriptions[i].CreatedAt.Before(registry.Subscriptions[j].CreatedAt)
+	})
+	data, err := json.Marshal(registry)
+	if err != nil {
+		return err
+	}
+	return replaceFile(d.config.Path, data)
+}
+
+//SignWebhook is the hex HMAC-SHA256 of "timestamp.body" under secret. Receivers
+//recompute it from the X-Webhook-Timestamp header and the raw body.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,91 @@
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+//MakeWebhookHandler mounts the subscription registry and dead-letter routes
+//under baseRoute. Every route needs an admin actor.
+func MakeWebhookHandler(d *WebhookDispatcher, usersService UsersService, logger log.Logger, baseRoute string) http.Handler {
+	r := newRouter()
+	admin := requireAdmin(usersService)
+	options := []httptransport.ServerOption{
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerErrorLogger(logger),
+	}
+
+	r.Methods(http.MethodPost).Path(baseRoute + "/webhooks").Handler(httptransport.NewServer(
+		admin(makeSubscribeWebhook(d)),
+		decodeSubscribeWebhookRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/webhooks").Handler(httptransport.NewServer(
+		admin(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return d.Subscriptions(), nil
+		}),
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodDelete).Path(baseRoute + "/webhooks/{id}").Handler(httptransport.NewServer(
+		admin(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return "", d.Unsubscribe(request.(string))
+		}),
+		decodeIDRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodGet).Path(baseRoute + "/webhooks/deadletters").Handler(httptransport.NewServer(
+		admin(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return d.DeadLetters(), nil
+		}),
+		httptransport.NopRequestDecoder,
+		encodeResponse,
+		options...,
+	))
+	r.Methods(http.MethodPost).Path(baseRoute + "/webhooks/deadletters/{id}/redeliver").Handler(httptransport.NewServer(
+		admin(func(ctx context.Context, request interface{}) (interface{}, error) {
+			return "", d.Redeliver(request.(string))
+		}),
+		decodeIDRequest,
+		encodeResponse,
+		options...,
+	))
+	return r
+}
+
+func makeSubscribeWebhook(d *WebhookDispatcher) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req, ok := request.(WebhookSubscription)
+		if !ok {
+			return nil, errors.New("Bad Request")
+		}
+		return d.Subscribe(ctx, req)
+	}
+}
+
+func decodeSubscribeWebhookRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errBadRequest
+	}
+	return req, nil
+}
+
+func decodeIDRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		return nil, errBadRequest
+	}
+	return id, nil
+}
@@ -0,0 +1,321 @@
+package base
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestSignWebhook(t *testing.T) {
+	got := SignWebhook("secret", "1600000000", []byte(`{"id":"1"}`))
+	if want := "3831eb7dbf183fdbdf6145e3aa0b7029f210195f352de3815ebec7b67268edbc"; got != want {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+//webhookReceiver fails the first failures deliveries and checks the signature
+//of every one.
+type webhookReceiver struct {
+	t        *testing.T
+	mtx      sync.Mutex
+	secret   string
+	failures int
+	calls    int
+	received chan string
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	signature := "sha256=" + SignWebhook(rc.secret, r.Header.Get("X-Webhook-Timestamp"), body)
+	if r.Header.Get("X-Webhook-Signature") != signature {
+		rc.t.Errorf("bad signature %q", r.Header.Get("X-Webhook-Signature"))
+	}
+	rc.mtx.Lock()
+	rc.calls++
+	fail := rc.calls <= rc.failures
+	rc.mtx.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	rc.received <- r.Header.Get("X-Webhook-Id")
+}
+
+func (rc *webhookReceiver) count() int {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.calls
+}
+
+func newTestDispatcher(t *testing.T, attempts int, backoff time.Duration) *WebhookDispatcher {
+	d, err := NewWebhookDispatcher(WebhookConfig{
+		Workers:     1,
+		OutboxSize:  8,
+		MaxAttempts: attempts,
+		BaseBackoff: backoff,
+		MaxBackoff:  backoff,
+		Timeout:     time.Second,
+		Allow:       []string{"127.0.0.1"},
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		attempts    int
+		delivered   bool
+		deadLetters int
+	}{
+		{name: "first attempt", failures: 0, attempts: 3, delivered: true},
+		{name: "after retries", failures: 2, attempts: 3, delivered: true},
+		{name: "out of attempts", failures: 3, attempts: 3, deadLetters: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &webhookReceiver{t: t, secret: "secret", failures: tt.failures, received: make(chan string, 1)}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+			d := newTestDispatcher(t, tt.attempts, time.Millisecond)
+			if _, err := d.Subscribe(context.Background(), WebhookSubscription{URL: server.URL, EventTypes: []string{WebhookAlertFired}, Secret: "secret"}); err != nil {
+				t.Fatal(err)
+			}
+			d.Dispatch(WebhookAlertFired, map[string]string{"rule": "test"})
+			if tt.delivered {
+				select {
+				case <-receiver.received:
+				case <-time.After(5 * time.Second):
+					t.Fatal("not delivered")
+				}
+			} else {
+				deadline := time.Now().Add(5 * time.Second)
+				for len(d.DeadLetters()) == 0 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			if err := d.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			calls := tt.failures + 1
+			if calls > tt.attempts {
+				calls = tt.attempts
+			}
+			if got := receiver.count(); got != calls {
+				t.Fatalf("expected %v attempts, got %v", calls, got)
+			}
+			deadLetters := d.DeadLetters()
+			if len(deadLetters) != tt.deadLetters {
+				t.Fatalf("expected %v dead letters, got %v", tt.deadLetters, deadLetters)
+			}
+			if tt.deadLetters > 0 && deadLetters[0].Attempts != tt.attempts {
+				t.Fatalf("expected %v attempts in the dead letter, got %v", tt.attempts, deadLetters[0].Attempts)
+			}
+		})
+	}
+}
+
+func TestWebhookCloseFlushesRetries(t *testing.T) {
+	receiver := &webhookReceiver{t: t, secret: "secret", failures: 1, received: make(chan string, 1)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	d := newTestDispatcher(t, 3, time.Hour)
+	if _, err := d.Subscribe(context.Background(), WebhookSubscription{URL: server.URL, EventTypes: []string{WebhookAlertFired}, Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Dispatch(WebhookAlertFired, "fired")
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Backlog() == 0 || receiver.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first attempt not made")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//the retry is an hour away, Close attempts it now
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-receiver.received:
+	default:
+		t.Fatal("retry not flushed by Close")
+	}
+	if d.Backlog() != 0 || len(d.DeadLetters()) != 0 {
+		t.Fatalf("expected nothing left, got backlog %v and %v dead letters", d.Backlog(), len(d.DeadLetters()))
+	}
+}
+
+func TestWebhookTargets(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		url   string
+		err   error
+	}{
+		{name: "loopback", url: "http://127.0.0.1:8080/hook", err: errWebhookTarget},
+		{name: "private", url: "https://10.1.2.3/hook", err: errWebhookTarget},
+		{name: "link-local", url: "http://169.254.169.254/latest", err: errWebhookTarget},
+		{name: "ipv6 loopback", url: "http://[::1]/hook", err: errWebhookTarget},
+		{name: "public", url: "https://203.0.113.10/hook", err: nil},
+		{name: "allowed network", allow: []string{"10.0.0.0/8"}, url: "https://10.1.2.3/hook", err: nil},
+		{name: "allowed name", allow: []string{"hooks.internal"}, url: "https://hooks.internal/hook", err: nil},
+		{name: "no scheme", url: "203.0.113.10/hook", err: errInvalidWebhook},
+		{name: "other scheme", url: "ftp://203.0.113.10/hook", err: errInvalidWebhook},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewWebhookDispatcher(WebhookConfig{Allow: tt.allow}, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close(context.Background())
+			_, err = d.Subscribe(context.Background(), WebhookSubscription{URL: tt.url, EventTypes: []string{WebhookAlertFired}})
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	//a receiver that is refused is not dialed either
+	if _, err := (webhookTargets{}).dialContext(context.Background(), "tcp", "127.0.0.1:80"); err != errWebhookTarget {
+		t.Fatalf("expected %v, got %v", errWebhookTarget, err)
+	}
+}
+
+func TestWebhookHandlerNeedsAdmin(t *testing.T) {
+	users := newFakeUsersService(usermodel.User{Username: "root", IsAdmin: true}, usermodel.User{Username: "bob"})
+	d := newTestDispatcher(t, 1, time.Millisecond)
+	defer d.Close(context.Background())
+	h := MakeWebhookHandler(d, users, log.NewNopLogger(), "/v2")
+	tests := []struct {
+		name   string
+		actor  string
+		method string
+		path   string
+		code   int
+	}{
+		{name: "subscribe without actor", method: http.MethodPost, path: "/v2/webhooks", code: http.StatusForbidden},
+		{name: "subscribe as user", actor: "bob", method: http.MethodPost, path: "/v2/webhooks", code: http.StatusForbidden},
+		{name: "list as user", actor: "bob", method: http.MethodGet, path: "/v2/webhooks", code: http.StatusForbidden},
+		{name: "delete as user", actor: "bob", method: http.MethodDelete, path: "/v2/webhooks/1", code: http.StatusForbidden},
+		{name: "dead letters as user", actor: "bob", method: http.MethodGet, path: "/v2/webhooks/deadletters", code: http.StatusForbidden},
+		{name: "redeliver as user", actor: "bob", method: http.MethodPost, path: "/v2/webhooks/deadletters/1/redeliver", code: http.StatusForbidden},
+		{name: "subscribe as admin", actor: "root", method: http.MethodPost, path: "/v2/webhooks", code: http.StatusOK},
+		{name: "list as admin", actor: "root", method: http.MethodGet, path: "/v2/webhooks", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"url": "http://127.0.0.1:1/hook", "eventtypes": ["alert.fired"]}`
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			r = r.WithContext(withActor(r.Context(), tt.actor))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("expected %v, got %v: %v", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebhookRegistryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	open := func() *WebhookDispatcher {
+		d, err := NewWebhookDispatcher(WebhookConfig{Workers: 1, OutboxSize: 8, Timeout: time.Second, Allow: []string{"127.0.0.1"}, Path: path}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	d := open()
+	kept, err := d.Subscribe(context.Background(), WebhookSubscription{URL: "http://127.0.0.1:1/kept", EventTypes: []string{WebhookAlertFired}, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := d.Subscribe(context.Background(), WebhookSubscription{URL: "http://127.0.0.1:1/removed", EventTypes: []string{WebhookAlertFired}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//nothing listens on port 1, both deliveries are dead-lettered
+	d.Dispatch(WebhookAlertFired, "fired")
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.DeadLetters()) != 2 {
+		t.Fatalf("expected 2 dead letters, got %v", d.DeadLetters())
+	}
+	if err := d.Unsubscribe(removed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restart finds the subscription with its secret and both dead letters
+	d = open()
+	defer d.Close(context.Background())
+	if subs := d.Subscriptions(); len(subs) != 1 || subs[0].ID != kept.ID {
+		t.Fatalf("expected subscription %v, got %v", kept.ID, subs)
+	}
+	if secret := d.subscriptions[kept.ID].Secret; secret != "secret" {
+		t.Errorf("expected the secret to be kept, got %q", secret)
+	}
+	deadLetters := d.DeadLetters()
+	if len(deadLetters) != 2 {
+		t.Fatalf("expected 2 dead letters, got %v", deadLetters)
+	}
+
+	users := newFakeUsersService(usermodel.User{Username: "root", IsAdmin: true})
+	h := MakeWebhookHandler(d, users, log.NewNopLogger(), "/v2")
+	tests := []struct {
+		name string
+		id   string
+		code int
+	}{
+		{name: "Unknown dead letter", id: "missing", code: http.StatusNotFound},
+		{name: "Removed subscription", id: deadLetterOf(deadLetters, removed.ID), code: http.StatusConflict},
+		{name: "Subscribed", id: deadLetterOf(deadLetters, kept.ID), code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v2/webhooks/deadletters/"+tt.id+"/redeliver", nil)
+			r = r.WithContext(withActor(r.Context(), "root"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("expected %v, got %v: %v", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+	//the dead letter of the removed subscription is still there to look at
+	if id := deadLetterOf(d.DeadLetters(), removed.ID); id == "" {
+		t.Error("expected the dead letter of the removed subscription to stay")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWebhookDispatcher(WebhookConfig{Path: path}, log.NewNopLogger()); err == nil {
+		t.Error("expected an error for a corrupt registry")
+	}
+}
+
+func deadLetterOf(deadLetters []DeadLetter, subscriptionID string) string {
+	for _, dl := range deadLetters {
+		if dl.SubscriptionID == subscriptionID {
+			return dl.ID
+		}
+	}
+	return ""
+}
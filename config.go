@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"accessdoor/base"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//envPrefix starts the environment variable of every setting, service.timeout
+//is read from ACCESSDOOR_SERVICE_TIMEOUT.
+const envPrefix = "ACCESSDOOR_"
+
+//Config holds every setting of the service. Durations are milliseconds.
+type Config struct {
+	Service struct {
+		Name     string
+		BasePath string
+		Version  string
+		DataType string
+		Timeout  int64
+	}
+	HTTP struct {
+		Addr       string
+		Port       int
+		TLS        TLSFiles
+		ClientAuth string
+		Proxies    string
+	}
+	Metrics struct {
+		Port    int
+		Buckets string
+		TLS     TLSFiles
+	}
+	Upstream struct {
+		TLS TLSFiles
+	}
+	Consul struct {
+		Addr string
+	}
+	Syslog struct {
+		Address          string
+		SDID             string
+		SecurityFacility string
+	}
+	Proxy struct {
+		GetUserURL      string
+		AuthenticateURL string
+		UpdateAccessURL string
+		EventUpdateURL  string
+		GetEventURL     string
+	}
+	Outbound struct {
+		Attempts int
+		MaxTime  int
+	}
+	Stream struct {
+		RingSize         int
+		SubscriberBuffer int
+		Heartbeat        int
+	}
+	Webhook struct {
+		Workers     int
+		Outbox      int
+		Attempts    int
+		Backoff     int
+		MaxBackoff  int
+		Timeout     int
+		DeadLetters int
+		Allow       string
+		Path        string
+	}
+	Audit struct {
+		Path   string
+		Verify bool
+	}
+	Doors struct {
+		Catalog         string
+		EventsRetention int64
+	}
+	Users struct {
+		Roster string
+	}
+	Occupancy struct {
+		Stale int64
+	}
+	Muster struct {
+		Sessions int
+	}
+	Attendance struct {
+		MaxShift int64
+	}
+	Alerts struct {
+		Rules string
+	}
+	Grants struct {
+		Lookback int64
+		Interval int64
+	}
+	Tracing struct {
+		OTLPEndpoint string
+		OTLPFile     string
+		Sample       float64
+		Batch        int
+		Interval     int
+	}
+	Log struct {
+		Level  string
+		Redact string
+		Sinks  string
+	}
+	Usage struct {
+		Retention int64
+	}
+	Reload struct {
+		Watch int
+	}
+	Shutdown struct {
+		Delay   int
+		Timeout int
+		Flush   int
+	}
+}
+
+//TLSFiles are the PEM files of a TLS listener or client. CA verifies the
+//other side, client certificates for a listener.
+type TLSFiles struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+//bind registers a flag with its default for every setting of c.
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.Service.Name, "service.name", "dooraccess", "Name of microservice")
+	fs.StringVar(&c.Service.BasePath, "service.base.path", "dooraccess", "Name of microservice")
+	fs.StringVar(&c.Service.Version, "service.version", "v1", "Version of microservice")
+	fs.StringVar(&c.HTTP.Addr, "http.addr", "localhost", "This is the addr at which http requests are accepted (Default localhost)")
+	fs.IntVar(&c.HTTP.Port, "http.port", 8090, "This is the port at which http requests are accepted (Default :8080)")
+	fs.IntVar(&c.Metrics.Port, "metrics.port", 8092, "HTTP metrics listen address (Default 8082)")
+	fs.StringVar(&c.Service.DataType, "service.datatype", "test", "default Test/qa")
+	fs.StringVar(&c.Consul.Addr, "consul.addr", "localhost:8500", "consul address (Default localhost:8500)")
+	fs.Int64Var(&c.Service.Timeout, "service.timeout", 200000, "service timeout in milliseconds")
+	fs.StringVar(&c.Syslog.Address, "syslog.address", "localhost:514", "default location for the syslogger")
+	fs.StringVar(&c.Proxy.GetUserURL, "proxy.getuserurl", "/users/v1/getuser", "user proxy url")
+	fs.StringVar(&c.Proxy.AuthenticateURL, "proxy.authenticateurl", "/users/v1/authenticate", "user proxy url")
+	fs.StringVar(&c.Proxy.UpdateAccessURL, "proxy.updatedaccess", "/users/v1/updateuseraccess", "user proxy url")
+	fs.StringVar(&c.Proxy.EventUpdateURL, "proxy.eventupdate", "/events/v1/updateevent", "events proxy url")
+	fs.StringVar(&c.Proxy.GetEventURL, "proxy.getevent", "/events/v1/getevents", "events proxy url")
+	fs.IntVar(&c.Outbound.Attempts, "outbound.service.attempts", 1, "max attempts for API")
+	fs.IntVar(&c.Outbound.MaxTime, "outbound.service.maxtime", 500000, "maxTime for API in milliseconds")
+	fs.IntVar(&c.Stream.RingSize, "stream.ringsize", 1024, "number of recent access decisions kept for Last-Event-ID resume")
+	fs.IntVar(&c.Stream.SubscriberBuffer, "stream.subscriber.buffer", 64, "pending access decisions allowed per stream subscriber")
+	fs.IntVar(&c.Stream.Heartbeat, "stream.heartbeat", 15000, "stream heartbeat interval in milliseconds")
+	fs.IntVar(&c.Webhook.Workers, "webhook.workers", 4, "number of concurrent webhook deliveries")
+	fs.IntVar(&c.Webhook.Outbox, "webhook.outbox", 1024, "webhook deliveries queued before they are dead-lettered")
+	fs.IntVar(&c.Webhook.Attempts, "webhook.attempts", 5, "max delivery attempts per webhook")
+	fs.IntVar(&c.Webhook.Backoff, "webhook.backoff", 1000, "initial webhook retry backoff in milliseconds, doubled per attempt")
+	fs.IntVar(&c.Webhook.MaxBackoff, "webhook.maxbackoff", 60000, "max webhook retry backoff in milliseconds")
+	fs.IntVar(&c.Webhook.Timeout, "webhook.timeout", 5000, "webhook delivery timeout in milliseconds")
+	fs.IntVar(&c.Webhook.DeadLetters, "webhook.deadletters", 1000, "max dead-lettered webhook deliveries kept")
+	fs.StringVar(&c.Webhook.Allow, "webhook.allow", "", "comma separated hosts, IPs and CIDRs webhook receivers may use besides public addresses")
+	fs.StringVar(&c.Webhook.Path, "webhook.path", "webhooks.json", "file the webhook subscriptions and dead letters are kept in across restarts")
+	fs.StringVar(&c.Audit.Path, "audit.path", "audit.log", "hash-chained audit log of access changes")
+	fs.BoolVar(&c.Audit.Verify, "audit.verify", false, "verify the audit log chain at audit.path and exit")
+	fs.StringVar(&c.Doors.Catalog, "doors.catalog", "", "JSON file classifying doors by area and type (entry, exit, internal, muster)")
+	fs.StringVar(&c.Users.Roster, "users.roster", "", "file with one known username per line, used to rebuild reports on startup")
+	fs.Int64Var(&c.Occupancy.Stale, "occupancy.stale", 43200000, "milliseconds after which an unrefreshed presence is dropped, 0 keeps it forever")
+	fs.Int64Var(&c.Doors.EventsRetention, "doors.events.retention", 604800000, "milliseconds of activity kept per door for the door events view, 0 keeps everything")
+	fs.Int64Var(&c.Attendance.MaxShift, "attendance.maxshift", 57600000, "milliseconds after which an entry without an exit is reported as a missing exit")
+	fs.StringVar(&c.Alerts.Rules, "alerts.rules", "", "JSON file of alert rules evaluated on every access decision")
+	fs.Int64Var(&c.Grants.Lookback, "grants.lookback", 7776000000, "milliseconds without a granted swipe after which a door grant is reported as unused")
+	fs.Int64Var(&c.Grants.Interval, "grants.interval", 86400000, "milliseconds between unused grant analysis runs, 0 only runs on startup")
+	fs.StringVar(&c.Tracing.OTLPEndpoint, "tracing.otlp.endpoint", "", "OTLP/HTTP traces URL spans are exported to as JSON, e.g. http://localhost:4318/v1/traces")
+	fs.StringVar(&c.Tracing.OTLPFile, "tracing.otlp.file", "", "file spans are appended to as OTLP/JSON, one export request per line")
+	fs.Float64Var(&c.Tracing.Sample, "tracing.sample", 1, "ratio of traces started here that are exported, inbound traces keep the caller's decision")
+	fs.IntVar(&c.Tracing.Batch, "tracing.batch", 512, "max spans per OTLP export")
+	fs.IntVar(&c.Tracing.Interval, "tracing.interval", 5000, "OTLP export interval in milliseconds")
+	fs.StringVar(&c.Log.Level, "log.level", "info", "lowest level logged: debug, info, warn or error")
+	fs.StringVar(&c.Log.Redact, "log.redact", "secret,password,token,authorization,signature,cookie", "comma separated log keys whose values are redacted")
+	fs.StringVar(&c.Log.Sinks, "log.sinks", "stdout", "comma separated log sinks, stdout (JSON) and syslog")
+	fs.StringVar(&c.Syslog.SDID, "syslog.sdid", "accessdoor@32473", "RFC 5424 structured data id of syslog lines")
+	fs.StringVar(&c.Syslog.SecurityFacility, "syslog.security.facility", "authpriv", "syslog facility of denials and access changes, empty keeps them with the other lines")
+	fs.StringVar(&c.Metrics.Buckets, "metrics.buckets", "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10", "comma separated latency histogram buckets in seconds")
+	fs.Int64Var(&c.Usage.Retention, "usage.retention", 7776000000, "milliseconds of hourly usage counts kept for the usage aggregation, 0 keeps everything")
+	fs.IntVar(&c.Reload.Watch, "reload.watch", 2000, "milliseconds between checks of the config, door catalog and alert rules files for changes, 0 reloads on SIGHUP only")
+	fs.StringVar(&c.HTTP.TLS.Cert, "http.tls.cert", "", "PEM certificate of the API listener, serves HTTPS when set")
+	fs.StringVar(&c.HTTP.TLS.Key, "http.tls.key", "", "PEM key of http.tls.cert")
+	fs.StringVar(&c.HTTP.TLS.CA, "http.tls.clientca", "", "PEM CAs that issue the client certificates of trusted door controllers")
+	fs.StringVar(&c.HTTP.ClientAuth, "http.tls.clientauth", base.ClientAuthRequire, "client certificates when http.tls.clientca is set: require (all but /healthcheck), optional or none")
+	fs.StringVar(&c.HTTP.Proxies, "http.proxies", "", "comma separated IPs, CIDRs or client certificate names of proxies trusted to set X-Actor and X-Forwarded-For")
+	fs.IntVar(&c.Muster.Sessions, "muster.sessions", 100, "finished muster sessions kept, oldest are dropped first")
+	fs.StringVar(&c.Metrics.TLS.Cert, "metrics.tls.cert", "", "PEM certificate of the metrics listener, serves HTTPS when set")
+	fs.StringVar(&c.Metrics.TLS.Key, "metrics.tls.key", "", "PEM key of metrics.tls.cert")
+	fs.StringVar(&c.Metrics.TLS.CA, "metrics.tls.clientca", "", "PEM CAs of the client certificates scrapers must present")
+	fs.StringVar(&c.Upstream.TLS.CA, "upstream.tls.ca", "", "PEM CAs that verify https upstreams, the system CAs when empty")
+	fs.StringVar(&c.Upstream.TLS.Cert, "upstream.tls.cert", "", "PEM client certificate presented to https upstreams")
+	fs.StringVar(&c.Upstream.TLS.Key, "upstream.tls.key", "", "PEM key of upstream.tls.cert")
+	fs.IntVar(&c.Shutdown.Delay, "shutdown.delay", 5000, "milliseconds between deregistering from Consul and draining, for the change to reach clients")
+	fs.IntVar(&c.Shutdown.Timeout, "shutdown.timeout", 30000, "milliseconds allowed to drain requests on shutdown")
+	fs.IntVar(&c.Shutdown.Flush, "shutdown.flush", 10000, "milliseconds allowed to flush webhooks and traces on shutdown, after the drain")
+}
+
+//loadConfig layers the settings: flag defaults, then the config file, then
+//environment variables, then the flags given in args. Every layer goes through
+//the flag parsers, so a value has the same syntax everywhere.
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, string, bool, error) {
+	c := &Config{}
+	c.bind(fs)
+	path := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "YAML or JSON file with settings keyed by flag name, e.g. service.timeout: 5000")
+	printConfig := fs.Bool("print-config", false, "print the effective settings with secrets redacted and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, "", false, err
+	}
+	given := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	if *path != "" {
+		values, err := readConfigFile(*path)
+		if err != nil {
+			return nil, "", false, err
+		}
+		for _, name := range sortedKeys(values) {
+			if fs.Lookup(name) == nil || name == "config" || name == "print-config" {
+				return nil, "", false, fmt.Errorf("%v: unknown setting %v", *path, name)
+			}
+			if err := fs.Set(name, values[name]); err != nil {
+				return nil, "", false, fmt.Errorf("%v: %v: invalid value %q", *path, name, values[name])
+			}
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if val, ok := os.LookupEnv(envName(f.Name)); ok && err == nil && f.Name != "config" {
+			if setErr := fs.Set(f.Name, val); setErr != nil {
+				err = fmt.Errorf("%v: invalid value %q", envName(f.Name), val)
+			}
+		}
+	})
+	if err != nil {
+		return nil, "", false, err
+	}
+	for name, val := range given {
+		fs.Set(name, val)
+	}
+	return c, *path, *printConfig, nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+//readConfigFile flattens the file to flag names. Nested maps are joined with
+//dots, so service: {timeout: 5000} and service.timeout: 5000 are the same, and
+//lists are joined with commas.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	values := map[string]string{}
+	if raw == nil {
+		return values, nil
+	}
+	if err := flattenConfig("", raw, values); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return values, nil
+}
+
+func flattenConfig(prefix string, raw interface{}, values map[string]string) error {
+	join := func(key interface{}) string {
+		if prefix == "" {
+			return fmt.Sprint(key)
+		}
+		return prefix + "." + fmt.Sprint(key)
+	}
+	if prefix == "" {
+		switch raw.(type) {
+		case map[string]interface{}, map[interface{}]interface{}:
+		default:
+			return errors.New("settings must be a map")
+		}
+	}
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if err := flattenConfig(join(key), val, values); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for key, val := range v {
+			if err := flattenConfig(join(key), val, values); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = configValue(item)
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+		values[prefix] = ""
+	default:
+		values[prefix] = configValue(v)
+	}
+	return nil
+}
+
+//configValue formats a scalar of the file the way the flags parse it. Numbers
+//are written without an exponent, so grants.lookback: 1e10 still fits Int64Var.
+func configValue(v interface{}) string {
+	switch n := v.(type) {
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	case json.Number:
+		if _, err := n.Int64(); err == nil {
+			return n.String()
+		}
+		if f, err := n.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return n.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//validate checks every setting and reports all problems at once.
+func (c *Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Service.Name != "", "service.name is empty")
+	check(c.Service.BasePath != "" && !strings.Contains(c.Service.BasePath, "/"), "service.base.path %q must be a single path segment", c.Service.BasePath)
+	check(c.Service.Version != "", "service.version is empty")
+	check(c.Service.Timeout > 0, "service.timeout must be positive")
+	check(c.HTTP.Addr != "", "http.addr is empty")
+	check(c.HTTP.Port > 0 && c.HTTP.Port < 65536, "http.port %v is not a port", c.HTTP.Port)
+	check(c.Metrics.Port > 0 && c.Metrics.Port < 65536, "metrics.port %v is not a port", c.Metrics.Port)
+	check(c.Metrics.Port != c.HTTP.Port, "metrics.port and http.port are both %v", c.HTTP.Port)
+	_, err := base.ParseBuckets(c.Metrics.Buckets)
+	check(err == nil, "metrics.buckets: %v", err)
+	_, _, err = net.SplitHostPort(c.Consul.Addr)
+	check(err == nil, "consul.addr %q must be host:port", c.Consul.Addr)
+	_, _, err = net.SplitHostPort(c.Syslog.Address)
+	check(err == nil, "syslog.address %q must be host:port", c.Syslog.Address)
+	if c.Syslog.SecurityFacility != "" {
+		_, err = base.SyslogFacility(c.Syslog.SecurityFacility)
+		check(err == nil, "syslog.security.facility: %v", err)
+	}
+	for name, path := range map[string]string{
+		"proxy.getuserurl":      c.Proxy.GetUserURL,
+		"proxy.authenticateurl": c.Proxy.AuthenticateURL,
+		"proxy.updatedaccess":   c.Proxy.UpdateAccessURL,
+		"proxy.eventupdate":     c.Proxy.EventUpdateURL,
+		"proxy.getevent":        c.Proxy.GetEventURL,
+	} {
+		u, err := url.Parse(path)
+		check(err == nil && strings.HasPrefix(path, "/") && u.Host == "", "%v %q must be a path starting with /", name, path)
+	}
+	check(c.Outbound.Attempts > 0, "outbound.service.attempts must be at least 1")
+	check(c.Outbound.MaxTime > 0, "outbound.service.maxtime must be positive")
+	check(c.Stream.RingSize > 0, "stream.ringsize must be positive")
+	check(c.Stream.SubscriberBuffer > 0, "stream.subscriber.buffer must be positive")
+	check(c.Stream.Heartbeat > 0, "stream.heartbeat must be positive")
+	check(c.Webhook.Workers > 0, "webhook.workers must be positive")
+	check(c.Webhook.Outbox > 0, "webhook.outbox must be positive")
+	check(c.Webhook.Attempts > 0, "webhook.attempts must be at least 1")
+	check(c.Webhook.Backoff > 0, "webhook.backoff must be positive")
+	check(c.Webhook.MaxBackoff >= c.Webhook.Backoff, "webhook.maxbackoff must not be below webhook.backoff")
+	check(c.Webhook.Timeout > 0, "webhook.timeout must be positive")
+	check(c.Webhook.DeadLetters >= 0, "webhook.deadletters must not be negative")
+	for _, item := range splitConfigList(c.Webhook.Allow) {
+		if strings.Contains(item, "/") {
+			_, _, err := net.ParseCIDR(item)
+			check(err == nil, "webhook.allow: invalid CIDR %q", item)
+		}
+	}
+	check(c.Webhook.Path != "", "webhook.path is empty")
+	check(c.Audit.Path != "", "audit.path is empty")
+	for name, path := range map[string]string{"doors.catalog": c.Doors.Catalog, "alerts.rules": c.Alerts.Rules} {
+		if path != "" {
+			_, err := os.Stat(path)
+			check(err == nil, "%v: %v", name, err)
+		}
+	}
+	check(c.Doors.EventsRetention >= 0, "doors.events.retention must not be negative")
+	check(c.Occupancy.Stale >= 0, "occupancy.stale must not be negative")
+	check(c.Usage.Retention >= 0, "usage.retention must not be negative")
+	check(c.Reload.Watch >= 0, "reload.watch must not be negative")
+	checkTLS := func(prefix string, files TLSFiles, ca string) {
+		check((files.Cert == "") == (files.Key == ""), "%v.cert and %v.key must be set together", prefix, prefix)
+		for name, path := range map[string]string{prefix + ".cert": files.Cert, prefix + ".key": files.Key, prefix + "." + ca: files.CA} {
+			if path != "" {
+				_, err := os.Stat(path)
+				check(err == nil, "%v: %v", name, err)
+			}
+		}
+	}
+	checkTLS("http.tls", c.HTTP.TLS, "clientca")
+	checkTLS("metrics.tls", c.Metrics.TLS, "clientca")
+	checkTLS("upstream.tls", c.Upstream.TLS, "ca")
+	check(c.HTTP.TLS.CA == "" || c.HTTP.TLS.Cert != "", "http.tls.clientca needs http.tls.cert")
+	check(c.Metrics.TLS.CA == "" || c.Metrics.TLS.Cert != "", "metrics.tls.clientca needs metrics.tls.cert")
+	switch c.HTTP.ClientAuth {
+	case base.ClientAuthNone, base.ClientAuthOptional, base.ClientAuthRequire:
+	default:
+		check(false, "http.tls.clientauth %q must be require, optional or none", c.HTTP.ClientAuth)
+	}
+	_, err = base.NewActorTrust(splitConfigList(c.HTTP.Proxies))
+	check(err == nil, "http.proxies: %v", err)
+	check(c.Muster.Sessions > 0, "muster.sessions must be positive")
+	check(c.Shutdown.Delay >= 0, "shutdown.delay must not be negative")
+	check(c.Shutdown.Timeout > 0, "shutdown.timeout must be positive")
+	check(c.Shutdown.Flush > 0, "shutdown.flush must be positive")
+	check(c.Attendance.MaxShift > 0, "attendance.maxshift must be positive")
+	check(c.Grants.Lookback > 0, "grants.lookback must be positive")
+	check(c.Grants.Interval >= 0, "grants.interval must not be negative")
+	if c.Tracing.OTLPEndpoint != "" {
+		u, err := url.Parse(c.Tracing.OTLPEndpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "tracing.otlp.endpoint %q must be an http or https URL", c.Tracing.OTLPEndpoint)
+	}
+	check(c.Tracing.Sample >= 0 && c.Tracing.Sample <= 1, "tracing.sample must be between 0 and 1")
+	check(c.Tracing.Batch > 0, "tracing.batch must be positive")
+	check(c.Tracing.Interval > 0, "tracing.interval must be positive")
+	_, err = base.LogLevelOption(c.Log.Level)
+	check(err == nil, "log.level: %v", err)
+	for _, sink := range splitConfigList(c.Log.Sinks) {
+		check(sink == "stdout" || sink == "syslog", "log.sinks: unknown sink %q", sink)
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func splitConfigList(val string) []string {
+	list := []string{}
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+//secretSettings are redacted by printConfig, so are URL passwords.
+var secretSettings = []string{"secret", "password", "token"}
+
+//printConfig writes the effective settings of fs as YAML keyed by flag name,
+//the same format the config file accepts.
+func printConfig(fs *flag.FlagSet, w io.Writer) error {
+	settings := yaml.MapSlice{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		var val interface{} = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			val = getter.Get()
+		}
+		if s, ok := val.(string); ok {
+			val = redactSetting(f.Name, s)
+		}
+		settings = append(settings, yaml.MapItem{Key: f.Name, Value: val})
+	})
+	out, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func redactSetting(name, val string) string {
+	if val == "" {
+		return val
+	}
+	for _, secret := range secretSettings {
+		if strings.Contains(strings.ToLower(name), secret) {
+			return base.Redacted
+		}
+	}
+	if u, err := url.Parse(val); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return strings.Replace(val, u.User.String()+"@", url.User(u.User.Username()).String()+":"+base.Redacted+"@", 1)
+		}
+	}
+	return val
+}
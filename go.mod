@@ -9,4 +9,5 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/consul/api v1.13.0
 	github.com/prometheus/client_golang v1.12.2
+	gopkg.in/yaml.v2 v2.4.0
 )
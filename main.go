@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log/syslog"
@@ -10,14 +11,18 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"accessdoor/base"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/metrics/prometheus"
 	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -26,6 +31,7 @@ const (
 	UsersServiceName  = "users"
 	EventsServiceName = "events"
 	httpurl           = "http://"
+	httpsurl          = "https://"
 )
 
 var (
@@ -33,102 +39,229 @@ var (
 		UsersServiceName:  "",
 		EventsServiceName: "",
 	}
+	//upstreamTLS holds the client TLS config per upstream service, used when
+	//Consul says the service speaks https.
+	upstreamTLS = map[string]*tls.Config{}
 )
 
 func main() {
 
-	var (
-		serviceName          = flag.String("service.name", "dooraccess", "Name of microservice")
-		basePath             = flag.String("service.base.path", "dooraccess", "Name of microservice")
-		version              = flag.String("service.version", "v1", "Version of microservice")
-		httpAddr             = flag.String("http.addr", "localhost", "This is the addr at which http requests are accepted (Default localhost)")
-		httpPort             = flag.Int("http.port", 8090, "This is the port at which http requests are accepted (Default :8080)")
-		metricsPort          = flag.Int("metrics.port", 8092, "HTTP metrics listen address (Default 8082)")
-		dataType             = flag.String("service.datatype", "test", "default Test/qa")
-		consulAddr           = flag.String("consul.addr", "localhost:8500", "consul address (Default localhost:8500)")
-		serverTimeout        = flag.Int64("service.timeout", 200000, "service timeout in milliseconds")
-		sysLogAddress        = flag.String("syslog.address", "localhost:514", "default location for the syslogger")
-		usersgetuserURL      = flag.String("proxy.getuserurl", "/users/v1/getuser", "user proxy url")
-		usersauthenticateURL = flag.String("proxy.authenticateurl", "/users/v1/authenticate", "user proxy url")
-		usersupdateaccessURL = flag.String("proxy.updatedaccess", "/users/v1/updateuseraccess", "user proxy url")
-		eventsupdatURL       = flag.String("proxy.eventupdate", "/events/v1/updateevent", "events proxy url")
-		geteventsURL         = flag.String("proxy.getevent", "/events/v1/getevents", "events proxy url")
-		maxAttempts          = flag.Int("outbound.service.attempts", 1, "max attempts for API")
-		apiMaxTime           = flag.Int("outbound.service.maxtime", 500000, "maxTime for API in milliseconds")
-	)
-	flag.Parse()
+	cfg, cfgPath, printOnly, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Printf("exit: %v\n", err)
+		os.Exit(2)
+	}
+	if printOnly {
+		if err := printConfig(flag.CommandLine, os.Stdout); err != nil {
+			fmt.Printf("exit: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Printf("exit: %v\n", err)
+		os.Exit(2)
+	}
 	errs := make(chan error)
 
-	sysLogger, err := syslog.Dial("udp", *sysLogAddress, syslog.LOG_EMERG|syslog.LOG_LOCAL6, *serviceName)
+	if cfg.Audit.Verify {
+		f, err := os.Open(cfg.Audit.Path)
+		if err != nil {
+			fmt.Printf("exit: %v\n", err)
+			os.Exit(1)
+		}
+		last, err := base.VerifyAuditLog(f)
+		f.Close()
+		if err == nil {
+			err = base.CheckAuditHead(cfg.Audit.Path, last)
+		}
+		if err != nil {
+			fmt.Printf("audit log %v is corrupt: %v\n", cfg.Audit.Path, err)
+			os.Exit(1)
+		}
+		fmt.Printf("audit log %v ok: %v entries, head %v\n", cfg.Audit.Path, last.Seq, last.Hash)
+		return
+	}
+
+	sysLogger, err := base.DialSyslog("udp", cfg.Syslog.Address, syslog.LOG_LOCAL6, cfg.Service.Name)
 	if err != nil {
 		fmt.Printf("exit: %v\n", err)
 		return
 	}
 	defer sysLogger.Close()
 
+	//security lines get their own connection since a writer's facility is fixed when it is dialed
+	var securityLogger *base.SyslogConn
+	if cfg.Syslog.SecurityFacility != "" {
+		facility, err := base.SyslogFacility(cfg.Syslog.SecurityFacility)
+		if err != nil {
+			fmt.Printf("exit: %v\n", err)
+			return
+		}
+		securityLogger, err = base.DialSyslog("udp", cfg.Syslog.Address, facility, cfg.Service.Name)
+		if err != nil {
+			fmt.Printf("exit: %v\n", err)
+			return
+		}
+		defer securityLogger.Close()
+	}
+
 	var logger log.Logger
+	var logSink log.Logger
+	var logFilter *base.LoggerSwitch
 	{
-		logger = log.NewJSONLogger(os.Stdout)
-		logger = log.With(logger, "serviceName", *serviceName)
-		logger = log.With(logger, "ip", *httpAddr)
+		var sinks []log.Logger
+		for _, sink := range strings.Split(cfg.Log.Sinks, ",") {
+			switch strings.TrimSpace(sink) {
+			case "stdout":
+				sinks = append(sinks, log.NewJSONLogger(os.Stdout))
+			case "syslog":
+				var security base.SyslogWriter
+				if securityLogger != nil {
+					security = securityLogger
+				}
+				sinks = append(sinks, base.NewSyslogLogger(sysLogger, security, cfg.Syslog.SDID))
+			case "":
+			default:
+				fmt.Printf("exit: unknown log sink %q\n", sink)
+				return
+			}
+		}
+		logSink = base.NewMultiLogger(sinks...)
+		//redaction and filtering sit below log.With so bound values and the caller depth are kept
+		filtered, err := newLogFilter(logSink, cfg)
+		if err != nil {
+			fmt.Printf("exit: %v\n", err)
+			return
+		}
+		logFilter = base.NewLoggerSwitch(filtered)
+		logger = log.With(logFilter, "serviceName", cfg.Service.Name)
+		logger = log.With(logger, "ip", cfg.HTTP.Addr)
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
+	if cfgPath != "" {
+		logger.Log("config", cfgPath)
+	}
+
+	var spanExporter base.SpanExporter
+	var otlpExporter *base.OTLPExporter
+	if cfg.Tracing.OTLPEndpoint != "" || cfg.Tracing.OTLPFile != "" {
+		otlpExporter, err = base.NewOTLPExporter(base.OTLPConfig{
+			Endpoint:  cfg.Tracing.OTLPEndpoint,
+			Path:      cfg.Tracing.OTLPFile,
+			BatchSize: cfg.Tracing.Batch,
+			Interval:  time.Duration(cfg.Tracing.Interval) * time.Millisecond,
+			Timeout:   10 * time.Second,
+		}, cfg.Service.Name, logger)
+		if err != nil {
+			logger.Log("exit", err)
+			return
+		}
+		spanExporter = otlpExporter
+	}
+	tracer := base.NewTracer(spanExporter, cfg.Tracing.Sample)
+
+	apiTLS, err := serverTLS(cfg.HTTP.TLS, cfg.HTTP.ClientAuth)
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
+	metricsTLS, err := serverTLS(cfg.Metrics.TLS, base.ClientAuthRequire)
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
+	var upstreamKeyPair *base.KeyPair
+	if cfg.Upstream.TLS.Cert != "" {
+		upstreamKeyPair, err = base.LoadKeyPair(cfg.Upstream.TLS.Cert, cfg.Upstream.TLS.Key)
+		if err != nil {
+			logger.Log("exit", err)
+			return
+		}
+	}
+	clientTLS, err := base.ClientTLSConfig(cfg.Upstream.TLS.CA, upstreamKeyPair)
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
 
-	consulClient, registrar, err := base.Register(*serviceName, *consulAddr, *httpAddr, *httpPort, []string{}, logger)
+	scheme := "http"
+	if apiTLS != nil {
+		scheme = "https"
+	}
+	consulClient, registrar, err := base.Register(cfg.Service.Name, cfg.Consul.Addr, scheme, cfg.HTTP.Addr, cfg.HTTP.Port, []string{}, logger)
 	if err != nil || registrar == nil {
 		logger.Log("exit", err)
 		return
 	}
 	registrar.Register()
+	//every return from here on leaves Consul, the shutdown leaves it earlier
+	var deregisterOnce sync.Once
+	deregister := func() { deregisterOnce.Do(registrar.Deregister) }
+	defer deregister()
 	//get service ip from consul. since the instance ips are dynamic using consul agent to fetch them.
+	//the scheme and the name in the certificate come from the service metadata
 	for service, _ := range proxyservices {
-		serviceinfo, _, _ := consulClient.Health().Service(service, "", true, nil)
-		proxyservices[service] = httpurl + serviceinfo[0].Service.Address + ":" + strconv.Itoa(serviceinfo[0].Service.Port)
+		instance, err := base.HealthyInstance(consulClient, service)
+		if err != nil {
+			logger.Log("exit", err)
+			return
+		}
+		serviceurl := httpurl
+		if instance.Meta[base.MetaScheme] == "https" {
+			serviceurl = httpsurl
+		}
+		proxyservices[service] = serviceurl + instance.Address + ":" + strconv.Itoa(instance.Port)
+		upstreamTLS[service] = clientTLS.Clone()
+		upstreamTLS[service].ServerName = instance.Meta[base.MetaTLSServerName]
 	}
 	labelNames := []string{"method"}
-	constLabels := map[string]string{"serviceName": *serviceName, "version": *version, "dataType": *dataType}
-	getuserinfoURL, err := url.Parse(proxyservices[UsersServiceName] + *usersgetuserURL)
+	constLabels := map[string]string{"serviceName": cfg.Service.Name, "version": cfg.Service.Version, "dataType": cfg.Service.DataType}
+	latencyBuckets, err := base.ParseBuckets(cfg.Metrics.Buckets)
 	if err != nil {
-		logger.Log("error while parsing getuserinfoURL" + err.Error())
-	}
-
-	authenticateuserURL, err := url.Parse(proxyservices[UsersServiceName] + *usersauthenticateURL)
-	if err != nil {
-		logger.Log("error while parsing authenticateuserURL" + err.Error())
-	}
-
-	updateuseraccessURL, err := url.Parse(proxyservices[UsersServiceName] + *usersupdateaccessURL)
-	if err != nil {
-		logger.Log("error while parsing updateuseraccessURL" + err.Error())
+		logger.Log("exit", err)
+		return
 	}
-
-	updateeventURL, err := url.Parse(proxyservices[EventsServiceName] + *eventsupdatURL)
-	if err != nil {
-		logger.Log("error while parsing updateevents" + err.Error())
+	upstreamLabels := []string{"service", "instance", "class", "attempt"}
+	proxyMetrics := &base.ProxyMetrics{
+		Attempts: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Name:        "upstream_attempts_total",
+			Help:        "Upstream call attempts by service, instance, status class and attempt number.",
+			ConstLabels: constLabels,
+		}, upstreamLabels),
+		AttemptDuration: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Name:        "upstream_attempt_duration_seconds",
+			Help:        "Upstream call attempt duration by service, instance, status class and attempt number.",
+			ConstLabels: constLabels,
+			Buckets:     latencyBuckets,
+		}, upstreamLabels),
+		Connections: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Name:        "upstream_connections_total",
+			Help:        "Connections used by upstream attempts, new or reused from the pool.",
+			ConstLabels: constLabels,
+		}, []string{"service", "instance", "state"}),
+		OpenConnections: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Name:        "upstream_open_connections",
+			Help:        "Open connections in the upstream pool, idle or in use.",
+			ConstLabels: constLabels,
+		}, []string{"service", "instance"}),
 	}
 
-	eventsgetURL, err := url.Parse(proxyservices[EventsServiceName] + *geteventsURL)
+	usersProxy, eventsProxy, err := newProxies(cfg, tracer, proxyMetrics, logger)
 	if err != nil {
-		logger.Log("error while parsing eventsget" + err.Error())
+		logger.Log("exit", err)
+		return
 	}
+	//the switches let a reload replace the upstream endpoints under the middlewares
+	usersSwitch := base.NewUsersSwitch(usersProxy)
+	eventsSwitch := base.NewEventsSwitch(eventsProxy)
 
-	var eventsService base.EventsService
-	eventsService = base.NewEventsProxy(context.Background(),
-		base.ProxyConfig{
-			URL:         eventsgetURL,
-			Method:      http.MethodGet,
-			MaxAttempts: *maxAttempts,
-			MaxTime:     time.Duration(*apiMaxTime) * time.Millisecond,
-		},
-		base.ProxyConfig{
-			URL:         updateeventURL,
-			Method:      http.MethodPost,
-			MaxAttempts: *maxAttempts,
-			MaxTime:     time.Duration(*apiMaxTime) * time.Millisecond,
-		},
-		logger)(eventsService)
+	var eventsService base.EventsService = eventsSwitch
+	//a span around every layer, so a trace shows where the time of a call went
+	eventsService = base.NewEventsProxyTracingMiddleware(tracer, "events.proxy")(eventsService)
 	eventsService = base.NewEventsProxyLoggingMiddleware(logger)(eventsService)
+	eventsService = base.NewEventsProxyTracingMiddleware(tracer, "events.logging")(eventsService)
 	eventsService = base.NewEventsProxyInstrumentingService(labelNames,
 		prometheus.NewCounterFrom(stdprometheus.CounterOpts{
 			Name:        "proxy_request_count",
@@ -140,34 +273,18 @@ func main() {
 			Help:        "Number of errors.",
 			ConstLabels: constLabels,
 		}, labelNames),
-		prometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+		prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
 			Name:        "proxy_outbound_request_latency_seconds",
 			Help:        "Total duration of requests in request_latency_seconds.",
 			ConstLabels: constLabels,
+			Buckets:     latencyBuckets,
 		}, labelNames))(eventsService)
+	eventsService = base.NewEventsProxyTracingMiddleware(tracer, "events.instrumenting")(eventsService)
 
-	var usersService base.UsersService
-	usersService = base.NewUsersProxy(context.Background(),
-		base.ProxyConfig{
-			URL:         getuserinfoURL,
-			Method:      http.MethodGet,
-			MaxAttempts: *maxAttempts,
-			MaxTime:     time.Duration(*apiMaxTime) * time.Millisecond,
-		},
-		base.ProxyConfig{
-			URL:         authenticateuserURL,
-			Method:      http.MethodPost,
-			MaxAttempts: *maxAttempts,
-			MaxTime:     time.Duration(*apiMaxTime) * time.Millisecond,
-		},
-		base.ProxyConfig{
-			URL:         updateuseraccessURL,
-			Method:      http.MethodPost,
-			MaxAttempts: *maxAttempts,
-			MaxTime:     time.Duration(*apiMaxTime) * time.Millisecond,
-		},
-		logger)(usersService)
+	var usersService base.UsersService = usersSwitch
+	usersService = base.NewUsersProxyTracingMiddleware(tracer, "users.proxy")(usersService)
 	usersService = base.NewUsersProxyLoggingMiddleware(logger)(usersService)
+	usersService = base.NewUsersProxyTracingMiddleware(tracer, "users.logging")(usersService)
 	usersService = base.NewUsersProxyInstrumentingService(labelNames,
 		prometheus.NewCounterFrom(stdprometheus.CounterOpts{
 			Name:        "outbound_request_count",
@@ -179,17 +296,121 @@ func main() {
 			Help:        "Number of errors.",
 			ConstLabels: constLabels,
 		}, labelNames),
-		prometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+		prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
 			Name:        "outbound_request_latency_seconds",
 			Help:        "Total duration of requests in request_latency_seconds.",
 			ConstLabels: constLabels,
+			Buckets:     latencyBuckets,
 		}, labelNames))(usersService)
+	usersService = base.NewUsersProxyTracingMiddleware(tracer, "users.instrumenting")(usersService)
 
+	auditLog, err := base.OpenAuditLog(cfg.Audit.Path, logger)
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
+	defer auditLog.Close()
+
+	catalog, err := base.LoadDoorCatalog(cfg.Doors.Catalog)
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
+	doors := base.NewDoors(catalog)
+	roster, err := base.LoadUserRoster(cfg.Users.Roster)
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
+	occupancy := base.NewOccupancy(doors, time.Duration(cfg.Occupancy.Stale)*time.Millisecond)
+	go occupancy.Rebuild(context.Background(), eventsService, roster, logger)
+	muster := base.NewMuster(doors, occupancy, usersService, cfg.Muster.Sessions, logger)
+	doorIndex := base.NewDoorIndex(time.Duration(cfg.Doors.EventsRetention) * time.Millisecond)
+	go doorIndex.Rebuild(context.Background(), usersService, eventsService, roster, logger)
+	go doorIndex.Run(context.Background(), time.Hour)
+	rollup := base.NewRollup(time.Duration(cfg.Usage.Retention) * time.Millisecond)
+	go rollup.Rebuild(context.Background(), eventsService, roster, logger)
+	attendance := base.NewAttendance(doors, eventsService, roster, time.Duration(cfg.Attendance.MaxShift)*time.Millisecond)
+	investigator := base.NewInvestigator(doors, usersService, eventsService, roster, logger)
+
+	hub := base.NewHub(cfg.Stream.RingSize, cfg.Stream.SubscriberBuffer)
+	webhooks, err := base.NewWebhookDispatcher(base.WebhookConfig{
+		Workers:       cfg.Webhook.Workers,
+		OutboxSize:    cfg.Webhook.Outbox,
+		MaxAttempts:   cfg.Webhook.Attempts,
+		BaseBackoff:   time.Duration(cfg.Webhook.Backoff) * time.Millisecond,
+		MaxBackoff:    time.Duration(cfg.Webhook.MaxBackoff) * time.Millisecond,
+		Timeout:       time.Duration(cfg.Webhook.Timeout) * time.Millisecond,
+		MaxDeadLetter: cfg.Webhook.DeadLetters,
+		Allow:         splitConfigList(cfg.Webhook.Allow),
+		Path:          cfg.Webhook.Path,
+	}, logger)
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
+
+	//alerts are about access decisions, they share the security facility
+	alertSyslog := sysLogger
+	if securityLogger != nil {
+		alertSyslog = securityLogger
+	}
+	alertSinks := map[string]base.AlertSink{
+		base.AlertSinkLog:     base.NewLogAlertSink(logger),
+		base.AlertSinkSyslog:  base.NewSyslogAlertSink(alertSyslog),
+		base.AlertSinkWebhook: base.NewWebhookAlertSink(webhooks),
+	}
+	alertRules, err := base.LoadAlertRules(cfg.Alerts.Rules, alertSinks)
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
+	alerts := base.NewAlertEngine(alertRules, doors, alertSinks)
+	accessMetrics := base.NewAccessChangeMetrics(prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name:        "access_changes_total",
+		Help:        "Access changes by the role of their actor.",
+		ConstLabels: constLabels,
+	}, []string{"role"}))
+	stdprometheus.MustRegister(stdprometheus.NewGaugeFunc(stdprometheus.GaugeOpts{
+		Name:        "webhook_outbox_backlog",
+		Help:        "Webhook deliveries waiting in the outbox.",
+		ConstLabels: constLabels,
+	}, func() float64 { return float64(webhooks.Backlog()) }))
+	readiness := &base.Readiness{}
 	var s base.Service
 	{
 
-		s = base.NewService(logger, usersService, eventsService)
+		s = base.NewService(logger, usersService, eventsService,
+			base.WithReadiness(readiness),
+			base.WithDecisionListener(hub),
+			base.WithDecisionListener(webhooks),
+			base.WithAccessChangeListener(webhooks),
+			base.WithAccessAttemptListener(auditLog),
+			base.WithDecisionListener(roster),
+			base.WithAccessChangeListener(roster),
+			base.WithDecisionListener(occupancy),
+			base.WithDecisionListener(muster),
+			base.WithDecisionListener(doorIndex),
+			base.WithAccessChangeListener(doorIndex),
+			base.WithDecisionListener(rollup),
+			base.WithDecisionListener(alerts),
+			base.WithAccessChangeListener(accessMetrics),
+		)
+		s = base.NewTracingMiddleware(tracer, "service")(s)
+		s = base.NewDecisionInstrumentingService(doors,
+			prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Name:        "access_decisions_total",
+				Help:        "Access decisions by door, zone, outcome and reason.",
+				ConstLabels: constLabels,
+			}, []string{"door", "zone", "outcome", "reason"}),
+			prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+				Name:        "door_last_access_timestamp_seconds",
+				Help:        "Unix time of the last granted access per door.",
+				ConstLabels: constLabels,
+			}, []string{"door"}))(s)
+		s = base.NewTracingMiddleware(tracer, "service.decisions")(s)
 		s = base.NewLoggingMiddleware(logger)(s)
+		s = base.NewTracingMiddleware(tracer, "service.logging")(s)
 		s = base.NewInstrumentingService(labelNames, prometheus.NewCounterFrom(stdprometheus.CounterOpts{
 			Name:        "request_count",
 			Help:        "Number of requests received.",
@@ -200,36 +421,127 @@ func main() {
 				Help:        "Number of errors.",
 				ConstLabels: constLabels,
 			}, labelNames),
-			prometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+			prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
 				Name:        "request_latency_seconds",
 				Help:        "Total duration of requests in request_latency_seconds.",
 				ConstLabels: constLabels,
+				Buckets:     latencyBuckets,
 			}, labelNames),
 			s)
+		s = base.NewTracingMiddleware(tracer, "service.instrumenting")(s)
 	}
+	grants := base.NewGrantAnalyzer(doors, s, usersService, eventsService, roster,
+		time.Duration(cfg.Grants.Lookback)*time.Millisecond, logger)
+	go grants.Run(context.Background(), time.Duration(cfg.Grants.Interval)*time.Millisecond)
 
-	h := base.MakeHTTPHandler(s, logger, *version, *basePath)
-	h = http.TimeoutHandler(h, time.Duration(*serverTimeout)*time.Millisecond, "")
+	v2Route := "/" + cfg.Service.BasePath + "/v2"
+	apiRouter := mux.NewRouter()
+	apiRouter.Use(base.TraceRoute)
+	base.MeasureRoutes(apiRouter)
+	apiRouter.PathPrefix(v2Route + "/webhooks").Handler(base.MakeWebhookHandler(webhooks, usersService, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/audit").Handler(base.MakeAuditHandler(auditLog, usersService, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/occupancy").Handler(base.MakeOccupancyHandler(occupancy, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/muster").Handler(base.MakeMusterHandler(muster, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/doors").Handler(base.MakeDoorIndexHandler(doorIndex, usersService, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/usage").Handler(base.MakeRollupHandler(rollup, usersService, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/attendance").Handler(base.MakeAttendanceHandler(attendance, usersService, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/investigations").Handler(base.MakeInvestigationHandler(investigator, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/alerts").Handler(base.MakeAlertHandler(alerts, logger, v2Route))
+	apiRouter.PathPrefix(v2Route + "/grants").Handler(base.MakeGrantHandler(grants, logger, v2Route))
+	httpMetrics := &base.HTTPMetrics{
+		Requests: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Name:        "http_requests_total",
+			Help:        "HTTP requests by route template and status code.",
+			ConstLabels: constLabels,
+		}, []string{"route", "code"}),
+		Duration: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Name:        "http_request_duration_seconds",
+			Help:        "HTTP request duration by route template and status code.",
+			ConstLabels: constLabels,
+			Buckets:     latencyBuckets,
+		}, []string{"route", "code"}),
+		ResponseSize: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Name:        "http_response_size_bytes",
+			Help:        "HTTP response body size by route template and status code.",
+			ConstLabels: constLabels,
+			Buckets:     stdprometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"route", "code"}),
+		InFlight: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Name:        "http_requests_in_flight",
+			Help:        "HTTP requests being served by route template.",
+			ConstLabels: constLabels,
+		}, []string{"route"}),
+		Timeouts: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Name:        "http_request_timeouts_total",
+			Help:        "HTTP requests that ran past service.timeout.",
+			ConstLabels: constLabels,
+		}, []string{"route"}),
+		Panics: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Name:        "http_request_panics_total",
+			Help:        "HTTP requests that panicked and were recovered.",
+			ConstLabels: constLabels,
+		}, []string{"route"}),
+	}
+	apiRouter.PathPrefix("/").Handler(base.MakeHTTPHandler(s, logger, cfg.Service.Version, cfg.Service.BasePath))
+	h := base.NewHandlerSwitch(http.TimeoutHandler(apiRouter, time.Duration(cfg.Service.Timeout)*time.Millisecond, ""))
 
+	//streaming routes are long lived and cannot sit behind the TimeoutHandler
+	r := mux.NewRouter()
+	r.Use(base.TraceRoute)
+	base.MeasureRoutes(r)
+	r.Methods(http.MethodGet).Path(v2Route + "/events/stream").Handler(
+		base.MakeStreamHandler(hub, logger, time.Duration(cfg.Stream.Heartbeat)*time.Millisecond))
+	r.Methods(http.MethodGet).Path(v2Route + "/events/export").Handler(
+		base.MakeExportHandler(eventsService, usersService, roster, logger))
+	r.PathPrefix("/").Handler(h)
+
+	actorTrust, err := base.NewActorTrust(splitConfigList(cfg.HTTP.Proxies))
+	if err != nil {
+		logger.Log("exit", err)
+		return
+	}
 	httpServer := http.Server{
-		Addr:    ":" + strconv.Itoa(*httpPort),
-		Handler: handlers.RecoveryHandler(handlers.RecoveryLogger(base.NewPanicLogger(logger)))(h),
+		Addr:      ":" + strconv.Itoa(cfg.HTTP.Port),
+		Handler:   handlers.RecoveryHandler(handlers.RecoveryLogger(base.NewPanicLogger(logger)))(base.NewHTTPMetricsHandler(httpMetrics, base.NewRequestIDHandler(base.NewTracingHandler(tracer, requireClientCert(base.NewActorHandler(actorTrust, r), cfg.HTTP.TLS.CA, cfg.HTTP.ClientAuth, "/healthcheck"))))),
+		TLSConfig: apiTLS,
 	}
 
+	httpServer.RegisterOnShutdown(hub.Close)
+
 	go func() {
-		errs <- httpServer.ListenAndServe()
+		logger.Log("transport", "HTTP", "addr", cfg.HTTP.Port, "tls", apiTLS != nil)
+		errs <- serve(&httpServer)
 	}()
 
 	metricsServer := http.Server{
-		Addr:    ":" + strconv.Itoa(*metricsPort),
-		Handler: promhttp.Handler(),
+		Addr:      ":" + strconv.Itoa(cfg.Metrics.Port),
+		Handler:   requireClientCert(promhttp.Handler(), cfg.Metrics.TLS.CA, base.ClientAuthRequire),
+		TLSConfig: metricsTLS,
 	}
 
 	go func() {
-		logger.Log("transport", "HTTP", "addr", *metricsPort)
-		errs <- metricsServer.ListenAndServe()
+		logger.Log("transport", "HTTP", "addr", cfg.Metrics.Port, "tls", metricsTLS != nil)
+		errs <- serve(&metricsServer)
 	}()
 
+	reload := newReloader(flag.CommandLine, cfgPath, catalog, reloadTargets{
+		logSink:      logSink,
+		logFilter:    logFilter,
+		users:        usersSwitch,
+		events:       eventsSwitch,
+		tracer:       tracer,
+		proxyMetrics: proxyMetrics,
+		api:          apiRouter,
+		apiTimeout:   h,
+		doors:        doors,
+		alerts:       alerts,
+		alertSinks:   alertSinks,
+	}, reloadMetrics(constLabels), logger)
+	go reload.watchSignal()
+	if cfg.Reload.Watch > 0 {
+		go reload.watchFiles(time.Duration(cfg.Reload.Watch) * time.Millisecond)
+	}
+
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
@@ -237,9 +549,124 @@ func main() {
 	}()
 
 	errMain := <-errs
-	//exit gracefully
-	errMetricsServer := metricsServer.Shutdown(context.Background())
-	errHTTPServer := httpServer.Shutdown(context.Background())
-	logger.Log("exit", errMain, "httpErr", errHTTPServer, "metricsErr", errMetricsServer)
+	//exit gracefully: fail the health check and leave Consul first, so clients
+	//stop sending before the listener closes
+	logger.Log("shutdown", errMain, "delay", cfg.Shutdown.Delay, "timeout", cfg.Shutdown.Timeout, "flush", cfg.Shutdown.Flush)
+	readiness.Stop()
+	deregister()
+	time.Sleep(time.Duration(cfg.Shutdown.Delay) * time.Millisecond)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), time.Duration(cfg.Shutdown.Timeout)*time.Millisecond)
+	defer cancelDrain()
+	errHTTPServer := httpServer.Shutdown(drainCtx)
+	if errHTTPServer != nil {
+		//requests still running at the deadline are cut off
+		httpServer.Close()
+	}
+	//decisions made while draining are queued by now, the outbox is flushed
+	//after with its own deadline so a slow drain cannot use it up
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), time.Duration(cfg.Shutdown.Flush)*time.Millisecond)
+	defer cancelFlush()
+	errWebhooks := webhooks.Close(flushCtx)
+	var errTracing error
+	if otlpExporter != nil {
+		errTracing = otlpExporter.Close(flushCtx)
+	}
+	//metrics stay up while draining so the drain can be watched
+	errMetricsServer := metricsServer.Shutdown(flushCtx)
+	//syslog and the audit log are closed by the deferred calls after this line
+	logger.Log("exit", errMain, "httpErr", errHTTPServer, "metricsErr", errMetricsServer, "webhooksErr", errWebhooks, "tracingErr", errTracing)
+
+}
+
+//newLogFilter puts redaction and the level filter of cfg in front of sink.
+func newLogFilter(sink log.Logger, cfg *Config) (log.Logger, error) {
+	levelOption, err := base.LogLevelOption(cfg.Log.Level)
+	if err != nil {
+		return nil, err
+	}
+	logger := base.NewRedactingLogger(sink, strings.Split(cfg.Log.Redact, ","))
+	return level.NewFilter(logger, levelOption), nil
+}
 
+//newProxies builds the users and events upstream endpoints from the proxy and
+//outbound settings of cfg.
+func newProxies(cfg *Config, tracer *base.Tracer, proxyMetrics *base.ProxyMetrics, logger log.Logger) (base.UsersService, base.EventsService, error) {
+	parse := func(service, path string) (*url.URL, error) {
+		u, err := url.Parse(proxyservices[service] + path)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing %v: %v", path, err)
+		}
+		return u, nil
+	}
+	proxyConfig := func(service, path, method string) (base.ProxyConfig, error) {
+		u, err := parse(service, path)
+		return base.ProxyConfig{
+			URL:         u,
+			Method:      method,
+			MaxAttempts: cfg.Outbound.Attempts,
+			MaxTime:     time.Duration(cfg.Outbound.MaxTime) * time.Millisecond,
+			Tracer:      tracer,
+			Service:     service,
+			Metrics:     proxyMetrics,
+			TLS:         upstreamTLS[service],
+		}, err
+	}
+	getuserinfo, err := proxyConfig(UsersServiceName, cfg.Proxy.GetUserURL, http.MethodGet)
+	if err != nil {
+		return nil, nil, err
+	}
+	authenticateuser, err := proxyConfig(UsersServiceName, cfg.Proxy.AuthenticateURL, http.MethodPost)
+	if err != nil {
+		return nil, nil, err
+	}
+	updateuseraccess, err := proxyConfig(UsersServiceName, cfg.Proxy.UpdateAccessURL, http.MethodPost)
+	if err != nil {
+		return nil, nil, err
+	}
+	eventsget, err := proxyConfig(EventsServiceName, cfg.Proxy.GetEventURL, http.MethodGet)
+	if err != nil {
+		return nil, nil, err
+	}
+	updateevent, err := proxyConfig(EventsServiceName, cfg.Proxy.EventUpdateURL, http.MethodPost)
+	if err != nil {
+		return nil, nil, err
+	}
+	var usersService base.UsersService
+	usersService = base.NewUsersProxy(context.Background(), getuserinfo, authenticateuser, updateuseraccess, logger)(usersService)
+	var eventsService base.EventsService
+	eventsService = base.NewEventsProxy(context.Background(), eventsget, updateevent, logger)(eventsService)
+	return usersService, eventsService, nil
+}
+
+//serverTLS returns the TLS config of a listener, nil when files has no
+//certificate. Client certificates are only asked for when files has a CA.
+func serverTLS(files TLSFiles, clientAuth string) (*tls.Config, error) {
+	if files.Cert == "" {
+		return nil, nil
+	}
+	keyPair, err := base.LoadKeyPair(files.Cert, files.Key)
+	if err != nil {
+		return nil, err
+	}
+	if files.CA == "" {
+		clientAuth = base.ClientAuthNone
+	}
+	return base.ServerTLSConfig(keyPair, files.CA, clientAuth)
+}
+
+//requireClientCert wraps next in base.RequireClientCert when clientCA is set
+//and clientAuth requires a certificate.
+func requireClientCert(next http.Handler, clientCA, clientAuth string, exempt ...string) http.Handler {
+	if clientCA == "" || clientAuth != base.ClientAuthRequire {
+		return next
+	}
+	return base.RequireClientCert(next, exempt...)
+}
+
+//serve runs server, over TLS when it has a TLSConfig.
+func serve(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
 }
@@ -1,10 +1,86 @@
 package model
 
 import (
+	"time"
 	usermodel "users/model"
 )
 
+//UserResponse is the v1 getuser response. Events map a door to a time.Time.String() timestamp.
 type UserResponse struct {
-	UserInfo usermodel.User      `json:"userinfo"`
-	Events   []map[string]string `json:"events"`
+	UserInfo   usermodel.User      `json:"userinfo"`
+	Events     []map[string]string `json:"events"`
+	NextCursor string              `json:"nextcursor,omitempty"`
 }
+
+//UserEvents is the v2 getuser response.
+type UserEvents struct {
+	UserInfo   usermodel.User `json:"userinfo"`
+	Events     []Event        `json:"events"`
+	NextCursor string         `json:"nextcursor,omitempty"`
+}
+
+//Event is a single access decision. Timestamp marshals as RFC 3339 with zone.
+//Time and Relative are only filled when a consumer asks for a display format.
+type Event struct {
+	Username  string    `json:"username,omitempty"`
+	Door      string    `json:"door"`
+	Timestamp time.Time `json:"timestamp"`
+	Time      string    `json:"time,omitempty"`
+	Relative  string    `json:"relative,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Device    string    `json:"device,omitempty"`
+	RequestID string    `json:"requestid,omitempty"`
+}
+
+//AuthenticateRequest is the authenticate request body. Device is optional and
+//identifies the door controller that read the badge.
+type AuthenticateRequest struct {
+	Username   string `json:"username"`
+	AccessDoor string `json:"accessdoor"`
+	Device     string `json:"device,omitempty"`
+}
+
+//AccessChange describes an UpdateUserAccess call. Doors is what was requested,
+//Before and After are the target's DoorAccess around the change. Outcome is
+//applied, denied or failed with Error telling why, After is Before when
+//nothing was applied.
+type AccessChange struct {
+	Actor     string          `json:"actor,omitempty"`
+	ActorRole string          `json:"actorrole,omitempty"`
+	Username  string          `json:"username"`
+	Doors     usermodel.Doors `json:"dooraccess"`
+	Before    usermodel.Doors `json:"before"`
+	After     usermodel.Doors `json:"after"`
+	Timestamp time.Time       `json:"timestamp"`
+	RequestID string          `json:"requestid,omitempty"`
+	SourceIP  string          `json:"sourceip,omitempty"`
+	Outcome   string          `json:"outcome,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+//EventQuery narrows the event history returned for a user.
+//Zero values mean "no restriction".
+type EventQuery struct {
+	Username string
+	Door     string
+	From     time.Time
+	To       time.Time
+	Outcome  string
+	Order    string
+	Limit    int
+	Cursor   string
+}
+
+const (
+	OutcomeGranted = "granted"
+	OutcomeDenied  = "denied"
+	OutcomeApplied = "applied"
+	OutcomeFailed  = "failed"
+
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+
+	RoleAdmin   = "admin"
+	RoleUser    = "user"
+	RoleUnknown = "unknown"
+)
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"accessdoor/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+//reloadable lists the settings a reload applies, a name ending in . covers
+//every setting below it. Other changes are logged and wait for a restart.
+var reloadable = []string{
+	"proxy.",
+	"outbound.service.attempts",
+	"outbound.service.maxtime",
+	"service.timeout",
+	"log.level",
+	"log.redact",
+	"doors.catalog",
+	"alerts.rules",
+}
+
+func isReloadable(name string) bool {
+	return matchSetting(name, reloadable)
+}
+
+//matchSetting tells whether name is one of settings, a name ending in . in
+//settings matches every setting below it.
+func matchSetting(name string, settings []string) bool {
+	for _, setting := range settings {
+		if name == setting || strings.HasSuffix(setting, ".") && strings.HasPrefix(name, setting) {
+			return true
+		}
+	}
+	return false
+}
+
+//settingsChanged tells whether any of settings differs between before and after.
+func settingsChanged(before, after map[string]string, settings ...string) bool {
+	for name, val := range after {
+		if before[name] != val && matchSetting(name, settings) {
+			return true
+		}
+	}
+	return false
+}
+
+//sameAlertRules compares the rules as they are written in the rules file.
+func sameAlertRules(a, b []base.AlertRule) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+//reloadTargets are the parts of the running service a reload replaces.
+type reloadTargets struct {
+	logSink      log.Logger
+	logFilter    *base.LoggerSwitch
+	users        *base.UsersSwitch
+	events       *base.EventsSwitch
+	tracer       *base.Tracer
+	proxyMetrics *base.ProxyMetrics
+	api          http.Handler
+	apiTimeout   *base.HandlerSwitch
+	doors        *base.Doors
+	alerts       *base.AlertEngine
+	alertSinks   map[string]base.AlertSink
+}
+
+type reloadMetricsSet struct {
+	reloads     metrics.Counter
+	lastSuccess metrics.Gauge
+	pending     metrics.Gauge
+}
+
+func reloadMetrics(constLabels map[string]string) reloadMetricsSet {
+	return reloadMetricsSet{
+		reloads: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Name:        "config_reloads_total",
+			Help:        "Configuration reloads by result, success or failure.",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+		lastSuccess: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Name:        "config_last_reload_success_timestamp_seconds",
+			Help:        "Unix time of the last successful configuration reload.",
+			ConstLabels: constLabels,
+		}, []string{}),
+		pending: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Name:        "config_pending_restart_settings",
+			Help:        "Changed settings that only apply after a restart.",
+			ConstLabels: constLabels,
+		}, []string{}),
+	}
+}
+
+//reloader applies config changes to the running service. Everything a reload
+//needs is prepared first and only swapped in when all of it succeeded, so a
+//bad file leaves the service as it was.
+type reloader struct {
+	mtx      sync.Mutex
+	args     []string
+	cfgPath  string
+	settings map[string]string
+	catalog  base.DoorCatalog
+	rules    []base.AlertRule
+	mtimes   map[string]time.Time
+	targets  reloadTargets
+	metrics  reloadMetricsSet
+	logger   log.Logger
+}
+
+//newReloader starts from the settings in fs, which were parsed from the
+//command line, and catalog, the door catalog in use.
+func newReloader(fs *flag.FlagSet, cfgPath string, catalog base.DoorCatalog, targets reloadTargets, m reloadMetricsSet, logger log.Logger) *reloader {
+	r := &reloader{
+		args:     os.Args[1:],
+		cfgPath:  cfgPath,
+		settings: settingsOf(fs),
+		catalog:  catalog,
+		rules:    targets.alerts.Rules(),
+		targets:  targets,
+		metrics:  m,
+		logger:   logger,
+	}
+	r.mtimes = modTimes(r.paths())
+	return r
+}
+
+//settingsOf returns the value of every setting in fs.
+func settingsOf(fs *flag.FlagSet) map[string]string {
+	settings := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "print-config" {
+			settings[f.Name] = f.Value.String()
+		}
+	})
+	return settings
+}
+
+//watchSignal reloads on every SIGHUP.
+func (r *reloader) watchSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		r.reload("signal")
+	}
+}
+
+//watchFiles reloads when the config, door catalog or alert rules file changes,
+//checking every interval.
+func (r *reloader) watchFiles(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.mtx.Lock()
+		before, paths := r.mtimes, r.paths()
+		r.mtx.Unlock()
+		for path, mtime := range modTimes(paths) {
+			if !before[path].Equal(mtime) {
+				r.reload("file")
+				break
+			}
+		}
+	}
+}
+
+//paths returns the watched files. r.mtx must be held.
+func (r *reloader) paths() []string {
+	return []string{r.cfgPath, r.settings["doors.catalog"], r.settings["alerts.rules"]}
+}
+
+//modTimes returns the modification time of every file in paths. A missing
+//file has the zero time, so it counts as changed when it shows up.
+func modTimes(paths []string) map[string]time.Time {
+	mtimes := map[string]time.Time{}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		var mtime time.Time
+		if info, err := os.Stat(path); err == nil {
+			mtime = info.ModTime()
+		}
+		mtimes[path] = mtime
+	}
+	return mtimes
+}
+
+func (r *reloader) reload(trigger string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	//taken before reading the files so a write during the reload triggers another
+	r.mtimes = modTimes(r.paths())
+	err := r.apply(trigger)
+	for path, mtime := range modTimes(r.paths()) {
+		if _, ok := r.mtimes[path]; !ok {
+			r.mtimes[path] = mtime
+		}
+	}
+	if err != nil {
+		r.metrics.reloads.With("result", "failure").Add(1)
+		r.logger.Log("reload", trigger, "err", err)
+		return
+	}
+	r.metrics.reloads.With("result", "success").Add(1)
+	r.metrics.lastSuccess.Set(float64(time.Now().Unix()))
+}
+
+//apply builds the parts whose settings or files changed and swaps them in
+//once all of them built. The rest of the service is left alone.
+func (r *reloader) apply(trigger string) error {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	cfg, _, _, err := loadConfig(fs, r.args)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	settings := settingsOf(fs)
+
+	var swaps []func()
+	var replaced []string
+	if settingsChanged(r.settings, settings, "log.level", "log.redact") {
+		filter, err := newLogFilter(r.targets.logSink, cfg)
+		if err != nil {
+			return err
+		}
+		swaps = append(swaps, func() { r.targets.logFilter.Swap(filter) })
+		replaced = append(replaced, "log")
+	}
+	if settingsChanged(r.settings, settings, "proxy.", "outbound.service.attempts", "outbound.service.maxtime") {
+		users, events, err := newProxies(cfg, r.targets.tracer, r.targets.proxyMetrics, r.logger)
+		if err != nil {
+			return err
+		}
+		swaps = append(swaps, func() {
+			r.targets.users.Swap(users)
+			r.targets.events.Swap(events)
+		})
+		replaced = append(replaced, "proxies")
+	}
+	if settingsChanged(r.settings, settings, "service.timeout") {
+		api := http.TimeoutHandler(r.targets.api, time.Duration(cfg.Service.Timeout)*time.Millisecond, "")
+		swaps = append(swaps, func() { r.targets.apiTimeout.Swap(api) })
+		replaced = append(replaced, "timeout")
+	}
+	//the files can change under the same path, so they are always read
+	catalog, err := base.LoadDoorCatalog(cfg.Doors.Catalog)
+	if err != nil {
+		return err
+	}
+	added, removed, changed := base.DiffCatalogs(r.catalog, catalog)
+	if len(added)+len(removed)+len(changed) > 0 {
+		swaps = append(swaps, func() { r.targets.doors.Replace(catalog) })
+		replaced = append(replaced, "doors")
+	}
+	rules, err := base.LoadAlertRules(cfg.Alerts.Rules, r.targets.alertSinks)
+	if err != nil {
+		return err
+	}
+	if !sameAlertRules(r.rules, rules) {
+		swaps = append(swaps, func() { r.targets.alerts.SetRules(rules) })
+		replaced = append(replaced, "alerts")
+	}
+
+	for _, swap := range swaps {
+		swap()
+	}
+
+	applied, pending := 0, 0
+	for _, name := range sortedKeys(settings) {
+		old, val := r.settings[name], settings[name]
+		if old == val {
+			continue
+		}
+		if !isReloadable(name) {
+			pending++
+			r.logger.Log("reload", trigger, "setting", name, "from", redactSetting(name, old), "to", redactSetting(name, val), "applied", false)
+			continue
+		}
+		applied++
+		r.logger.Log("reload", trigger, "setting", name, "from", redactSetting(name, old), "to", redactSetting(name, val), "applied", true)
+		r.settings[name] = val
+	}
+	r.catalog = catalog
+	r.rules = rules
+	r.metrics.pending.Set(float64(pending))
+	r.logger.Log("reload", trigger, "settings", applied, "restart", pending, "replaced", strings.Join(replaced, ","),
+		"doorsAdded", strings.Join(added, ","), "doorsRemoved", strings.Join(removed, ","), "doorsChanged", strings.Join(changed, ","),
+		"alertRules", len(rules))
+	return nil
+}
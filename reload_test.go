@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	usermodel "users/model"
+
+	"accessdoor/base"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+)
+
+func TestIsReloadable(t *testing.T) {
+	tests := []struct {
+		name       string
+		reloadable bool
+	}{
+		{name: "proxy.getuserurl", reloadable: true},
+		{name: "proxy.eventupdate", reloadable: true},
+		{name: "outbound.service.attempts", reloadable: true},
+		{name: "service.timeout", reloadable: true},
+		{name: "log.level", reloadable: true},
+		{name: "doors.catalog", reloadable: true},
+		{name: "alerts.rules", reloadable: true},
+		{name: "proxy", reloadable: false},
+		{name: "log.sinks", reloadable: false},
+		{name: "http.port", reloadable: false},
+		{name: "service.timeouts", reloadable: false},
+	}
+	for _, test := range tests {
+		if got := isReloadable(test.name); got != test.reloadable {
+			t.Errorf("isReloadable(%q) = %v, want %v", test.name, got, test.reloadable)
+		}
+	}
+}
+
+//reloadCounts keeps the value of a counter or gauge per label set.
+type reloadCounts map[string]float64
+
+type reloadCounter struct {
+	counts reloadCounts
+	labels string
+}
+
+func (c reloadCounter) With(labelValues ...string) metrics.Counter {
+	return reloadCounter{counts: c.counts, labels: strings.Join(labelValues, " ")}
+}
+
+func (c reloadCounter) Add(delta float64) { c.counts[c.labels] += delta }
+
+type reloadGauge struct {
+	counts reloadCounts
+}
+
+func (g reloadGauge) With(...string) metrics.Gauge { return g }
+
+func (g reloadGauge) Set(value float64) { g.counts[""] = value }
+
+func (g reloadGauge) Add(delta float64) { g.counts[""] += delta }
+
+//lineLogger keeps every line logged as a map of its keyvals.
+type lineLogger struct {
+	lines []map[string]string
+}
+
+func (l *lineLogger) Log(keyvals ...interface{}) error {
+	line := map[string]string{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+	}
+	l.lines = append(l.lines, line)
+	return nil
+}
+
+//namedUsers answers GetUser with its own name, to tell which one a switch holds.
+type namedUsers struct {
+	base.UsersService
+	name string
+}
+
+func (u namedUsers) GetUser(context.Context, string) (usermodel.User, error) {
+	return usermodel.User{Username: u.name}, nil
+}
+
+//reloadFixture is the running service a reloader swaps parts of.
+type reloadFixture struct {
+	files    map[string]string
+	settings map[string]string
+	sink     *lineLogger
+	logger   *lineLogger
+	targets  reloadTargets
+	reloads  reloadCounts
+	pending  reloadCounts
+	reloader *reloader
+}
+
+const (
+	reloadCatalog = `{"Lobby": {"area": "HQ", "type": "entry"}}`
+	reloadRules   = `{"rules": [{"name": "lab", "doors": ["Lab"]}]}`
+)
+
+func newReloadFixture(t *testing.T) *reloadFixture {
+	dir := t.TempDir()
+	f := &reloadFixture{
+		files: map[string]string{
+			"config": dir + "/config.yaml",
+			"doors":  dir + "/doors.json",
+			"rules":  dir + "/rules.json",
+		},
+		sink:    &lineLogger{},
+		logger:  &lineLogger{},
+		reloads: reloadCounts{},
+		pending: reloadCounts{},
+	}
+	f.settings = map[string]string{"doors.catalog": f.files["doors"], "alerts.rules": f.files["rules"]}
+	f.write(t, "doors", reloadCatalog)
+	f.write(t, "rules", reloadRules)
+	f.writeConfig(t, nil)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	args := []string{"-config", f.files["config"]}
+	cfg, _, _, err := loadConfig(fs, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := newLogFilter(f.sink, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := base.LoadDoorCatalog(cfg.Doors.Catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doors := base.NewDoors(catalog)
+	sinks := map[string]base.AlertSink{base.AlertSinkLog: base.NewLogAlertSink(log.NewNopLogger())}
+	rules, err := base.LoadAlertRules(cfg.Alerts.Rules, sinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+	f.targets = reloadTargets{
+		logSink:    f.sink,
+		logFilter:  base.NewLoggerSwitch(filter),
+		users:      base.NewUsersSwitch(namedUsers{name: "original"}),
+		events:     base.NewEventsSwitch(nil),
+		tracer:     base.NewTracer(nil, 0),
+		api:        api,
+		apiTimeout: base.NewHandlerSwitch(http.TimeoutHandler(api, 5*time.Second, "")),
+		doors:      doors,
+		alerts:     base.NewAlertEngine(rules, doors, sinks),
+		alertSinks: sinks,
+	}
+	f.reloader = newReloader(fs, f.files["config"], catalog, f.targets,
+		reloadMetricsSet{reloads: reloadCounter{counts: f.reloads}, lastSuccess: reloadGauge{reloadCounts{}}, pending: reloadGauge{f.pending}}, f.logger)
+	f.reloader.args = args
+	return f
+}
+
+func (f *reloadFixture) write(t *testing.T, file, data string) {
+	if err := ioutil.WriteFile(f.files[file], []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//writeConfig writes the config file with changes over the fixture's settings.
+func (f *reloadFixture) writeConfig(t *testing.T, changes map[string]string) {
+	settings := map[string]string{}
+	for name, val := range f.settings {
+		settings[name] = val
+	}
+	for name, val := range changes {
+		settings[name] = val
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var config strings.Builder
+	for _, name := range names {
+		val, _ := json.Marshal(settings[name])
+		fmt.Fprintf(&config, "%v: %s\n", name, val)
+	}
+	f.write(t, "config", config.String())
+}
+
+//summary is the last line the reloader logged.
+func (f *reloadFixture) summary() map[string]string {
+	if len(f.logger.lines) == 0 {
+		return nil
+	}
+	return f.logger.lines[len(f.logger.lines)-1]
+}
+
+//user is the name of the users service the switch holds.
+func (f *reloadFixture) user(t *testing.T) string {
+	user, err := f.targets.users.GetUser(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Username
+}
+
+//status is the status of a request through the API timeout.
+func (f *reloadFixture) status() int {
+	w := httptest.NewRecorder()
+	f.targets.apiTimeout.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w.Code
+}
+
+//infoLogged tells whether an info line gets through the log filter.
+func (f *reloadFixture) infoLogged() bool {
+	before := len(f.sink.lines)
+	level.Info(f.targets.logFilter).Log("msg", "probe")
+	return len(f.sink.lines) > before
+}
+
+func TestReload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(usermodel.User{Username: r.URL.Path})
+	}))
+	defer upstream.Close()
+	proxyservices[UsersServiceName] = upstream.URL
+	defer func() { proxyservices[UsersServiceName] = "" }()
+
+	tests := []struct {
+		name     string
+		config   map[string]string
+		doors    string
+		rules    string
+		replaced string
+		pending  float64
+		check    func(*testing.T, *reloadFixture)
+	}{
+		{
+			name: "Nothing changed",
+			check: func(t *testing.T, f *reloadFixture) {
+				if f.user(t) != "original" || f.status() != http.StatusOK || !f.infoLogged() {
+					t.Error("expected nothing to be replaced")
+				}
+			},
+		},
+		{
+			name:     "Door catalog contents",
+			doors:    `{"Lobby": {"area": "HQ", "type": "entry"}, "Lab": {"area": "HQ", "type": "internal"}}`,
+			replaced: "doors",
+			check: func(t *testing.T, f *reloadFixture) {
+				if _, ok := f.targets.doors.Catalog()["Lab"]; !ok {
+					t.Error("expected the new door in the catalog")
+				}
+				if f.summary()["doorsAdded"] != "Lab" {
+					t.Errorf("unexpected summary %v", f.summary())
+				}
+				if f.user(t) != "original" {
+					t.Error("expected the proxies to be kept")
+				}
+			},
+		},
+		{
+			name:     "Alert rules contents",
+			rules:    `{"rules": [{"name": "lab", "doors": ["Lab"]}, {"name": "denied", "outcome": "denied"}]}`,
+			replaced: "alerts",
+			check: func(t *testing.T, f *reloadFixture) {
+				if n := len(f.targets.alerts.Rules()); n != 2 {
+					t.Errorf("expected 2 rules, got %v", n)
+				}
+			},
+		},
+		{
+			name:     "Log level",
+			config:   map[string]string{"log.level": "error"},
+			replaced: "log",
+			check: func(t *testing.T, f *reloadFixture) {
+				if f.infoLogged() {
+					t.Error("expected info lines to be filtered")
+				}
+			},
+		},
+		{
+			name:     "Proxy path",
+			config:   map[string]string{"proxy.getuserurl": "/users/v2/getuser"},
+			replaced: "proxies",
+			check: func(t *testing.T, f *reloadFixture) {
+				if user := f.user(t); user != "/users/v2/getuser" {
+					t.Errorf("expected the new upstream path, got %v", user)
+				}
+			},
+		},
+		{
+			name:     "Timeout",
+			config:   map[string]string{"service.timeout": "10"},
+			replaced: "timeout",
+			check: func(t *testing.T, f *reloadFixture) {
+				if status := f.status(); status != http.StatusServiceUnavailable {
+					t.Errorf("expected the new timeout, got status %v", status)
+				}
+			},
+		},
+		{
+			name:     "Several parts",
+			config:   map[string]string{"log.level": "error", "outbound.service.attempts": "2"},
+			replaced: "log,proxies",
+		},
+		{
+			name:    "Restart only setting",
+			config:  map[string]string{"http.port": "9000"},
+			pending: 1,
+			check: func(t *testing.T, f *reloadFixture) {
+				for _, line := range f.logger.lines {
+					if line["setting"] == "http.port" && line["applied"] != "false" {
+						t.Errorf("expected http.port not to be applied, got %v", line)
+					}
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newReloadFixture(t)
+			f.writeConfig(t, test.config)
+			if test.doors != "" {
+				f.write(t, "doors", test.doors)
+			}
+			if test.rules != "" {
+				f.write(t, "rules", test.rules)
+			}
+			f.reloader.reload("test")
+			if f.reloads["result success"] != 1 {
+				t.Fatalf("expected a successful reload, got %v and %v", f.reloads, f.summary())
+			}
+			if replaced := f.summary()["replaced"]; replaced != test.replaced {
+				t.Errorf("expected %q replaced, got %q", test.replaced, replaced)
+			}
+			if f.pending[""] != test.pending {
+				t.Errorf("expected %v pending, got %v", test.pending, f.pending[""])
+			}
+			if test.check != nil {
+				test.check(t, f)
+			}
+		})
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		doors  string
+		rules  string
+	}{
+		{name: "Invalid setting", config: map[string]string{"log.level": "error", "service.timeout": "0"}},
+		{name: "Unknown setting", config: map[string]string{"log.level": "error", "service.timout": "10"}},
+		{name: "Door catalog", config: map[string]string{"log.level": "error"}, doors: `{"Lab": `},
+		{name: "Alert rules", config: map[string]string{"log.level": "error"}, rules: `{"rules": [{"name": "lab", "sinks": ["pager"]}]}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newReloadFixture(t)
+			f.writeConfig(t, test.config)
+			if test.doors != "" {
+				f.write(t, "doors", test.doors)
+			}
+			if test.rules != "" {
+				f.write(t, "rules", test.rules)
+			}
+			f.reloader.reload("test")
+			if f.reloads["result failure"] != 1 || f.reloads["result success"] != 0 {
+				t.Fatalf("expected a failed reload, got %v", f.reloads)
+			}
+			//the old config stays in place, the log filter included
+			if !f.infoLogged() || len(f.targets.doors.Catalog()) != 1 || len(f.targets.alerts.Rules()) != 1 {
+				t.Error("expected the service to be left as it was")
+			}
+
+			//the changes are still seen once the files are fixed
+			f.write(t, "doors", reloadCatalog)
+			f.write(t, "rules", reloadRules)
+			f.writeConfig(t, map[string]string{"log.level": "error"})
+			f.reloader.reload("test")
+			if f.reloads["result success"] != 1 || f.summary()["replaced"] != "log" || f.infoLogged() {
+				t.Errorf("expected the log filter to be replaced, got %v", f.summary())
+			}
+		})
+	}
+}